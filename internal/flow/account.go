@@ -0,0 +1,435 @@
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	AccountTypeCash       = "CASH"
+	AccountTypeDebitCard  = "DEBIT_CARD"
+	AccountTypeCreditCard = "CREDIT_CARD"
+	AccountTypeEWallet    = "E_WALLET"
+	AccountTypeInvestment = "INVESTMENT"
+	AccountTypeOther      = "OTHER"
+)
+
+type ApiSaveAccountReq struct {
+	AccountNo      string      `desc:"Account No. A new account is created if it's empty"`
+	Name           string      `desc:"Account Name" valid:"notEmpty,maxLen:64"`
+	AccountType    string      `desc:"Account Type: CASH, DEBIT_CARD, CREDIT_CARD, E_WALLET, INVESTMENT, OTHER" valid:"member:CASH|DEBIT_CARD|CREDIT_CARD|E_WALLET|INVESTMENT|OTHER"`
+	Currency       string      `desc:"Currency" valid:"notEmpty"`
+	OpeningBalance string      `desc:"Opening Balance, negative for debt, e.g., amount owed on credit card"`
+	OpeningTime    *util.ETime `desc:"Time of the opening balance, cashflows before it are not included in the balance. All cashflows are included if it's empty"`
+	PaymentMethods []string    `desc:"Payment Methods of cashflows that are mapped to the account on import, e.g., '零钱'"`
+	CycleCloseDay  int         `desc:"Day of month the billing cycle closes, 1 to 31, only for CREDIT_CARD"`
+	PaymentDueDay  int         `desc:"Day of month the payment is due, 1 to 31, only for CREDIT_CARD"`
+	MinPaymentPct  string      `desc:"Minimum payment in percentage of the statement total, only for CREDIT_CARD, by default it's 10"`
+}
+
+type ApiAccountNoReq struct {
+	AccountNo string `desc:"Account No" valid:"notEmpty"`
+}
+
+type Account struct {
+	AccountNo      string
+	UserNo         string
+	Name           string
+	AccountType    string
+	Currency       string
+	OpeningBalance string
+	OpeningTime    *util.ETime
+}
+
+func validateCreditCardConf(cycleCloseDay int, paymentDueDay int, minPaymentPct string) error {
+	if cycleCloseDay < 1 || cycleCloseDay > 31 || paymentDueDay < 1 || paymentDueDay > 31 {
+		return miso.NewErrf("Invalid billing cycle, days should be between 1 and 31")
+	}
+	pct, err := parseAmt(minPaymentPct)
+	if err != nil || pct.Cmp(money.Zero()) < 0 || pct.Cmp(money.NewAmt("100")) > 0 {
+		return miso.NewErrf("Invalid minimum payment percentage '%v', should be between 0 and 100", minPaymentPct)
+	}
+	return nil
+}
+
+func SaveAccount(rail miso.Rail, db *gorm.DB, req ApiSaveAccountReq, user common.User) (string, error) {
+	if req.OpeningBalance == "" {
+		req.OpeningBalance = "0"
+	}
+	if req.AccountType == AccountTypeCreditCard {
+		if req.MinPaymentPct == "" {
+			req.MinPaymentPct = "10"
+		}
+		if err := validateCreditCardConf(req.CycleCloseDay, req.PaymentDueDay, req.MinPaymentPct); err != nil {
+			return "", err
+		}
+	} else {
+		req.CycleCloseDay, req.PaymentDueDay, req.MinPaymentPct = 0, 0, "0"
+	}
+	paymentMethods := normalizePaymentMethods(req.PaymentMethods)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if req.AccountNo != "" {
+			// MySQL reports 0 affected rows if nothing is changed, existence is checked beforehand
+			if _, err := findAccount(tx, req.AccountNo, user.UserNo); err != nil {
+				return err
+			}
+			t := tx.Exec(`UPDATE account SET name = ?, account_type = ?, currency = ?, opening_balance = ?, opening_time = ?,
+				cycle_close_day = ?, payment_due_day = ?, min_payment_pct = ?, updated_by = ?
+				WHERE account_no = ? AND user_no = ? AND deleted = 0`,
+				req.Name, req.AccountType, req.Currency, req.OpeningBalance, req.OpeningTime,
+				req.CycleCloseDay, req.PaymentDueDay, req.MinPaymentPct, user.Username, req.AccountNo, user.UserNo)
+			if t.Error != nil {
+				return fmt.Errorf("failed to update account, %w", t.Error)
+			}
+
+			var prevMethods []string
+			err := tx.Raw(`SELECT payment_method FROM account_payment_method WHERE account_no = ?`, req.AccountNo).
+				Scan(&prevMethods).Error
+			if err != nil {
+				return fmt.Errorf("failed to query account_payment_method, %w", err)
+			}
+			if err := tx.Exec(`DELETE FROM account_payment_method WHERE account_no = ?`, req.AccountNo).Error; err != nil {
+				return fmt.Errorf("failed to delete account_payment_method, %w", err)
+			}
+
+			// cashflows linked by the payment methods that are no longer mapped are unlinked
+			if dropped := droppedPaymentMethods(prevMethods, paymentMethods); len(dropped) > 0 {
+				t := tx.Exec(`UPDATE cashflow SET account_no = '' WHERE user_no = ? AND account_no = ? AND payment_method IN ?`,
+					user.UserNo, req.AccountNo, dropped)
+				if t.Error != nil {
+					return fmt.Errorf("failed to unlink cashflows from account, %w", t.Error)
+				}
+				rail.Infof("Unlinked %d cashflows from account %v, payment methods: %v", t.RowsAffected, req.AccountNo, dropped)
+			}
+		} else {
+			req.AccountNo = util.GenIdP("ACC_")
+			err := tx.Exec(`INSERT INTO account (account_no, user_no, name, account_type, currency, opening_balance, opening_time,
+				cycle_close_day, payment_due_day, min_payment_pct, created_by)
+				VALUES (?,?,?,?,?,?,?,?,?,?,?)`,
+				req.AccountNo, user.UserNo, req.Name, req.AccountType, req.Currency, req.OpeningBalance, req.OpeningTime,
+				req.CycleCloseDay, req.PaymentDueDay, req.MinPaymentPct, user.Username).Error
+			if err != nil {
+				return fmt.Errorf("failed to save account, %w", err)
+			}
+		}
+
+		if len(paymentMethods) < 1 {
+			return nil
+		}
+		var n int
+		err := tx.Raw(`SELECT COUNT(*) FROM account_payment_method WHERE user_no = ? AND payment_method IN ?`, user.UserNo, paymentMethods).
+			Scan(&n).Error
+		if err != nil {
+			return fmt.Errorf("failed to query account_payment_method, %w", err)
+		}
+		if n > 0 {
+			return miso.NewErrf("Payment method is already mapped to another account")
+		}
+		for _, pm := range paymentMethods {
+			err := tx.Exec(`INSERT INTO account_payment_method (user_no, payment_method, account_no) VALUES (?,?,?)`,
+				user.UserNo, pm, req.AccountNo).Error
+			if err != nil {
+				return fmt.Errorf("failed to save account_payment_method, %w", err)
+			}
+		}
+
+		// link existing cashflows that are not yet linked to any account
+		t := tx.Exec(`UPDATE cashflow SET account_no = ? WHERE user_no = ? AND payment_method IN ? AND currency = ?
+			AND account_no = '' AND deleted = 0`,
+			req.AccountNo, user.UserNo, paymentMethods, req.Currency)
+		if t.Error != nil {
+			return fmt.Errorf("failed to link cashflows to account, %w", t.Error)
+		}
+		rail.Infof("Linked %d cashflows to account %v", t.RowsAffected, req.AccountNo)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	rail.Infof("Account %v saved by %v", req.AccountNo, user.Username)
+	return req.AccountNo, markNetWorthStale(db, user.UserNo, "")
+}
+
+func normalizePaymentMethods(pm []string) []string {
+	return normalizeTags(pm)
+}
+
+// Payment methods in prev that are not in curr.
+func droppedPaymentMethods(prev []string, curr []string) []string {
+	keep := util.NewSet[string]()
+	for _, pm := range curr {
+		keep.Add(pm)
+	}
+	dropped := []string{}
+	for _, pm := range prev {
+		if !keep.Has(pm) {
+			dropped = append(dropped, pm)
+		}
+	}
+	return dropped
+}
+
+func DeleteAccount(rail miso.Rail, db *gorm.DB, req ApiAccountNoReq, user common.User) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		t := tx.Exec(`UPDATE account SET deleted = 1, updated_by = ? WHERE account_no = ? AND user_no = ? AND deleted = 0`,
+			user.Username, req.AccountNo, user.UserNo)
+		if t.Error != nil {
+			return fmt.Errorf("failed to delete account, %w", t.Error)
+		}
+		if t.RowsAffected < 1 {
+			return nil
+		}
+		if err := tx.Exec(`DELETE FROM account_payment_method WHERE account_no = ?`, req.AccountNo).Error; err != nil {
+			return fmt.Errorf("failed to delete account_payment_method, %w", err)
+		}
+		err := tx.Exec(`UPDATE cashflow SET account_no = '' WHERE user_no = ? AND account_no = ?`, user.UserNo, req.AccountNo).Error
+		if err != nil {
+			return fmt.Errorf("failed to unlink cashflows from account, %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return markNetWorthStale(db, user.UserNo, "")
+}
+
+type ApiLinkCashflowAccountReq struct {
+	Category  string `desc:"Category Code" valid:"notEmpty"`
+	TransId   string `desc:"Transaction ID" valid:"notEmpty"`
+	AccountNo string `desc:"Account No, the cashflow is unlinked if it's empty"`
+}
+
+// Link cashflow to an account manually.
+func LinkCashflowAccount(rail miso.Rail, db *gorm.DB, req ApiLinkCashflowAccountReq, user common.User) error {
+	var currency string
+	t := db.Raw(`SELECT currency FROM cashflow WHERE user_no = ? AND category = ? AND trans_id = ? AND deleted = 0`,
+		user.UserNo, req.Category, req.TransId).
+		Scan(&currency)
+	if t.Error != nil {
+		return fmt.Errorf("failed to query cashflow, %w", t.Error)
+	}
+	if t.RowsAffected < 1 {
+		return miso.NewErrf("Cashflow not found")
+	}
+	if req.AccountNo != "" {
+		acc, err := findAccount(db, req.AccountNo, user.UserNo)
+		if err != nil {
+			return err
+		}
+		if acc.Currency != currency {
+			return miso.NewErrf("Cashflow currency %v doesn't match account currency %v", currency, acc.Currency)
+		}
+	}
+	err := db.Exec(`UPDATE cashflow SET account_no = ?, updated_by = ? WHERE user_no = ? AND category = ? AND trans_id = ? AND deleted = 0`,
+		req.AccountNo, user.Username, user.UserNo, req.Category, req.TransId).Error
+	if err != nil {
+		return fmt.Errorf("failed to update cashflow account_no, %w", err)
+	}
+	return markNetWorthStale(db, user.UserNo, "")
+}
+
+func findAccount(db *gorm.DB, accountNo string, userNo string) (Account, error) {
+	var acc Account
+	t := db.Raw(`SELECT account_no, user_no, name, account_type, currency, opening_balance, opening_time FROM account
+		WHERE account_no = ? AND user_no = ? AND deleted = 0`, accountNo, userNo).
+		Scan(&acc)
+	if t.Error != nil {
+		return acc, fmt.Errorf("failed to query account, %w", t.Error)
+	}
+	if t.RowsAffected < 1 {
+		return acc, miso.NewErrf("Account not found")
+	}
+	return acc, nil
+}
+
+type paymentMethodAccount struct {
+	PaymentMethod string
+	AccountNo     string
+	Currency      string
+}
+
+// Find accounts mapped to the payment methods, the returned map is keyed by payment method.
+func findPaymentMethodAccounts(db *gorm.DB, userNo string) (map[string]paymentMethodAccount, error) {
+	var l []paymentMethodAccount
+	err := db.Raw(`SELECT m.payment_method, m.account_no, a.currency FROM account_payment_method m
+		JOIN account a ON a.account_no = m.account_no AND a.deleted = 0
+		WHERE m.user_no = ?`, userNo).
+		Scan(&l).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query account_payment_method, %w", err)
+	}
+	m := make(map[string]paymentMethodAccount, len(l))
+	for _, v := range l {
+		m[v.PaymentMethod] = v
+	}
+	return m, nil
+}
+
+// Find account the cashflow is linked to on import, cashflows in other currencies are not linked.
+func paymentMethodAccountOf(accounts map[string]paymentMethodAccount, paymentMethod string, currency string) string {
+	if acc, ok := accounts[paymentMethod]; ok && acc.Currency == currency {
+		return acc.AccountNo
+	}
+	return ""
+}
+
+type ApiListAccountRes struct {
+	AccountNo      string      `desc:"Account No"`
+	Name           string      `desc:"Account Name"`
+	AccountType    string      `desc:"Account Type"`
+	Currency       string      `desc:"Currency"`
+	OpeningBalance string      `desc:"Opening Balance"`
+	OpeningTime    *util.ETime `desc:"Time of the opening balance"`
+	Balance        string      `desc:"Current Balance" gorm:"-"`
+	PaymentMethods []string    `desc:"Payment Methods mapped to the account" gorm:"-"`
+	CycleCloseDay  int         `desc:"Day of month the billing cycle closes, only for CREDIT_CARD"`
+	PaymentDueDay  int         `desc:"Day of month the payment is due, only for CREDIT_CARD"`
+	MinPaymentPct  string      `desc:"Minimum payment in percentage of the statement total, only for CREDIT_CARD"`
+	CreatedAt      util.ETime  `desc:"Create Time"`
+}
+
+// List accounts with current balances.
+func ListAccounts(rail miso.Rail, db *gorm.DB, user common.User) ([]ApiListAccountRes, error) {
+	var l []ApiListAccountRes
+	err := db.Raw(`SELECT account_no, name, account_type, currency, opening_balance, opening_time,
+		cycle_close_day, payment_due_day, min_payment_pct, created_at FROM account
+		WHERE user_no = ? AND deleted = 0 ORDER BY id`, user.UserNo).
+		Scan(&l).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list account, %w", err)
+	}
+
+	var pms []struct {
+		PaymentMethod string
+		AccountNo     string
+	}
+	err = db.Raw(`SELECT payment_method, account_no FROM account_payment_method WHERE user_no = ? ORDER BY id`, user.UserNo).
+		Scan(&pms).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query account_payment_method, %w", err)
+	}
+
+	now := time.Now()
+	for i, a := range l {
+		bal, err := calcAccountBalance(db, Account{AccountNo: a.AccountNo, UserNo: user.UserNo, Currency: a.Currency,
+			OpeningBalance: a.OpeningBalance, OpeningTime: a.OpeningTime}, now)
+		if err != nil {
+			return nil, err
+		}
+		l[i].Balance = money.UnitFmt(bal.String(), a.Currency)
+		l[i].OpeningBalance = money.UnitFmt(a.OpeningBalance, a.Currency)
+		l[i].PaymentMethods = []string{}
+		for _, pm := range pms {
+			if pm.AccountNo == a.AccountNo {
+				l[i].PaymentMethods = append(l[i].PaymentMethods, pm.PaymentMethod)
+			}
+		}
+	}
+	return l, nil
+}
+
+// Calculate balance of the account at the given time.
+func calcAccountBalance(db *gorm.DB, acc Account, at time.Time) (*money.Amt, error) {
+	var sum string
+	tx := db.Table("cashflow").
+		Select("COALESCE(SUM(case when direction = 'IN' then amount else (-1 * amount) end), 0)").
+		Where("user_no = ?", acc.UserNo).
+		Where("account_no = ?", acc.AccountNo).
+		Where("currency = ?", acc.Currency).
+		Where("trans_time <= ?", at).
+		Where("deleted = 0")
+	if acc.OpeningTime != nil {
+		tx = tx.Where("trans_time >= ?", acc.OpeningTime)
+	}
+	if err := tx.Scan(&sum).Error; err != nil {
+		return nil, fmt.Errorf("failed to calculate account balance, %w", err)
+	}
+	return money.NewAmt(acc.OpeningBalance).Add(money.NewAmt(sum)), nil
+}
+
+type ApiAccountBalanceHistoryReq struct {
+	AccountNo string      `desc:"Account No" valid:"notEmpty"`
+	AggType   string      `desc:"Aggregation Type." valid:"member:YEARLY|MONTHLY|WEEKLY"`
+	StartTime util.ETime  `desc:"Start time"`
+	EndTime   *util.ETime `desc:"End time, by default it's current time"`
+}
+
+type ApiAccountBalance struct {
+	AggRange string `desc:"Aggregation Range"`
+	Balance  string `desc:"Balance at the end of the period"`
+}
+
+// List closing balances of the account for each period.
+func AccountBalanceHistory(rail miso.Rail, db *gorm.DB, req ApiAccountBalanceHistoryReq, user common.User) ([]ApiAccountBalance, error) {
+	acc, err := findAccount(db, req.AccountNo, user.UserNo)
+	if err != nil {
+		return nil, err
+	}
+	end := time.Now()
+	if req.EndTime != nil {
+		end = req.EndTime.ToTime()
+	}
+	ranges := aggRangesBetween(req.AggType, req.StartTime.ToTime(), end)
+	if len(ranges) < 1 {
+		return []ApiAccountBalance{}, nil
+	}
+	last, err := ParseAggRangeTime(req.AggType, ranges[len(ranges)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	var daily []dailyCashflowSum
+	tx := db.Table("cashflow").
+		Select(`DATE_FORMAT(trans_time, '%Y%m%d') trans_date, currency,
+			SUM(case when direction = 'IN' then amount else (-1 * amount) end) amount_sum`).
+		Where("user_no = ?", acc.UserNo).
+		Where("account_no = ?", acc.AccountNo).
+		Where("currency = ?", acc.Currency).
+		Where("trans_time <= ?", aggTimeRange(req.AggType, last.ToTime()).End).
+		Where("deleted = 0")
+	if acc.OpeningTime != nil {
+		tx = tx.Where("trans_time >= ?", acc.OpeningTime)
+	}
+	if err := tx.Group("trans_date, currency").Scan(&daily).Error; err != nil {
+		return nil, fmt.Errorf("failed to query account daily cashflows, %w", err)
+	}
+
+	bal, err := rollAccountBalances(money.NewAmt(acc.OpeningBalance), daily, req.AggType, ranges)
+	if err != nil {
+		return nil, err
+	}
+	return util.MapTo(bal, func(b ApiAccountBalance) ApiAccountBalance {
+		b.Balance = money.UnitFmt(b.Balance, acc.Currency)
+		return b
+	}), nil
+}
+
+// Accumulate daily net amounts on top of the opening balance, and take closing balance of each period.
+func rollAccountBalances(opening *money.Amt, daily []dailyCashflowSum, aggType string, ranges []string) ([]ApiAccountBalance, error) {
+	sort.Slice(daily, func(i, j int) bool { return daily[i].TransDate < daily[j].TransDate })
+
+	res := make([]ApiAccountBalance, 0, len(ranges))
+	bal := opening
+	i := 0
+	for _, rng := range ranges {
+		st, err := ParseAggRangeTime(aggType, rng)
+		if err != nil {
+			return nil, err
+		}
+		periodEnd := aggTimeRange(aggType, st.ToTime()).End.Format("20060102")
+		for ; i < len(daily) && daily[i].TransDate <= periodEnd; i++ {
+			bal = bal.Add(money.NewAmt(daily[i].AmountSum))
+		}
+		res = append(res, ApiAccountBalance{AggRange: rng, Balance: bal.String()})
+	}
+	return res, nil
+}
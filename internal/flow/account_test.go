@@ -0,0 +1,78 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+)
+
+func TestRollAccountBalances(t *testing.T) {
+	daily := []dailyCashflowSum{
+		{TransDate: "20240315", Currency: "CNY", AmountSum: "-50"},
+		{TransDate: "20240105", Currency: "CNY", AmountSum: "200"},
+		{TransDate: "20240131", Currency: "CNY", AmountSum: "-100"},
+	}
+	res, err := rollAccountBalances(money.NewAmt("1000"), daily, AggTypeMonthly, []string{"202401", "202402", "202403"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"1100", "1100", "1050"}
+	for i, r := range res {
+		if r.Balance != exp[i] {
+			t.Fatalf("%v balance: %v, expected: %v", r.AggRange, r.Balance, exp[i])
+		}
+	}
+}
+
+func TestValidateCreditCardConf(t *testing.T) {
+	type tc struct {
+		close, due int
+		pct        string
+		ok         bool
+	}
+	tab := []tc{
+		{1, 31, "10", true},
+		{25, 10, "0", true},
+		{25, 10, "100", true},
+		{25, 10, "12.5", true},
+		{0, 10, "10", false},
+		{25, 0, "10", false},
+		{32, 10, "10", false},
+		{25, 32, "10", false},
+		{25, 10, "-1", false},
+		{25, 10, "100.01", false},
+		{25, 10, "abc", false},
+		{25, 10, "", false},
+	}
+	for _, c := range tab {
+		err := validateCreditCardConf(c.close, c.due, c.pct)
+		if (err == nil) != c.ok {
+			t.Fatalf("%+v, err: %v", c, err)
+		}
+	}
+}
+
+func TestDroppedPaymentMethods(t *testing.T) {
+	dropped := droppedPaymentMethods([]string{"零钱", "招商银行(1234)", "花呗"}, []string{"花呗", "余额宝"})
+	if len(dropped) != 2 || dropped[0] != "零钱" || dropped[1] != "招商银行(1234)" {
+		t.Fatalf("dropped: %v", dropped)
+	}
+	if dropped := droppedPaymentMethods([]string{"零钱"}, []string{"零钱"}); len(dropped) != 0 {
+		t.Fatalf("dropped: %v", dropped)
+	}
+}
+
+func TestPaymentMethodAccountOf(t *testing.T) {
+	accounts := map[string]paymentMethodAccount{
+		"零钱": {PaymentMethod: "零钱", AccountNo: "ACC_1", Currency: "CNY"},
+	}
+	if acc := paymentMethodAccountOf(accounts, "零钱", "CNY"); acc != "ACC_1" {
+		t.Fatalf("acc: %v", acc)
+	}
+	if acc := paymentMethodAccountOf(accounts, "零钱", "USD"); acc != "" {
+		t.Fatalf("currency mismatch, acc: %v", acc)
+	}
+	if acc := paymentMethodAccountOf(accounts, "花呗", "CNY"); acc != "" {
+		t.Fatalf("not mapped, acc: %v", acc)
+	}
+}
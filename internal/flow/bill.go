@@ -0,0 +1,227 @@
+package flow
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/rabbit"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	BillSourceTemplate     = "TEMPLATE"
+	BillSourceSubscription = "SUBSCRIPTION"
+
+	PropBillRemindDaysBefore = "acct.bill.remind-days-before"
+
+	defaultUpcomingBillDays = 30
+
+	billDueDateFormat = "2006-01-02"
+)
+
+var (
+	BillReminderPipeline = rabbit.NewEventPipeline[BillReminderEvent]("acct:bill:reminder").
+		Document("BillReminderPipeline", "Bill reminder event, sent a configurable number of days before the bill is due", "acct")
+)
+
+func init() {
+	miso.SetDefProp(PropBillRemindDaysBefore, 3)
+}
+
+type BillReminderEvent struct {
+	UserNo       string     `desc:"User No"`
+	Source       string     `desc:"Source of the bill: TEMPLATE, SUBSCRIPTION"`
+	BillKey      string     `desc:"Key of the bill, it's the template no for TEMPLATE"`
+	Name         string     `desc:"Name of the bill"`
+	Counterparty string     `desc:"Counterparty of the transaction"`
+	Category     string     `desc:"Category Code"`
+	Amount       string     `desc:"Amount, it's the average amount for SUBSCRIPTION"`
+	Currency     string     `desc:"Currency"`
+	DueTime      util.ETime `desc:"Due time of the bill"`
+	DaysLeft     int        `desc:"Number of days left before the bill is due"`
+}
+
+type ApiUpcomingBillsReq struct {
+	Days int `desc:"Bills due in the next N days are listed, by default it's 30"`
+}
+
+type ApiUpcomingBill struct {
+	Source       string     `desc:"Source of the bill: TEMPLATE, SUBSCRIPTION"`
+	BillKey      string     `desc:"Key of the bill, it's the template no for TEMPLATE"`
+	Name         string     `desc:"Name of the bill"`
+	Counterparty string     `desc:"Counterparty of the transaction"`
+	Category     string     `desc:"Category Code"`
+	Amount       string     `desc:"Amount, it's the average amount for SUBSCRIPTION"`
+	Currency     string     `desc:"Currency"`
+	DueTime      util.ETime `desc:"Due time of the bill"`
+}
+
+// List bills (outgoing cashflows) due in the next N days, based on cashflow templates and detected subscriptions.
+func UpcomingBills(rail miso.Rail, db *gorm.DB, req ApiUpcomingBillsReq, user common.User) ([]ApiUpcomingBill, error) {
+	days := req.Days
+	if days < 1 {
+		days = defaultUpcomingBillDays
+	}
+	now := time.Now()
+	return listUpcomingBills(rail, db, user.UserNo, now, now.AddDate(0, 0, days))
+}
+
+func listUpcomingBills(rail miso.Rail, db *gorm.DB, userNo string, from time.Time, to time.Time) ([]ApiUpcomingBill, error) {
+	var templates []CashflowTemplate
+	err := db.Raw(`SELECT template_no, user_no, name, direction, amount, currency, counterparty, payment_method, category, remark,
+		schedule, end_time, next_due_time, created_by
+		FROM cashflow_template WHERE user_no = ? AND direction = ? AND enabled = 1 AND deleted = 0 AND next_due_time <= ?`,
+		userNo, DirectionOut, to).
+		Scan(&templates).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cashflow_template, %w", err)
+	}
+
+	subs, err := DetectRecurringCashflows(rail, db, ApiDetectRecurringReq{}, common.User{UserNo: userNo})
+	if err != nil {
+		return nil, err
+	}
+	return collectUpcomingBills(templates, subs, from, to), nil
+}
+
+func collectUpcomingBills(templates []CashflowTemplate, subs []ApiRecurringCashflow, from time.Time, to time.Time) []ApiUpcomingBill {
+	bills := []ApiUpcomingBill{}
+	covered := util.NewSet[string]()
+	for _, t := range templates {
+		covered.Add(billCounterpartyKey(t.Currency, t.Counterparty))
+		if t.NextDueTime == nil {
+			continue
+		}
+		sched, err := parseTemplateSchedule(t.Schedule)
+		if err != nil {
+			continue
+		}
+		var end *time.Time
+		if t.EndTime != nil {
+			et := t.EndTime.ToTime()
+			end = &et
+		}
+		for _, d := range templateDueTimes(sched, t.NextDueTime.ToTime(), end, to) {
+			if d.Before(from) {
+				continue
+			}
+			bills = append(bills, ApiUpcomingBill{
+				Source:       BillSourceTemplate,
+				BillKey:      t.TemplateNo,
+				Name:         t.Name,
+				Counterparty: t.Counterparty,
+				Category:     t.Category,
+				Amount:       money.UnitFmt(t.Amount, t.Currency),
+				Currency:     t.Currency,
+				DueTime:      util.ToETime(d),
+			})
+		}
+	}
+
+	for _, s := range subs {
+		// subscriptions that are already scheduled by templates are ignored
+		if !s.Active || s.Direction != DirectionOut || covered.Has(billCounterpartyKey(s.Currency, s.Counterparty)) {
+			continue
+		}
+		due := s.NextExpected.ToTime()
+		if due.Before(from) || due.After(to) {
+			continue
+		}
+		bills = append(bills, ApiUpcomingBill{
+			Source:       BillSourceSubscription,
+			BillKey:      subscriptionBillKey(s),
+			Name:         s.Counterparty,
+			Counterparty: s.Counterparty,
+			Category:     s.Category,
+			Amount:       s.AvgAmount,
+			Currency:     s.Currency,
+			DueTime:      s.NextExpected,
+		})
+	}
+
+	sort.SliceStable(bills, func(i, j int) bool { return bills[i].DueTime.Before(bills[j].DueTime) })
+	return bills
+}
+
+func billCounterpartyKey(currency string, counterparty string) string {
+	return currency + ":" + strings.ToLower(strings.TrimSpace(counterparty))
+}
+
+func subscriptionBillKey(s ApiRecurringCashflow) string {
+	h := sha1.Sum([]byte(s.Cadence + ":" + billCounterpartyKey(s.Currency, s.Counterparty)))
+	return hex.EncodeToString(h[:])
+}
+
+// Reminders are sent days before the bills are due, it runs daily since subscriptions are detected for every user on each run.
+func ScheduleBillReminderJob() error {
+	return miso.ScheduleDistributedTask(miso.Job{
+		Name:                   "SendBillRemindersJob",
+		Cron:                   "0 8 * * *",
+		Run:                    func(rail miso.Rail) error { return SendBillReminders(rail, miso.GetMySQL()) },
+		TriggeredOnBoostrapped: true,
+	})
+}
+
+// Publish BillReminderEvent for bills due within the configured days, each bill is only reminded once per due date.
+func SendBillReminders(rail miso.Rail, db *gorm.DB) error {
+	now := time.Now()
+	to := now.AddDate(0, 0, miso.GetPropInt(PropBillRemindDaysBefore))
+
+	var users []string
+	err := db.Raw(`SELECT user_no FROM cashflow_template WHERE direction = ? AND enabled = 1 AND deleted = 0
+		UNION SELECT DISTINCT user_no FROM cashflow WHERE direction = ? AND trans_time >= ? AND deleted = 0`,
+		DirectionOut, DirectionOut, now.AddDate(-2, 0, 0)).
+		Scan(&users).Error
+	if err != nil {
+		return fmt.Errorf("failed to list users with bills, %w", err)
+	}
+
+	for _, userNo := range users {
+		bills, err := listUpcomingBills(rail, db, userNo, now, to)
+		if err != nil {
+			rail.Errorf("Failed to list upcoming bills for %v, %v", userNo, err)
+			continue
+		}
+		for _, b := range bills {
+			if err := remindBill(rail, db, userNo, b, now); err != nil {
+				rail.Errorf("Failed to send bill reminder for %v, bill: %v, %v", userNo, b.BillKey, err)
+			}
+		}
+	}
+	return nil
+}
+
+func remindBill(rail miso.Rail, db *gorm.DB, userNo string, b ApiUpcomingBill, now time.Time) error {
+	// the reminder record is rolled back if the event is not published, so that it's retried on next run
+	return db.Transaction(func(tx *gorm.DB) error {
+		t := tx.Exec(`INSERT IGNORE INTO bill_reminder (user_no, bill_key, due_date) VALUES (?,?,?)`,
+			userNo, b.BillKey, b.DueTime.Format(billDueDateFormat))
+		if t.Error != nil {
+			return fmt.Errorf("failed to save bill_reminder, %w", t.Error)
+		}
+		if t.RowsAffected < 1 {
+			return nil // already reminded
+		}
+		rail.Infof("Reminding bill %v (%v) for %v, due at %v", b.BillKey, b.Name, userNo, b.DueTime)
+		return BillReminderPipeline.Send(rail, BillReminderEvent{
+			UserNo:       userNo,
+			Source:       b.Source,
+			BillKey:      b.BillKey,
+			Name:         b.Name,
+			Counterparty: b.Counterparty,
+			Category:     b.Category,
+			Amount:       b.Amount,
+			Currency:     b.Currency,
+			DueTime:      b.DueTime,
+			DaysLeft:     int(b.DueTime.ToTime().Sub(now).Hours() / 24),
+		})
+	})
+}
@@ -0,0 +1,46 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/util"
+)
+
+func TestCollectUpcomingBills(t *testing.T) {
+	from := time.Date(2024, 3, 20, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 0, 30)
+	next := util.ToETime(time.Date(2024, 4, 1, 9, 0, 0, 0, time.Local))
+
+	templates := []CashflowTemplate{{
+		TemplateNo:   "TPL_1",
+		Name:         "Rent",
+		Direction:    DirectionOut,
+		Amount:       "3000",
+		Currency:     "CNY",
+		Counterparty: "Landlord",
+		Schedule:     "0 9 1 * *",
+		NextDueTime:  &next,
+	}}
+	subs := []ApiRecurringCashflow{
+		{Counterparty: "landlord ", Direction: DirectionOut, Currency: "CNY", Cadence: CadenceMonthly, Active: true,
+			NextExpected: util.ToETime(from.AddDate(0, 0, 5))},
+		{Counterparty: "Netflix", Direction: DirectionOut, Currency: "USD", Cadence: CadenceMonthly, Active: true,
+			NextExpected: util.ToETime(from.AddDate(0, 0, 3)), AvgAmount: "15.99"},
+		{Counterparty: "Gym", Direction: DirectionOut, Currency: "CNY", Cadence: CadenceMonthly, Active: false,
+			NextExpected: util.ToETime(from.AddDate(0, 0, 3))},
+		{Counterparty: "Insurance", Direction: DirectionOut, Currency: "CNY", Cadence: CadenceYearly, Active: true,
+			NextExpected: util.ToETime(from.AddDate(0, 2, 0))},
+	}
+
+	bills := collectUpcomingBills(templates, subs, from, to)
+	if len(bills) != 2 {
+		t.Fatalf("bills: %+v", bills)
+	}
+	if bills[0].Source != BillSourceSubscription || bills[0].Counterparty != "Netflix" {
+		t.Fatalf("first bill: %+v", bills[0])
+	}
+	if bills[1].Source != BillSourceTemplate || bills[1].BillKey != "TPL_1" || !bills[1].DueTime.Equal(next.ToTime()) {
+		t.Fatalf("second bill: %+v", bills[1])
+	}
+}
@@ -0,0 +1,403 @@
+package flow
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/rabbit"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	// scale of projected spending before it's rounded to the currency's scale
+	budgetDivScale = 8
+)
+
+var (
+	// percentages of budget used that trigger alerts
+	BudgetAlertThresholds = []int{80, 100}
+
+	BudgetAlertPipeline = rabbit.NewEventPipeline[BudgetAlertEvent]("acct:budget:alert").
+				Document("BudgetAlertPipeline", "Budget alert event, sent when spending of a budget period crosses one of the thresholds", "acct")
+)
+
+type BudgetAlertEvent struct {
+	UserNo     string `desc:"User No"`
+	BudgetNo   string `desc:"Budget No"`
+	BudgetName string `desc:"Budget Name"`
+	Category   string `desc:"Category Code"`
+	Currency   string `desc:"Currency"`
+	PeriodType string `desc:"Budget Period Type"`
+	AggRange   string `desc:"Aggregation Range of the budget period"`
+	Threshold  int    `desc:"Percentage of budget used that triggers the alert"`
+	Amount     string `desc:"Spending limit of the period"`
+	Spent      string `desc:"Amount spent in the period"`
+}
+
+type ApiSaveBudgetReq struct {
+	BudgetNo   string `desc:"Budget No. A new budget is created if it's empty"`
+	Name       string `desc:"Budget Name" valid:"notEmpty,maxLen:64"`
+	Category   string `desc:"Category Code. Cashflows of all categories are included if it's empty"`
+	Currency   string `desc:"Currency" valid:"notEmpty"`
+	PeriodType string `desc:"Budget Period Type." valid:"member:YEARLY|MONTHLY|WEEKLY"`
+	Amount     string `desc:"Spending limit of each period" valid:"notEmpty"`
+}
+
+type ApiBudgetNoReq struct {
+	BudgetNo string `desc:"Budget No" valid:"notEmpty"`
+}
+
+type Budget struct {
+	BudgetNo   string
+	UserNo     string
+	Name       string
+	Category   string
+	Currency   string
+	PeriodType string
+	Amount     string
+}
+
+func SaveBudget(rail miso.Rail, db *gorm.DB, req ApiSaveBudgetReq, user common.User) (string, error) {
+	if money.NewAmt(req.Amount).Cmp(money.Zero()) <= 0 {
+		return "", miso.NewErrf("Invalid budget amount '%v'", req.Amount)
+	}
+
+	if req.BudgetNo != "" {
+		// MySQL reports 0 affected rows if nothing is changed, existence is checked beforehand
+		if _, err := findBudget(db, req.BudgetNo, user.UserNo); err != nil {
+			return "", err
+		}
+		t := db.Exec(`UPDATE budget SET name = ?, category = ?, currency = ?, period_type = ?, amount = ?, updated_by = ?
+			WHERE budget_no = ? AND user_no = ? AND deleted = 0`,
+			req.Name, req.Category, req.Currency, req.PeriodType, req.Amount, user.Username, req.BudgetNo, user.UserNo)
+		if t.Error != nil {
+			return "", fmt.Errorf("failed to update budget, %w", t.Error)
+		}
+
+		// category, currency or period type may have changed, spending of past periods is recalculated on demand
+		if err := db.Exec(`DELETE FROM budget_spending WHERE budget_no = ?`, req.BudgetNo).Error; err != nil {
+			return "", fmt.Errorf("failed to delete budget_spending, %w", err)
+		}
+	} else {
+		req.BudgetNo = util.GenIdP("BGT_")
+		err := db.Exec(`INSERT INTO budget (budget_no, user_no, name, category, currency, period_type, amount, created_by)
+			VALUES (?,?,?,?,?,?,?,?)`,
+			req.BudgetNo, user.UserNo, req.Name, req.Category, req.Currency, req.PeriodType, req.Amount, user.Username).Error
+		if err != nil {
+			return "", fmt.Errorf("failed to save budget, %w", err)
+		}
+	}
+	rail.Infof("Budget %v saved by %v", req.BudgetNo, user.Username)
+
+	// spending of the current period is calculated right away, the following ones are maintained by cashflow changes
+	now := time.Now()
+	if err := CalcBudgetSpending(rail, db, user.UserNo, req.PeriodType, aggRangeOf(req.PeriodType, now)); err != nil {
+		return req.BudgetNo, err
+	}
+	return req.BudgetNo, nil
+}
+
+func findBudget(db *gorm.DB, budgetNo string, userNo string) (Budget, error) {
+	var b Budget
+	t := db.Raw(`SELECT budget_no, user_no, name, category, currency, period_type, amount FROM budget
+		WHERE budget_no = ? AND user_no = ? AND deleted = 0`, budgetNo, userNo).
+		Scan(&b)
+	if t.Error != nil {
+		return b, fmt.Errorf("failed to query budget, %w", t.Error)
+	}
+	if t.RowsAffected < 1 {
+		return b, miso.NewErrf("Budget not found")
+	}
+	return b, nil
+}
+
+func DeleteBudget(rail miso.Rail, db *gorm.DB, req ApiBudgetNoReq, user common.User) error {
+	err := db.Exec(`UPDATE budget SET deleted = 1, updated_by = ? WHERE budget_no = ? AND user_no = ?`,
+		user.Username, req.BudgetNo, user.UserNo).Error
+	if err != nil {
+		return fmt.Errorf("failed to delete budget, %w", err)
+	}
+	return nil
+}
+
+type ApiListBudgetReq struct {
+	Paging     miso.Paging `desc:"Paging"`
+	PeriodType string      `desc:"Budget Period Type." valid:"member:YEARLY|MONTHLY|WEEKLY|"`
+	Category   string      `desc:"Category Code"`
+}
+
+type ApiListBudgetRes struct {
+	BudgetNo   string     `desc:"Budget No"`
+	Name       string     `desc:"Budget Name"`
+	Category   string     `desc:"Category Code"`
+	Currency   string     `desc:"Currency"`
+	PeriodType string     `desc:"Budget Period Type"`
+	Amount     string     `desc:"Spending limit of each period"`
+	CreatedAt  util.ETime `desc:"Create Time"`
+}
+
+func ListBudgets(rail miso.Rail, db *gorm.DB, req ApiListBudgetReq, user common.User) (miso.PageRes[ApiListBudgetRes], error) {
+	return miso.NewPageQuery[ApiListBudgetRes]().
+		WithPage(req.Paging).
+		WithBaseQuery(func(tx *gorm.DB) *gorm.DB {
+			tx = tx.Table(`budget`).
+				Where("user_no = ?", user.UserNo).
+				Where("deleted = 0")
+			if req.PeriodType != "" {
+				tx = tx.Where("period_type = ?", req.PeriodType)
+			}
+			if req.Category != "" {
+				tx = tx.Where("category = ?", req.Category)
+			}
+			return tx
+		}).
+		WithSelectQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Select("budget_no", "name", "category", "currency", "period_type", "amount", "created_at").
+				Order("id desc")
+		}).
+		ForEach(func(t ApiListBudgetRes) ApiListBudgetRes {
+			t.Amount = money.UnitFmt(t.Amount, t.Currency)
+			return t
+		}).
+		Exec(rail, db)
+}
+
+func listUserBudgets(db *gorm.DB, userNo string, periodType string) ([]Budget, error) {
+	var budgets []Budget
+	err := db.Raw(`SELECT budget_no, user_no, name, category, currency, period_type, amount FROM budget
+		WHERE user_no = ? AND period_type = ? AND deleted = 0`, userNo, periodType).
+		Scan(&budgets).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list budgets, %w", err)
+	}
+	return budgets, nil
+}
+
+// Calculate amount spent for each of the user's budgets in the aggregation range.
+//
+// It's triggered by the same events that recalculate cashflow statistics.
+func CalcBudgetSpending(rail miso.Rail, db *gorm.DB, userNo string, aggType string, aggRange string) error {
+	budgets, err := listUserBudgets(db, userNo, aggType)
+	if err != nil || len(budgets) < 1 {
+		return err
+	}
+	t, err := ParseAggRangeTime(aggType, aggRange)
+	if err != nil {
+		return err
+	}
+	tr := aggTimeRange(aggType, t.ToTime())
+
+	for _, b := range budgets {
+		spent, err := calcBudgetSpent(db, b, tr)
+		if err != nil {
+			return err
+		}
+		err = db.Exec(`INSERT INTO budget_spending (budget_no, user_no, agg_range, spent) VALUES (?,?,?,?)
+			ON DUPLICATE KEY UPDATE spent = VALUES(spent)`, b.BudgetNo, userNo, aggRange, spent).Error
+		if err != nil {
+			return fmt.Errorf("failed to save budget_spending, %w", err)
+		}
+		rail.Debugf("Budget %v spent %v in %v", b.BudgetNo, spent, aggRange)
+
+		if budgetAlertable(aggType, aggRange, time.Now()) {
+			if err := alertBudgetThresholds(rail, db, b, aggRange, spent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Whether crossing thresholds in the period is alerted.
+//
+// Late imports into the previous period are still worth notifying, but recalculation of older or future periods is not.
+func budgetAlertable(aggType string, aggRange string, now time.Time) bool {
+	cur := aggRangeOf(aggType, now)
+	prev := aggRangeOf(aggType, aggTimeRange(aggType, now).Start.Add(-time.Second))
+	return aggRange == cur || aggRange == prev
+}
+
+// Claim the threshold of the budget period, send is only called if it's not claimed before, and the claim is rolled back
+// if send fails.
+type budgetAlertClaimer func(b Budget, aggRange string, threshold int, send func() error) error
+
+func dbBudgetAlertClaimer(db *gorm.DB) budgetAlertClaimer {
+	return func(b Budget, aggRange string, threshold int, send func() error) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			t := tx.Exec(`INSERT IGNORE INTO budget_alert (budget_no, user_no, agg_range, threshold) VALUES (?,?,?,?)`,
+				b.BudgetNo, b.UserNo, aggRange, threshold)
+			if t.Error != nil {
+				return fmt.Errorf("failed to save budget_alert, %w", t.Error)
+			}
+			if t.RowsAffected < 1 {
+				return nil // already alerted
+			}
+			return send()
+		})
+	}
+}
+
+// Publish BudgetAlertEvent for each threshold crossed, each threshold is only alerted once per period.
+func alertBudgetThresholds(rail miso.Rail, db *gorm.DB, b Budget, aggRange string, spent string) error {
+	return sendBudgetAlerts(rail, b, aggRange, spent, dbBudgetAlertClaimer(db), BudgetAlertPipeline.Send)
+}
+
+func sendBudgetAlerts(rail miso.Rail, b Budget, aggRange string, spent string, claim budgetAlertClaimer,
+	send func(rail miso.Rail, evt BudgetAlertEvent) error) error {
+
+	amt := money.NewAmt(b.Amount)
+	if amt.Cmp(money.Zero()) <= 0 {
+		return nil
+	}
+	usedPct := money.NewAmt(spent).Mul(money.NewAmt("100")).Div(amt, 2)
+
+	for _, th := range BudgetAlertThresholds {
+		if usedPct.Cmp(money.NewAmt(fmt.Sprintf("%d", th))) < 0 {
+			continue
+		}
+		err := claim(b, aggRange, th, func() error {
+			rail.Infof("Budget %v used %v%% in %v, crossed threshold %v%%", b.BudgetNo, usedPct, aggRange, th)
+			return send(rail, BudgetAlertEvent{
+				UserNo:     b.UserNo,
+				BudgetNo:   b.BudgetNo,
+				BudgetName: b.Name,
+				Category:   b.Category,
+				Currency:   b.Currency,
+				PeriodType: b.PeriodType,
+				AggRange:   aggRange,
+				Threshold:  th,
+				Amount:     money.UnitFmt(b.Amount, b.Currency),
+				Spent:      money.UnitFmt(spent, b.Currency),
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func calcBudgetSpent(db *gorm.DB, b Budget, tr TimeRange) (string, error) {
+	var spent string
+	tx := db.Table("cashflow").
+		Select("COALESCE(SUM(amount), 0)").
+		Where("user_no = ?", b.UserNo).
+		Where("direction = ?", DirectionOut).
+		Where("currency = ?", b.Currency).
+		Where("trans_time between ? and ?", tr.Start, tr.End).
+		Where("transfer_no = ''").
+		Where("stat_excluded = 0").
+		Where("deleted = 0")
+	if b.Category != "" {
+		tx = tx.Where("category = ?", b.Category)
+	}
+	if err := tx.Scan(&spent).Error; err != nil {
+		return "", fmt.Errorf("failed to query budget spent, %w", err)
+	}
+	return spent, nil
+}
+
+type ApiBudgetProgressReq struct {
+	Time       *util.ETime `desc:"Budget progress of the periods that contain the time, by default it's current time"`
+	PeriodType string      `desc:"Budget Period Type." valid:"member:YEARLY|MONTHLY|WEEKLY|"`
+}
+
+type ApiBudgetProgressRes struct {
+	BudgetNo   string `desc:"Budget No"`
+	Name       string `desc:"Budget Name"`
+	Category   string `desc:"Category Code"`
+	Currency   string `desc:"Currency"`
+	PeriodType string `desc:"Budget Period Type"`
+	AggRange   string `desc:"Aggregation Range of the budget period"`
+	Amount     string `desc:"Spending limit of the period"`
+	Spent      string `desc:"Amount spent in the period"`
+	Remaining  string `desc:"Remaining amount, negative if overspent"`
+	UsedPct    string `desc:"Percentage of the budget used"`
+	Projected  string `desc:"Projected spending at the end of the period"`
+}
+
+func BudgetProgress(rail miso.Rail, db *gorm.DB, req ApiBudgetProgressReq, user common.User) ([]ApiBudgetProgressRes, error) {
+	now := time.Now()
+	at := now
+	if req.Time != nil {
+		at = req.Time.ToTime()
+	}
+
+	var budgets []Budget
+	tx := db.Table("budget").
+		Select("budget_no, user_no, name, category, currency, period_type, amount").
+		Where("user_no = ?", user.UserNo).
+		Where("deleted = 0").
+		Order("id desc")
+	if req.PeriodType != "" {
+		tx = tx.Where("period_type = ?", req.PeriodType)
+	}
+	if err := tx.Scan(&budgets).Error; err != nil {
+		return nil, fmt.Errorf("failed to list budgets, %w", err)
+	}
+
+	res := make([]ApiBudgetProgressRes, 0, len(budgets))
+	for _, b := range budgets {
+		rng := aggRangeOf(b.PeriodType, at)
+		tr := aggTimeRange(b.PeriodType, at)
+		spent, err := loadBudgetSpent(rail, db, b, rng, tr)
+		if err != nil {
+			return nil, err
+		}
+		amt := money.NewAmt(b.Amount)
+		spentAmt := money.NewAmt(spent)
+		res = append(res, ApiBudgetProgressRes{
+			BudgetNo:   b.BudgetNo,
+			Name:       b.Name,
+			Category:   b.Category,
+			Currency:   b.Currency,
+			PeriodType: b.PeriodType,
+			AggRange:   rng,
+			Amount:     money.UnitFmt(b.Amount, b.Currency),
+			Spent:      money.UnitFmt(spent, b.Currency),
+			Remaining:  money.UnitFmt(amt.Sub(spentAmt).String(), b.Currency),
+			UsedPct:    spentAmt.Mul(money.NewAmt("100")).Div(amt, 2).String(),
+			Projected:  money.UnitFmt(projectSpending(spentAmt, tr, now).String(), b.Currency),
+		})
+	}
+	return res, nil
+}
+
+// Load amount spent in the budget period, it's calculated and saved if the period hasn't been calculated yet.
+func loadBudgetSpent(rail miso.Rail, db *gorm.DB, b Budget, aggRange string, tr TimeRange) (string, error) {
+	var spent string
+	t := db.Raw(`SELECT spent FROM budget_spending WHERE budget_no = ? AND agg_range = ?`, b.BudgetNo, aggRange).Scan(&spent)
+	if t.Error != nil {
+		return "", fmt.Errorf("failed to query budget_spending, %w", t.Error)
+	}
+	if t.RowsAffected > 0 {
+		return spent, nil
+	}
+
+	spent, err := calcBudgetSpent(db, b, tr)
+	if err != nil {
+		return "", err
+	}
+	err = db.Exec(`INSERT IGNORE INTO budget_spending (budget_no, user_no, agg_range, spent) VALUES (?,?,?,?)`,
+		b.BudgetNo, b.UserNo, aggRange, spent).Error
+	if err != nil {
+		return "", fmt.Errorf("failed to save budget_spending, %w", err)
+	}
+	rail.Debugf("Budget %v spent %v in %v, calculated on demand", b.BudgetNo, spent, aggRange)
+	return spent, nil
+}
+
+// Project spending at the end of the period based on the spending so far.
+func projectSpending(spent *money.Amt, tr TimeRange, now time.Time) *money.Amt {
+	elapsed := now.Sub(tr.Start)
+	if !now.Before(tr.End) || elapsed < time.Second {
+		return spent
+	}
+	total := tr.End.Sub(tr.Start)
+	return spent.Mul(money.NewAmt(fmt.Sprintf("%d", int64(total/time.Second)))).
+		Div(money.NewAmt(fmt.Sprintf("%d", int64(elapsed/time.Second))), budgetDivScale)
+}
@@ -0,0 +1,99 @@
+package flow
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/miso"
+)
+
+func TestProjectSpending(t *testing.T) {
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)
+	tr := aggTimeRange(AggTypeMonthly, start)
+	tab := []struct {
+		now      time.Time
+		spent    string
+		expected string
+	}{
+		{start.AddDate(0, 0, 15), "150", "300"},
+		{start.AddDate(0, 0, -1), "0", "0"},
+		{start.AddDate(0, 1, 0), "123", "123"},
+	}
+	for _, r := range tab {
+		p := projectSpending(money.NewAmt(r.spent), tr, r.now)
+		if p.Round(0).String() != r.expected {
+			t.Fatalf("now: %v, spent: %v, expected: %v, actual: %v", r.now, r.spent, r.expected, p)
+		}
+	}
+}
+
+func TestSendBudgetAlerts(t *testing.T) {
+	claimed := map[string]bool{}
+	claim := func(b Budget, aggRange string, threshold int, send func() error) error {
+		k := fmt.Sprintf("%v:%v:%v", b.BudgetNo, aggRange, threshold)
+		if claimed[k] {
+			return nil
+		}
+		if err := send(); err != nil {
+			return err
+		}
+		claimed[k] = true
+		return nil
+	}
+	var events []BudgetAlertEvent
+	send := func(rail miso.Rail, evt BudgetAlertEvent) error {
+		events = append(events, evt)
+		return nil
+	}
+	rail := miso.EmptyRail()
+	b := Budget{BudgetNo: "BGT_1", Currency: "CNY", Amount: "100"}
+
+	// recalculated twice, the threshold is only alerted once
+	for i := 0; i < 2; i++ {
+		if err := sendBudgetAlerts(rail, b, "202406", "85", claim, send); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(events) != 1 || events[0].Threshold != 80 {
+		t.Fatalf("events: %+v", events)
+	}
+
+	if err := sendBudgetAlerts(rail, b, "202406", "120", claim, send); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[1].Threshold != 100 || events[1].Spent != "120.00" {
+		t.Fatalf("events: %+v", events)
+	}
+
+	// thresholds are alerted again in a new period
+	if err := sendBudgetAlerts(rail, b, "202407", "120", claim, send); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("events: %+v", events)
+	}
+
+	// not claimed if the event is not sent, so that it's retried
+	failed := func(rail miso.Rail, evt BudgetAlertEvent) error { return fmt.Errorf("broker down") }
+	if err := sendBudgetAlerts(rail, b, "202408", "90", claim, failed); err == nil {
+		t.Fatal("should fail")
+	}
+	if err := sendBudgetAlerts(rail, b, "202408", "90", claim, send); err != nil || len(events) != 5 {
+		t.Fatalf("retry: %v, events: %+v", err, events)
+	}
+}
+
+func TestBudgetAlertable(t *testing.T) {
+	now := time.Date(2024, 6, 3, 0, 0, 0, 0, time.Local)
+	tab := map[string]bool{"202406": true, "202405": true, "202404": false, "202407": false}
+	for rng, exp := range tab {
+		if budgetAlertable(AggTypeMonthly, rng, now) != exp {
+			t.Fatalf("range: %v, expected: %v", rng, exp)
+		}
+	}
+	if !budgetAlertable(AggTypeYearly, "2023", now) || budgetAlertable(AggTypeYearly, "2022", now) {
+		t.Fatal("yearly")
+	}
+}
@@ -54,76 +54,111 @@ type ListCashFlowReq struct {
 	TransTimeEnd   *util.ETime `desc:"Transaction Time Range End"`
 	TransId        string      `desc:"Transaction ID"`
 	Category       string      `desc:"Category Code"`
+	AccountNo      string      `desc:"Account No"`
 	MinAmt         *money.Amt  `desc:"Minimum amount"`
+	Keyword        string      `desc:"Keyword, matches counterparty, remark, payment method and values of extra info, results are ordered by relevance"`
 }
 
 type ListCashFlowRes struct {
-	Direction     string     `desc:"Flow Direction: IN / OUT"`
-	TransTime     util.ETime `desc:"Transaction Time"`
-	TransId       string     `desc:"Transaction ID"`
-	Counterparty  string     `desc:"Counterparty of the transaction"`
-	PaymentMethod string     `desc:"Payment Method"`
-	Amount        string     `desc:"Amount"`
-	Currency      string     `desc:"Currency"`
-	Extra         string     `desc:"Extra Information"`
-	Category      string     `desc:"Category Code"`
-	CategoryName  string     `desc:"Category Name"`
-	Remark        string     `desc:"Remark"`
-	CreatedAt     util.ETime `desc:"Create Time"`
+	Direction     string            `desc:"Flow Direction: IN / OUT"`
+	TransTime     util.ETime        `desc:"Transaction Time"`
+	TransId       string            `desc:"Transaction ID"`
+	Counterparty  string            `desc:"Counterparty of the transaction"`
+	PaymentMethod string            `desc:"Payment Method"`
+	Amount        string            `desc:"Amount"`
+	Currency      string            `desc:"Currency"`
+	Extra         string            `desc:"Extra Information"`
+	Category      string            `desc:"Category Code"`
+	CategoryName  string            `desc:"Category Name"`
+	Remark        string            `desc:"Remark"`
+	AccountNo     string            `desc:"Account No"`
+	TransferNo    string            `desc:"Transfer No, cashflows of the same transfer are excluded from statistics"`
+	InstallmentNo string            `desc:"Installment Plan No of the purchase or the installment"`
+	StatExcluded  bool              `desc:"Whether the cashflow is excluded from statistics, e.g., the purchase of an amortised installment plan"`
+	CreatedAt     util.ETime        `desc:"Create Time"`
+	Tags          []string          `desc:"Tags" gorm:"-"`
+	Highlights    map[string]string `desc:"Fields matching the keyword with the matched terms wrapped in <em></em>, e.g., Counterparty, Extra.商品" gorm:"-"`
 }
 
 func ListCashFlows(rail miso.Rail, db *gorm.DB, user common.User, req ListCashFlowReq) (miso.PageRes[ListCashFlowRes], error) {
-	return miso.NewPageQuery[ListCashFlowRes]().
+	terms := keywordTerms(req.Keyword)
+	res, err := miso.NewPageQuery[ListCashFlowRes]().
 		WithPage(req.Paging).
 		WithBaseQuery(func(tx *gorm.DB) *gorm.DB {
-			tx = tx.Table(`cashflow`).
-				Where("user_no = ?", user.UserNo).
-				Where("deleted = 0")
-			if req.TransId != "" {
-				tx = tx.Where("trans_id = ?", req.TransId)
-			}
-			if req.Category != "" {
-				tx = tx.Where("category = ?", req.Category)
-			}
-			if req.TransTimeStart != nil {
-				tx = tx.Where("trans_time >= ?", req.TransTimeStart)
-			}
-			if req.TransTimeEnd != nil {
-				tx = tx.Where("trans_time <= ?", req.TransTimeEnd)
-			}
-			if req.MinAmt != nil {
-				abs := req.MinAmt.Abs()
-				if abs.Cmp(money.Zero()) > 0 {
-					tx = tx.Where("amount >= ?", abs)
-					if req.MinAmt.Cmp(money.Zero()) < 0 {
-						if req.Direction != DirectionOut {
-							tx = tx.Where("direction = ?", DirectionOut)
-						}
-					} else {
-						if req.Direction != DirectionIn {
-							tx = tx.Where("direction = ?", DirectionIn)
-						}
-					}
-				}
-			}
-			if req.Direction != "" {
-				tx = tx.Where("direction = ?", req.Direction)
-			}
-			return tx
+			return filterCashflows(tx, user, req)
 		}).
 		WithSelectQuery(func(tx *gorm.DB) *gorm.DB {
-			return tx.Select("direction", "trans_time", "trans_id", "counterparty",
-				"amount", "currency", "extra", "category", "remark", "created_at", "payment_method").
-				Order("trans_time desc")
+			tx = tx.Select("direction", "trans_time", "trans_id", "counterparty",
+				"amount", "currency", "extra", "category", "remark", "created_at", "payment_method", "account_no", "transfer_no", "installment_no", "stat_excluded")
+			return orderByKeyword(tx, req.Keyword).Order("trans_time desc")
 		}).
 		ForEach(func(t ListCashFlowRes) ListCashFlowRes {
 			if v, ok := categoryConfs[t.Category]; ok {
 				t.CategoryName = v.Name
 			}
 			t.Amount = money.UnitFmt(t.Amount, t.Currency)
+			if len(terms) > 0 {
+				t.Highlights = highlightCashflow(t, terms)
+			}
 			return t
 		}).
 		Exec(rail, db)
+	if err != nil {
+		return res, err
+	}
+
+	tags, err := findCashflowTags(db, user.UserNo, util.MapTo(res.Payload, func(t ListCashFlowRes) string { return t.TransId }))
+	if err != nil {
+		return res, err
+	}
+	for i, p := range res.Payload {
+		res.Payload[i].Tags = tags[cashflowTagKey(p.Category, p.TransId)]
+	}
+	return res, nil
+}
+
+// Filter cashflows using the conditions in ListCashFlowReq, paging is not applied.
+func filterCashflows(tx *gorm.DB, user common.User, req ListCashFlowReq) *gorm.DB {
+	tx = tx.Table(`cashflow`).
+		Where("user_no = ?", user.UserNo).
+		Where("deleted = 0")
+	if req.TransId != "" {
+		tx = tx.Where("trans_id = ?", req.TransId)
+	}
+	if req.Category != "" {
+		tx = tx.Where("category = ?", req.Category)
+	}
+	if req.AccountNo != "" {
+		tx = tx.Where("account_no = ?", req.AccountNo)
+	}
+	if req.TransTimeStart != nil {
+		tx = tx.Where("trans_time >= ?", req.TransTimeStart)
+	}
+	if req.TransTimeEnd != nil {
+		tx = tx.Where("trans_time <= ?", req.TransTimeEnd)
+	}
+	if req.MinAmt != nil {
+		abs := req.MinAmt.Abs()
+		if abs.Cmp(money.Zero()) > 0 {
+			tx = tx.Where("amount >= ?", abs)
+			if req.MinAmt.Cmp(money.Zero()) < 0 {
+				if req.Direction != DirectionOut {
+					tx = tx.Where("direction = ?", DirectionOut)
+				}
+			} else {
+				if req.Direction != DirectionIn {
+					tx = tx.Where("direction = ?", DirectionIn)
+				}
+			}
+		}
+	}
+	if req.Direction != "" {
+		tx = tx.Where("direction = ?", req.Direction)
+	}
+	if req.Keyword != "" {
+		tx = filterKeyword(tx, req.Keyword)
+	}
+	return tx
 }
 
 func ImportWechatCashflows(inb *miso.Inbound, db *gorm.DB) error {
@@ -182,6 +217,9 @@ type NewCashflow struct {
 	Currency      string
 	Extra         string
 	Remark        string
+	AccountNo     string // mapped from payment method if it's empty
+	InstallmentNo string
+	StatExcluded  bool
 }
 
 type SaveCashflowParams struct {
@@ -202,6 +240,9 @@ type SavingCashflow struct {
 	Extra         string
 	Category      string
 	Remark        string
+	AccountNo     string
+	InstallmentNo string
+	StatExcluded  bool
 	CreatedAt     util.ETime
 }
 
@@ -245,9 +286,18 @@ func SaveCashflows(rail miso.Rail, db *gorm.DB, param SaveCashflowParams) ([]New
 		return nil, nil
 	}
 
+	accounts, err := findPaymentMethodAccounts(db, userNo)
+	if err != nil {
+		return nil, err
+	}
+
 	ccySet := util.NewSet[string]()
 	saving := make([]SavingCashflow, 0, len(records))
-	for _, v := range records {
+	for i, v := range records {
+		if v.AccountNo == "" {
+			v.AccountNo = paymentMethodAccountOf(accounts, v.PaymentMethod, v.Currency)
+			records[i].AccountNo = v.AccountNo
+		}
 		transIdSet.Add(v.TransId)
 		s := SavingCashflow{
 			UserNo:        param.User.UserNo,
@@ -261,6 +311,9 @@ func SaveCashflows(rail miso.Rail, db *gorm.DB, param SaveCashflowParams) ([]New
 			Currency:      v.Currency,
 			Extra:         v.Extra,
 			Remark:        v.Remark,
+			AccountNo:     v.AccountNo,
+			InstallmentNo: v.InstallmentNo,
+			StatExcluded:  v.StatExcluded,
 			CreatedAt:     now,
 		}
 		saving = append(saving, s)
@@ -277,6 +330,15 @@ func SaveCashflows(rail miso.Rail, db *gorm.DB, param SaveCashflowParams) ([]New
 	return records, db.Table("cashflow_currency").Clauses(clause.Insert{Modifier: "IGNORE"}).CreateInBatches(newUserCcy, 200).Error
 }
 
+// Parse decimal amount, unlike money.NewAmt, invalid value is not silently treated as zero.
+func parseAmt(s string) (*money.Amt, error) {
+	a := money.Zero()
+	if err := a.SetString(s); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
 func userCashflowLock(rail miso.Rail, userNo string) *miso.RLock {
 	return miso.NewRLockf(rail, "acct:cashflow:user:%v", userNo)
 }
@@ -0,0 +1,220 @@
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+type ApiCompareStatisticsReq struct {
+	AggType  string `desc:"Aggregation Type." valid:"member:YEARLY|MONTHLY|WEEKLY"`
+	AggRange string `desc:"Aggregation Range. The corresponding year (YYYY), month (YYYYMM), sunday of the week (YYYYMMDD)." valid:"notEmpty"`
+	Currency string `desc:"Currency"`
+}
+
+type ApiCompareStatisticsRes struct {
+	Currency          string `desc:"Currency"`
+	AggRange          string `desc:"Aggregation Range of current period"`
+	AggValue          string `desc:"Aggregation Value of current period"`
+	PrevAggRange      string `desc:"Aggregation Range of previous period"`
+	PrevAggValue      string `desc:"Aggregation Value of previous period"`
+	PrevChangePct     string `desc:"Percentage change compared to previous period, empty if previous value is zero"`
+	LastYearAggRange  string `desc:"Aggregation Range of the same period last year"`
+	LastYearAggValue  string `desc:"Aggregation Value of the same period last year"`
+	LastYearChangePct string `desc:"Percentage change compared to the same period last year, empty if last year's value is zero"`
+
+	Categories []ApiCompareCategoryRes `desc:"Breakdown by category, sorted by category code"`
+}
+
+type ApiCompareCategoryRes struct {
+	Category          string `desc:"Category Code"`
+	AggValue          string `desc:"Aggregation Value of current period"`
+	PrevAggValue      string `desc:"Aggregation Value of previous period"`
+	PrevChangePct     string `desc:"Percentage change compared to previous period, empty if previous value is zero"`
+	LastYearAggValue  string `desc:"Aggregation Value of the same period last year"`
+	LastYearChangePct string `desc:"Percentage change compared to the same period last year, empty if last year's value is zero"`
+}
+
+// Aggregation range of the period right before t.
+func prevAggRange(aggType string, t time.Time) string {
+	switch aggType {
+	case AggTypeYearly:
+		return aggRangeOf(aggType, t.AddDate(-1, 0, 0))
+	case AggTypeMonthly:
+		return aggRangeOf(aggType, time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local).AddDate(0, -1, 0))
+	default:
+		return aggRangeOf(aggType, t.AddDate(0, 0, -7))
+	}
+}
+
+// Aggregation range of the same period last year.
+func lastYearAggRange(aggType string, t time.Time) string {
+	if aggType == AggTypeMonthly {
+		t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local)
+	}
+	return aggRangeOf(aggType, t.AddDate(-1, 0, 0))
+}
+
+// Calculate percentage change from prev to curr, returns empty string if prev is zero.
+func changePct(curr *money.Amt, prev *money.Amt) string {
+	if prev.Cmp(money.Zero()) == 0 {
+		return ""
+	}
+	return curr.Sub(prev).Mul(money.NewAmt("100")).Div(prev.Abs(), 2).String()
+}
+
+type cashflowStatValue struct {
+	AggRange string
+	Currency string
+	AggValue string
+}
+
+type categoryCashflowSum struct {
+	Category  string
+	Currency  string
+	AmountSum string
+}
+
+// Calculate cashflow sum (IN - OUT) of each category and currency in the time range, same as cashflow_statistics.
+//
+// The returned map is keyed by currency and then category.
+func calcCategoryCashflowSum(db *gorm.DB, tr TimeRange, currency string, userNo string) (map[string]map[string]*money.Amt, error) {
+	var sums []categoryCashflowSum
+	tx := db.Table("cashflow").
+		Select("category, currency, SUM(case when direction = 'IN' then amount else (-1 * amount) end) amount_sum").
+		Where("user_no = ?", userNo).
+		Where("trans_time between ? and ?", tr.Start, tr.End).
+		Where("transfer_no = ''").
+		Where("stat_excluded = 0").
+		Where("deleted = 0").
+		Group("category, currency")
+	if currency != "" {
+		tx = tx.Where("currency = ?", currency)
+	}
+	if err := tx.Scan(&sums).Error; err != nil {
+		return nil, fmt.Errorf("failed to query category cashflow sum, %w", err)
+	}
+	res := map[string]map[string]*money.Amt{}
+	for _, s := range sums {
+		if res[s.Currency] == nil {
+			res[s.Currency] = map[string]*money.Amt{}
+		}
+		res[s.Currency][s.Category] = money.NewAmt(s.AmountSum)
+	}
+	return res, nil
+}
+
+// Compare category sums of the current period with the previous period and the same period last year.
+func compareCategories(currency string, curr map[string]*money.Amt, prev map[string]*money.Amt,
+	lastYear map[string]*money.Amt) []ApiCompareCategoryRes {
+
+	categories := util.NewSet[string]()
+	for _, m := range []map[string]*money.Amt{curr, prev, lastYear} {
+		for c := range m {
+			categories.Add(c)
+		}
+	}
+	valueOf := func(m map[string]*money.Amt, c string) *money.Amt {
+		if v, ok := m[c]; ok {
+			return v
+		}
+		return money.Zero()
+	}
+
+	res := make([]ApiCompareCategoryRes, 0, categories.Size())
+	for _, c := range categories.CopyKeys() {
+		cv, pv, lv := valueOf(curr, c), valueOf(prev, c), valueOf(lastYear, c)
+		res = append(res, ApiCompareCategoryRes{
+			Category:          c,
+			AggValue:          money.UnitFmt(cv.String(), currency),
+			PrevAggValue:      money.UnitFmt(pv.String(), currency),
+			PrevChangePct:     changePct(cv, pv),
+			LastYearAggValue:  money.UnitFmt(lv.String(), currency),
+			LastYearChangePct: changePct(cv, lv),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return strings.Compare(res[i].Category, res[j].Category) < 0 })
+	return res
+}
+
+// Compare cashflow statistics of the period with the previous period and the same period last year, for each currency.
+//
+// Totals are read from cashflow_statistics, breakdown by category is calculated from the cashflows.
+func CompareCashflowStatistics(rail miso.Rail, db *gorm.DB, req ApiCompareStatisticsReq, user common.User) ([]ApiCompareStatisticsRes, error) {
+	t, err := ParseAggRangeTime(req.AggType, req.AggRange)
+	if err != nil {
+		return nil, err
+	}
+	prev := prevAggRange(req.AggType, t.ToTime())
+	lastYear := lastYearAggRange(req.AggType, t.ToTime())
+
+	var values []cashflowStatValue
+	tx := db.Table("cashflow_statistics").
+		Select("agg_range, currency, agg_value").
+		Where("user_no = ?", user.UserNo).
+		Where("agg_type = ?", req.AggType).
+		Where("agg_range IN ?", []string{req.AggRange, prev, lastYear})
+	if req.Currency != "" {
+		tx = tx.Where("currency = ?", req.Currency)
+	}
+	if err := tx.Scan(&values).Error; err != nil {
+		return nil, fmt.Errorf("failed to query cashflow_statistics, %w", err)
+	}
+
+	byCcy := map[string]map[string]*money.Amt{}
+	for _, v := range values {
+		m, ok := byCcy[v.Currency]
+		if !ok {
+			m = map[string]*money.Amt{}
+			byCcy[v.Currency] = m
+		}
+		m[v.AggRange] = money.NewAmt(v.AggValue)
+	}
+
+	valueOf := func(m map[string]*money.Amt, rng string) *money.Amt {
+		if v, ok := m[rng]; ok {
+			return v
+		}
+		return money.Zero()
+	}
+
+	catSums := make([]map[string]map[string]*money.Amt, 0, 3)
+	for _, rng := range []string{req.AggRange, prev, lastYear} {
+		rt, err := ParseAggRangeTime(req.AggType, rng)
+		if err != nil {
+			return nil, err
+		}
+		sums, err := calcCategoryCashflowSum(db, aggTimeRange(req.AggType, rt.ToTime()), req.Currency, user.UserNo)
+		if err != nil {
+			return nil, err
+		}
+		catSums = append(catSums, sums)
+	}
+
+	res := make([]ApiCompareStatisticsRes, 0, len(byCcy))
+	for _, ccy := range util.MapKeys(byCcy) {
+		m := byCcy[ccy]
+		curr, prevVal, lastYearVal := valueOf(m, req.AggRange), valueOf(m, prev), valueOf(m, lastYear)
+		res = append(res, ApiCompareStatisticsRes{
+			Currency:          ccy,
+			AggRange:          req.AggRange,
+			AggValue:          money.UnitFmt(curr.String(), ccy),
+			PrevAggRange:      prev,
+			PrevAggValue:      money.UnitFmt(prevVal.String(), ccy),
+			PrevChangePct:     changePct(curr, prevVal),
+			LastYearAggRange:  lastYear,
+			LastYearAggValue:  money.UnitFmt(lastYearVal.String(), ccy),
+			LastYearChangePct: changePct(curr, lastYearVal),
+			Categories:        compareCategories(ccy, catSums[0][ccy], catSums[1][ccy], catSums[2][ccy]),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return strings.Compare(res[i].Currency, res[j].Currency) < 0 })
+	return res, nil
+}
@@ -0,0 +1,62 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+)
+
+func TestComparedAggRange(t *testing.T) {
+	tab := [][]string{
+		{AggTypeYearly, "2024", "2023", "2023"},
+		{AggTypeMonthly, "202403", "202402", "202303"},
+		{AggTypeMonthly, "202401", "202312", "202301"},
+		{AggTypeWeekly, "20240602", "20240526", "20230528"},
+	}
+	for _, r := range tab {
+		ti, err := ParseAggRangeTime(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := prevAggRange(r[0], ti.ToTime()); v != r[2] {
+			t.Fatalf("%v %v, expected prev: %v, actual: %v", r[0], r[1], r[2], v)
+		}
+		if v := lastYearAggRange(r[0], ti.ToTime()); v != r[3] {
+			t.Fatalf("%v %v, expected last year: %v, actual: %v", r[0], r[1], r[3], v)
+		}
+	}
+}
+
+func TestChangePct(t *testing.T) {
+	tab := [][]string{
+		{"150", "100", "50.00"},
+		{"-150", "-100", "-50.00"},
+		{"50", "-100", "150.00"},
+		{"1", "0", ""},
+	}
+	for _, r := range tab {
+		if v := changePct(money.NewAmt(r[0]), money.NewAmt(r[1])); v != r[2] {
+			t.Fatalf("%v -> %v, expected: %v, actual: %v", r[1], r[0], r[2], v)
+		}
+	}
+}
+
+func TestCompareCategories(t *testing.T) {
+	curr := map[string]*money.Amt{"FOOD": money.NewAmt("-150"), "SALARY": money.NewAmt("1000")}
+	prev := map[string]*money.Amt{"FOOD": money.NewAmt("-100"), "RENT": money.NewAmt("-500")}
+	res := compareCategories("CNY", curr, prev, nil)
+	if len(res) != 3 {
+		t.Fatalf("res: %+v", res)
+	}
+	food, rent, salary := res[0], res[1], res[2]
+	if food.Category != "FOOD" || food.AggValue != "-150.00" || food.PrevAggValue != "-100.00" || food.PrevChangePct != "-50.00" ||
+		food.LastYearAggValue != "0.00" || food.LastYearChangePct != "" {
+		t.Fatalf("food: %+v", food)
+	}
+	if rent.Category != "RENT" || rent.AggValue != "0.00" || rent.PrevChangePct != "100.00" {
+		t.Fatalf("rent: %+v", rent)
+	}
+	if salary.Category != "SALARY" || salary.AggValue != "1000.00" || salary.PrevChangePct != "" {
+		t.Fatalf("salary: %+v", salary)
+	}
+}
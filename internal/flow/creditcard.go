@@ -0,0 +1,180 @@
+package flow
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultCreditCycles = 6
+	maxCreditCycles     = 36
+)
+
+type creditCycle struct {
+	Start time.Time // first second of the cycle
+	Close time.Time // last second of the cycle
+	Due   time.Time // last second of the payment due date
+}
+
+// Day of the month, clamped to the last day of the month, e.g., 31 in February is 28 or 29.
+func clampMonthDay(year int, month time.Month, day int) time.Time {
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.Local).Day()
+	if day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+}
+
+// Find the billing cycle that contains t.
+//
+// A cycle closes at the end of closeDay, the payment is due on dueDay after the cycle is closed.
+func creditCycleOf(closeDay int, dueDay int, t time.Time) creditCycle {
+	closeDate := clampMonthDay(t.Year(), t.Month(), closeDay)
+	if t.After(closeDate.AddDate(0, 0, 1).Add(-time.Second)) {
+		closeDate = clampMonthDay(t.Year(), t.Month()+1, closeDay)
+	}
+	prev := clampMonthDay(closeDate.Year(), closeDate.Month()-1, closeDay)
+
+	due := clampMonthDay(closeDate.Year(), closeDate.Month(), dueDay)
+	if !due.After(closeDate) {
+		due = clampMonthDay(closeDate.Year(), closeDate.Month()+1, dueDay)
+	}
+	return creditCycle{
+		Start: prev.AddDate(0, 0, 1),
+		Close: closeDate.AddDate(0, 0, 1).Add(-time.Second),
+		Due:   due.AddDate(0, 0, 1).Add(-time.Second),
+	}
+}
+
+// Find the previous billing cycle.
+func (c creditCycle) Prev(closeDay int, dueDay int) creditCycle {
+	return creditCycleOf(closeDay, dueDay, c.Start.Add(-time.Second))
+}
+
+type ApiCreditCyclesReq struct {
+	AccountNo string `desc:"Account No of the credit card" valid:"notEmpty"`
+	Cycles    int    `desc:"Number of recent billing cycles, by default it's 6"`
+}
+
+type ApiCreditCycle struct {
+	CycleStart     util.ETime `desc:"Start of the billing cycle"`
+	CycleClose     util.ETime `desc:"Close of the billing cycle"`
+	DueDate        util.ETime `desc:"Payment due date"`
+	Closed         bool       `desc:"Whether the billing cycle is closed"`
+	Spent          string     `desc:"Amount spent in the billing cycle"`
+	Refunded       string     `desc:"Amount refunded in the billing cycle, payments (transfers to the card) are not included"`
+	StatementTotal string     `desc:"Statement total, spent - refunded"`
+	MinPayment     string     `desc:"Minimum payment"`
+	Paid           string     `desc:"Amount paid (transfers to the card) after the cycle is closed and before the due date"`
+	PaymentMatched bool       `desc:"Whether the statement total is fully paid"`
+	MinPaymentMet  bool       `desc:"Whether the minimum payment is paid"`
+	Overdue        bool       `desc:"Whether the payment is overdue, i.e., due date passed and minimum payment not paid"`
+}
+
+type CreditCardConf struct {
+	CycleCloseDay int
+	PaymentDueDay int
+	MinPaymentPct string
+}
+
+// List per-cycle statement totals of a credit card account.
+func CreditCycles(rail miso.Rail, db *gorm.DB, req ApiCreditCyclesReq, user common.User) ([]ApiCreditCycle, error) {
+	acc, err := findAccount(db, req.AccountNo, user.UserNo)
+	if err != nil {
+		return nil, err
+	}
+	if acc.AccountType != AccountTypeCreditCard {
+		return nil, miso.NewErrf("Account is not a credit card")
+	}
+	var conf CreditCardConf
+	err = db.Raw(`SELECT cycle_close_day, payment_due_day, min_payment_pct FROM account WHERE account_no = ?`, acc.AccountNo).
+		Scan(&conf).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query account credit card conf, %w", err)
+	}
+	if conf.CycleCloseDay < 1 || conf.PaymentDueDay < 1 {
+		return nil, miso.NewErrf("Billing cycle of the credit card is not configured")
+	}
+
+	n := req.Cycles
+	if n < 1 {
+		n = defaultCreditCycles
+	}
+	n = util.MinInt(n, maxCreditCycles)
+
+	now := time.Now()
+	cycles := make([]creditCycle, 0, n)
+	c := creditCycleOf(conf.CycleCloseDay, conf.PaymentDueDay, now)
+	for i := 0; i < n; i++ {
+		cycles = append(cycles, c)
+		c = c.Prev(conf.CycleCloseDay, conf.PaymentDueDay)
+	}
+
+	res := make([]ApiCreditCycle, 0, len(cycles))
+	for _, c := range cycles {
+		sum, err := calcCreditCycleSum(db, acc, c)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, buildCreditCycle(c, sum, money.NewAmt(conf.MinPaymentPct), acc.Currency, now))
+	}
+	return res, nil
+}
+
+type creditCycleSum struct {
+	Spent    string
+	Refunded string
+	Paid     string
+}
+
+func calcCreditCycleSum(db *gorm.DB, acc Account, c creditCycle) (creditCycleSum, error) {
+	var sum creditCycleSum
+	err := db.Raw(`
+	SELECT
+	COALESCE(SUM(case when direction = 'OUT' and trans_time <= ? then amount else 0 end), 0) spent,
+	COALESCE(SUM(case when direction = 'IN' and transfer_no = '' and trans_time <= ? then amount else 0 end), 0) refunded,
+	COALESCE(SUM(case when direction = 'IN' and transfer_no != '' and trans_time > ? then amount else 0 end), 0) paid
+	FROM cashflow WHERE user_no = ? AND account_no = ? AND currency = ? AND trans_time BETWEEN ? AND ? AND deleted = 0
+	`,
+		c.Close, c.Close, c.Close, acc.UserNo, acc.AccountNo, acc.Currency, c.Start, c.Due).
+		Scan(&sum).Error
+	if err != nil {
+		return sum, fmt.Errorf("failed to query credit card cycle sum, %w", err)
+	}
+	return sum, nil
+}
+
+func buildCreditCycle(c creditCycle, sum creditCycleSum, minPct *money.Amt, currency string, now time.Time) ApiCreditCycle {
+	spent := money.NewAmt(sum.Spent)
+	refunded := money.NewAmt(sum.Refunded)
+	paid := money.NewAmt(sum.Paid)
+	total := spent.Sub(refunded)
+	if total.Cmp(money.Zero()) < 0 {
+		total = money.Zero()
+	}
+	minPayment := total.Mul(minPct).Div(money.NewAmt("100"), 2)
+
+	closed := now.After(c.Close)
+	matched := closed && paid.Cmp(total) >= 0
+	minMet := closed && paid.Cmp(minPayment) >= 0
+	return ApiCreditCycle{
+		CycleStart:     util.ToETime(c.Start),
+		CycleClose:     util.ToETime(c.Close),
+		DueDate:        util.ToETime(c.Due),
+		Closed:         closed,
+		Spent:          money.UnitFmt(spent.String(), currency),
+		Refunded:       money.UnitFmt(refunded.String(), currency),
+		StatementTotal: money.UnitFmt(total.String(), currency),
+		MinPayment:     money.UnitFmt(minPayment.String(), currency),
+		Paid:           money.UnitFmt(paid.String(), currency),
+		PaymentMatched: matched,
+		MinPaymentMet:  minMet,
+		Overdue:        now.After(c.Due) && !minMet,
+	}
+}
@@ -0,0 +1,52 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+)
+
+func TestCreditCycleOf(t *testing.T) {
+	const layout = "2006-01-02 15:04:05"
+	tab := []struct {
+		closeDay, dueDay int
+		t                time.Time
+		start, close     string
+		due              string
+	}{
+		{5, 25, time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local), "2024-03-06 00:00:00", "2024-04-05 23:59:59", "2024-04-25 23:59:59"},
+		{5, 25, time.Date(2024, 3, 5, 23, 0, 0, 0, time.Local), "2024-02-06 00:00:00", "2024-03-05 23:59:59", "2024-03-25 23:59:59"},
+		{20, 8, time.Date(2024, 12, 25, 0, 0, 0, 0, time.Local), "2024-12-21 00:00:00", "2025-01-20 23:59:59", "2025-02-08 23:59:59"},
+		{31, 15, time.Date(2024, 2, 10, 0, 0, 0, 0, time.Local), "2024-02-01 00:00:00", "2024-02-29 23:59:59", "2024-03-15 23:59:59"},
+	}
+	for _, v := range tab {
+		c := creditCycleOf(v.closeDay, v.dueDay, v.t)
+		if c.Start.Format(layout) != v.start || c.Close.Format(layout) != v.close || c.Due.Format(layout) != v.due {
+			t.Fatalf("cycle of %v: %v - %v, due: %v", v.t, c.Start, c.Close, c.Due)
+		}
+	}
+
+	c := creditCycleOf(5, 25, time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)).Prev(5, 25)
+	if c.Close.Format(layout) != "2024-03-05 23:59:59" {
+		t.Fatalf("prev cycle: %v - %v", c.Start, c.Close)
+	}
+}
+
+func TestBuildCreditCycle(t *testing.T) {
+	c := creditCycleOf(5, 25, time.Date(2024, 3, 10, 0, 0, 0, 0, time.Local))
+	now := time.Date(2024, 4, 30, 0, 0, 0, 0, time.Local)
+
+	r := buildCreditCycle(c, creditCycleSum{Spent: "1000", Refunded: "200", Paid: "50"}, money.NewAmt("10"), "CNY", now)
+	if r.StatementTotal != "800.00" || r.MinPayment != "80.00" {
+		t.Fatalf("cycle: %+v", r)
+	}
+	if r.PaymentMatched || r.MinPaymentMet || !r.Overdue {
+		t.Fatalf("cycle: %+v", r)
+	}
+
+	r = buildCreditCycle(c, creditCycleSum{Spent: "1000", Refunded: "200", Paid: "800"}, money.NewAmt("10"), "CNY", now)
+	if !r.PaymentMatched || !r.MinPaymentMet || r.Overdue {
+		t.Fatalf("cycle: %+v", r)
+	}
+}
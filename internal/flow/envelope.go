@@ -0,0 +1,322 @@
+package flow
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	RolloverAll     = "ALL"     // both unspent money and overspending are carried to next period
+	RolloverSurplus = "SURPLUS" // only unspent money is carried to next period
+	RolloverDeficit = "DEFICIT" // only overspending is carried to next period
+	RolloverNone    = "NONE"    // nothing is carried, each period starts with its allocation
+)
+
+type ApiSaveEnvelopeReq struct {
+	EnvelopeNo string      `desc:"Envelope No. A new envelope is created if it's empty"`
+	Name       string      `desc:"Envelope Name" valid:"notEmpty,maxLen:64"`
+	Currency   string      `desc:"Currency" valid:"notEmpty"`
+	PeriodType string      `desc:"Envelope Period Type." valid:"member:YEARLY|MONTHLY|WEEKLY"`
+	Allocation string      `desc:"Amount allocated to the envelope for each period" valid:"notEmpty"`
+	Rollover   string      `desc:"Rollover rule: ALL, SURPLUS, DEFICIT, NONE" valid:"member:ALL|SURPLUS|DEFICIT|NONE"`
+	Categories []string    `desc:"Category Codes linked to the envelope" valid:"notEmpty"`
+	StartTime  *util.ETime `desc:"Start of the first envelope period, by default it's current time for new envelope, or the existing start for update"`
+}
+
+type ApiEnvelopeNoReq struct {
+	EnvelopeNo string `desc:"Envelope No" valid:"notEmpty"`
+}
+
+type Envelope struct {
+	EnvelopeNo string
+	UserNo     string
+	Name       string
+	Currency   string
+	PeriodType string
+	Allocation string
+	Rollover   string
+	StartRange string
+}
+
+func SaveEnvelope(rail miso.Rail, db *gorm.DB, req ApiSaveEnvelopeReq, user common.User) (string, error) {
+	if money.NewAmt(req.Allocation).Cmp(money.Zero()) < 0 {
+		return "", miso.NewErrf("Invalid envelope allocation '%v'", req.Allocation)
+	}
+	categories := util.Distinct(req.Categories)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if req.EnvelopeNo != "" {
+			prev, err := findEnvelope(tx, req.EnvelopeNo, user.UserNo)
+			if err != nil {
+				return err
+			}
+			startRange, err := envelopeStartRange(req.PeriodType, req.StartTime, &prev)
+			if err != nil {
+				return err
+			}
+			t := tx.Exec(`UPDATE envelope SET name = ?, currency = ?, period_type = ?, allocation = ?, rollover = ?, start_range = ?, updated_by = ?
+				WHERE envelope_no = ? AND user_no = ? AND deleted = 0`,
+				req.Name, req.Currency, req.PeriodType, req.Allocation, req.Rollover, startRange, user.Username, req.EnvelopeNo, user.UserNo)
+			if t.Error != nil {
+				return fmt.Errorf("failed to update envelope, %w", t.Error)
+			}
+			if err := tx.Exec(`DELETE FROM envelope_category WHERE envelope_no = ?`, req.EnvelopeNo).Error; err != nil {
+				return fmt.Errorf("failed to delete envelope_category, %w", err)
+			}
+		} else {
+			startRange, err := envelopeStartRange(req.PeriodType, req.StartTime, nil)
+			if err != nil {
+				return err
+			}
+			req.EnvelopeNo = util.GenIdP("ENV_")
+			err = tx.Exec(`INSERT INTO envelope (envelope_no, user_no, name, currency, period_type, allocation, rollover, start_range, created_by)
+				VALUES (?,?,?,?,?,?,?,?,?)`,
+				req.EnvelopeNo, user.UserNo, req.Name, req.Currency, req.PeriodType, req.Allocation, req.Rollover, startRange, user.Username).Error
+			if err != nil {
+				return fmt.Errorf("failed to save envelope, %w", err)
+			}
+		}
+		for _, c := range categories {
+			err := tx.Exec(`INSERT INTO envelope_category (envelope_no, category) VALUES (?,?)`, req.EnvelopeNo, c).Error
+			if err != nil {
+				return fmt.Errorf("failed to save envelope_category, %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	rail.Infof("Envelope %v saved by %v", req.EnvelopeNo, user.Username)
+	return req.EnvelopeNo, nil
+}
+
+// Aggregation range of the first envelope period.
+//
+// When the envelope is updated without StartTime, the existing start is kept so that the rollover history is preserved.
+func envelopeStartRange(periodType string, startTime *util.ETime, prev *Envelope) (string, error) {
+	if startTime != nil {
+		return aggRangeOf(periodType, startTime.ToTime()), nil
+	}
+	if prev == nil {
+		return aggRangeOf(periodType, time.Now()), nil
+	}
+	if prev.PeriodType == periodType {
+		return prev.StartRange, nil
+	}
+	st, err := ParseAggRangeTime(prev.PeriodType, prev.StartRange)
+	if err != nil {
+		return "", err
+	}
+	return aggRangeOf(periodType, st.ToTime()), nil
+}
+
+func findEnvelope(db *gorm.DB, envelopeNo string, userNo string) (Envelope, error) {
+	var env Envelope
+	t := db.Raw(`SELECT envelope_no, user_no, name, currency, period_type, allocation, rollover, start_range FROM envelope
+		WHERE envelope_no = ? AND user_no = ? AND deleted = 0`, envelopeNo, userNo).
+		Scan(&env)
+	if t.Error != nil {
+		return env, fmt.Errorf("failed to query envelope, %w", t.Error)
+	}
+	if t.RowsAffected < 1 {
+		return env, miso.NewErrf("Envelope not found")
+	}
+	return env, nil
+}
+
+func DeleteEnvelope(rail miso.Rail, db *gorm.DB, req ApiEnvelopeNoReq, user common.User) error {
+	err := db.Exec(`UPDATE envelope SET deleted = 1, updated_by = ? WHERE envelope_no = ? AND user_no = ?`,
+		user.Username, req.EnvelopeNo, user.UserNo).Error
+	if err != nil {
+		return fmt.Errorf("failed to delete envelope, %w", err)
+	}
+	return nil
+}
+
+type ApiListEnvelopeReq struct {
+	Paging miso.Paging `desc:"Paging"`
+}
+
+type ApiListEnvelopeRes struct {
+	EnvelopeNo string     `desc:"Envelope No"`
+	Name       string     `desc:"Envelope Name"`
+	Currency   string     `desc:"Currency"`
+	PeriodType string     `desc:"Envelope Period Type"`
+	Allocation string     `desc:"Amount allocated to the envelope for each period"`
+	Rollover   string     `desc:"Rollover rule"`
+	StartRange string     `desc:"Aggregation Range of the first envelope period"`
+	Categories []string   `desc:"Category Codes linked to the envelope" gorm:"-"`
+	CreatedAt  util.ETime `desc:"Create Time"`
+}
+
+func ListEnvelopes(rail miso.Rail, db *gorm.DB, req ApiListEnvelopeReq, user common.User) (miso.PageRes[ApiListEnvelopeRes], error) {
+	res, err := miso.NewPageQuery[ApiListEnvelopeRes]().
+		WithPage(req.Paging).
+		WithBaseQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Table(`envelope`).
+				Where("user_no = ?", user.UserNo).
+				Where("deleted = 0")
+		}).
+		WithSelectQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Select("envelope_no", "name", "currency", "period_type", "allocation", "rollover", "start_range", "created_at").
+				Order("id desc")
+		}).
+		ForEach(func(t ApiListEnvelopeRes) ApiListEnvelopeRes {
+			t.Allocation = money.UnitFmt(t.Allocation, t.Currency)
+			return t
+		}).
+		Exec(rail, db)
+	if err != nil {
+		return res, err
+	}
+	for i, p := range res.Payload {
+		cate, err := listEnvelopeCategories(db, p.EnvelopeNo)
+		if err != nil {
+			return res, err
+		}
+		res.Payload[i].Categories = cate
+	}
+	return res, nil
+}
+
+func listEnvelopeCategories(db *gorm.DB, envelopeNo string) ([]string, error) {
+	var cate []string
+	err := db.Raw(`SELECT category FROM envelope_category WHERE envelope_no = ?`, envelopeNo).Scan(&cate).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list envelope_category, %w", err)
+	}
+	return cate, nil
+}
+
+type ApiEnvelopeBalancesReq struct {
+	EnvelopeNo string      `desc:"Envelope No" valid:"notEmpty"`
+	EndTime    *util.ETime `desc:"Balances are calculated up to the period that contains the time, by default it's current time"`
+}
+
+type ApiEnvelopeBalance struct {
+	AggRange   string `desc:"Aggregation Range of the envelope period"`
+	Opening    string `desc:"Balance carried from previous period"`
+	Allocation string `desc:"Amount allocated in the period"`
+	Spent      string `desc:"Net amount spent in the linked categories in the period"`
+	Closing    string `desc:"Balance at the end of the period, negative if overspent"`
+}
+
+func EnvelopeBalances(rail miso.Rail, db *gorm.DB, req ApiEnvelopeBalancesReq, user common.User) ([]ApiEnvelopeBalance, error) {
+	env, err := findEnvelope(db, req.EnvelopeNo, user.UserNo)
+	if err != nil {
+		return nil, err
+	}
+	cate, err := listEnvelopeCategories(db, env.EnvelopeNo)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := ParseAggRangeTime(env.PeriodType, env.StartRange)
+	if err != nil {
+		return nil, err
+	}
+	end := time.Now()
+	if req.EndTime != nil {
+		end = req.EndTime.ToTime()
+	}
+	ranges := aggRangesBetween(env.PeriodType, st.ToTime(), end)
+	if len(ranges) < 1 {
+		return []ApiEnvelopeBalance{}, nil
+	}
+
+	et, err := ParseAggRangeTime(env.PeriodType, ranges[len(ranges)-1])
+	if err != nil {
+		return nil, err
+	}
+	tr := TimeRange{Start: st.ToTime(), End: aggTimeRange(env.PeriodType, et.ToTime()).End}
+	spent, err := calcEnvelopeSpent(db, env, cate, tr)
+	if err != nil {
+		return nil, err
+	}
+	return rollEnvelopeBalances(env, ranges, spent), nil
+}
+
+// Calculate net amount spent (OUT - IN) in the linked categories for each envelope period.
+func calcEnvelopeSpent(db *gorm.DB, env Envelope, categories []string, tr TimeRange) (map[string]*money.Amt, error) {
+	spent := map[string]*money.Amt{}
+	if len(categories) < 1 {
+		return spent, nil
+	}
+
+	var daily []dailyCashflowSum
+	err := db.Raw(`
+	SELECT DATE_FORMAT(trans_time, '%Y%m%d') trans_date, currency,
+	SUM(case when direction = 'OUT' then amount else (-1 * amount) end) amount_sum
+	FROM cashflow WHERE user_no = ? and currency = ? and category IN ? and trans_time between ? and ? and transfer_no = '' and stat_excluded = 0 and deleted = 0
+	GROUP BY trans_date, currency
+	`,
+		env.UserNo, env.Currency, categories, tr.Start, tr.End).
+		Scan(&daily).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query envelope spending, %w", err)
+	}
+
+	for _, d := range daily {
+		td, err := time.ParseInLocation("20060102", d.TransDate, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trans_date '%v', %w", d.TransDate, err)
+		}
+		rng := aggRangeOf(env.PeriodType, td)
+		if prev, ok := spent[rng]; ok {
+			spent[rng] = prev.Add(money.NewAmt(d.AmountSum))
+		} else {
+			spent[rng] = money.NewAmt(d.AmountSum)
+		}
+	}
+	return spent, nil
+}
+
+// Roll envelope balances period by period based on the rollover rule.
+func rollEnvelopeBalances(env Envelope, ranges []string, spent map[string]*money.Amt) []ApiEnvelopeBalance {
+	alloc := money.NewAmt(env.Allocation)
+	opening := money.Zero()
+	res := make([]ApiEnvelopeBalance, 0, len(ranges))
+	for _, rng := range ranges {
+		s, ok := spent[rng]
+		if !ok {
+			s = money.Zero()
+		}
+		closing := opening.Add(alloc).Sub(s)
+		res = append(res, ApiEnvelopeBalance{
+			AggRange:   rng,
+			Opening:    money.UnitFmt(opening.String(), env.Currency),
+			Allocation: money.UnitFmt(alloc.String(), env.Currency),
+			Spent:      money.UnitFmt(s.String(), env.Currency),
+			Closing:    money.UnitFmt(closing.String(), env.Currency),
+		})
+
+		surplus := closing.Cmp(money.Zero()) > 0
+		switch env.Rollover {
+		case RolloverAll:
+			opening = closing
+		case RolloverSurplus:
+			if surplus {
+				opening = closing
+			} else {
+				opening = money.Zero()
+			}
+		case RolloverDeficit:
+			if !surplus {
+				opening = closing
+			} else {
+				opening = money.Zero()
+			}
+		default:
+			opening = money.Zero()
+		}
+	}
+	return res
+}
@@ -0,0 +1,60 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/util"
+)
+
+func TestRollEnvelopeBalances(t *testing.T) {
+	ranges := []string{"202401", "202402", "202403", "202404", "202405"}
+	spent := map[string]*money.Amt{
+		"202401": money.NewAmt("30"),
+		"202402": money.NewAmt("150"),
+		"202404": money.NewAmt("300"),
+	}
+	tab := map[string][]string{
+		RolloverAll:     {"70.00", "20.00", "120.00", "-80.00", "20.00"},
+		RolloverSurplus: {"70.00", "20.00", "120.00", "-80.00", "100.00"},
+		RolloverDeficit: {"70.00", "-50.00", "50.00", "-200.00", "-100.00"},
+		RolloverNone:    {"70.00", "-50.00", "100.00", "-200.00", "100.00"},
+	}
+	for rule, expected := range tab {
+		env := Envelope{Currency: "CNY", Allocation: "100", Rollover: rule}
+		bal := rollEnvelopeBalances(env, ranges, spent)
+		for i, b := range bal {
+			if b.Closing != expected[i] {
+				t.Fatalf("rule: %v, range: %v, expected: %v, actual: %v", rule, b.AggRange, expected[i], b.Closing)
+			}
+		}
+	}
+}
+
+func TestEnvelopeStartRange(t *testing.T) {
+	prev := Envelope{PeriodType: AggTypeMonthly, StartRange: "202401"}
+
+	// editing other fields keeps the existing start
+	rng, err := envelopeStartRange(AggTypeMonthly, nil, &prev)
+	if err != nil || rng != "202401" {
+		t.Fatalf("keep start: %v, %v", rng, err)
+	}
+
+	// period type changed, start is converted
+	rng, err = envelopeStartRange(AggTypeYearly, nil, &prev)
+	if err != nil || rng != "2024" {
+		t.Fatalf("convert start: %v, %v", rng, err)
+	}
+
+	st := util.ToETime(time.Date(2023, 6, 15, 0, 0, 0, 0, time.Local))
+	rng, err = envelopeStartRange(AggTypeMonthly, &st, &prev)
+	if err != nil || rng != "202306" {
+		t.Fatalf("explicit start: %v, %v", rng, err)
+	}
+
+	rng, err = envelopeStartRange(AggTypeMonthly, nil, nil)
+	if err != nil || rng != aggRangeOf(AggTypeMonthly, time.Now()) {
+		t.Fatalf("new envelope: %v, %v", rng, err)
+	}
+}
@@ -0,0 +1,340 @@
+package flow
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/curtisnewbie/miso/encoding"
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"github.com/xuri/excelize/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	ExportFormatCsv  = "CSV"
+	ExportFormatXlsx = "XLSX"
+
+	exportTimeFormat = "2006-01-02 15:04:05"
+
+	// number of rows buffered for tag lookup
+	exportBatchSize = 500
+
+	// index of the Amount column, it's written as number in XLSX
+	exportAmountCol = 2
+)
+
+var (
+	exportColumns = []string{"Transaction Time", "Direction", "Amount", "Currency", "Category", "Category Name",
+		"Transaction ID", "Counterparty", "Payment Method", "Account", "Tags", "Remark"}
+)
+
+type exportCashflow struct {
+	Direction     string
+	TransTime     util.ETime
+	TransId       string
+	Counterparty  string
+	PaymentMethod string
+	Amount        string
+	Currency      string
+	Extra         string
+	Category      string
+	Remark        string
+	AccountNo     string
+	TransferNo    string
+}
+
+type exportRowWriter interface {
+	Write(row []string) error
+	Close() error
+}
+
+type csvRowWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvRowWriter) Write(row []string) error {
+	return c.w.Write(row)
+}
+
+func (c *csvRowWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func newCsvRowWriter(w io.Writer) (*csvRowWriter, error) {
+	// BOM, so that Excel decodes the file as UTF-8
+	if _, err := w.Write([]byte("\xEF\xBB\xBF")); err != nil {
+		return nil, err
+	}
+	return &csvRowWriter{w: csv.NewWriter(w)}, nil
+}
+
+type xlsxRowWriter struct {
+	out  io.Writer
+	f    *excelize.File
+	sw   *excelize.StreamWriter
+	rows int
+}
+
+func (x *xlsxRowWriter) Write(row []string) error {
+	x.rows++
+	cell, err := excelize.CoordinatesToCellName(1, x.rows)
+	if err != nil {
+		return err
+	}
+	return x.sw.SetRow(cell, xlsxCells(row, x.rows == 1))
+}
+
+// Convert row to xlsx cells, amounts are written as numbers so that they can be summed up in spreadsheets.
+func xlsxCells(row []string, header bool) []any {
+	cells := make([]any, len(row))
+	for i, s := range row {
+		cells[i] = s
+		if !header && i == exportAmountCol {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				cells[i] = f
+			}
+		}
+	}
+	return cells
+}
+
+func (x *xlsxRowWriter) Close() error {
+	defer x.f.Close()
+	if err := x.sw.Flush(); err != nil {
+		return err
+	}
+	return x.f.Write(x.out)
+}
+
+func newXlsxRowWriter(w io.Writer) (*xlsxRowWriter, error) {
+	f := excelize.NewFile()
+	sw, err := f.NewStreamWriter("Sheet1")
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &xlsxRowWriter{out: w, f: f, sw: sw}, nil
+}
+
+// Export cashflows matching the filters in the request body (ListCashFlowReq, paging is ignored).
+//
+// The format is specified in query param 'format', either CSV or XLSX.
+func ExportCashflows(inb *miso.Inbound, db *gorm.DB) error {
+	rail := inb.Rail()
+	user := common.GetUser(rail)
+	format := strings.ToUpper(inb.Query("format"))
+	if format == "" {
+		format = ExportFormatCsv
+	}
+	if format != ExportFormatCsv && format != ExportFormatXlsx {
+		return miso.NewErrf("Invalid format '%v', should be either %v or %v", format, ExportFormatCsv, ExportFormatXlsx)
+	}
+
+	w, r := inb.Unwrap()
+	defer r.Body.Close()
+	var req ListCashFlowReq
+	if err := encoding.DecodeJson(r.Body, &req); err != nil && err != io.EOF {
+		return miso.NewErrf("Illegal Arguments").WithInternalMsg("%v", err)
+	}
+	if err := miso.Validate(req); err != nil {
+		return err
+	}
+
+	extraKeys, err := findExtraKeys(db, user, req)
+	if err != nil {
+		return err
+	}
+	accounts, err := findAccountNames(db, user.UserNo)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("cashflows_%v.%v", time.Now().Format("20060102150405"), strings.ToLower(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, name))
+	var rw exportRowWriter
+	if format == ExportFormatXlsx {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		rw, err = newXlsxRowWriter(w)
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		rw, err = newCsvRowWriter(w)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %v writer, %w", format, err)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	// the response is already committed, errors below are only logged
+	n, err := writeExportRows(db, user, req, rw, extraKeys, accounts)
+	if err == nil {
+		err = rw.Close()
+	}
+	if err != nil {
+		rail.Errorf("Failed to export cashflows for %v, %v", user.Username, err)
+		return nil
+	}
+	rail.Infof("Exported %d cashflows in %v for %v", n, format, user.Username)
+	return nil
+}
+
+func writeExportRows(db *gorm.DB, user common.User, req ListCashFlowReq, rw exportRowWriter, extraKeys []string,
+	accounts map[string]string) (int, error) {
+
+	header := append([]string{}, exportColumns...)
+	for _, k := range extraKeys {
+		header = append(header, exportCell(k))
+	}
+	if err := rw.Write(header); err != nil {
+		return 0, err
+	}
+
+	rows, err := filterCashflows(db, user, req).
+		Select("direction", "trans_time", "trans_id", "counterparty", "payment_method", "amount", "currency", "extra",
+			"category", "remark", "account_no").
+		Order("trans_time desc").
+		Rows()
+	if err != nil {
+		return 0, fmt.Errorf("failed to query cashflows, %w", err)
+	}
+	defer rows.Close()
+
+	n := 0
+	batch := make([]exportCashflow, 0, exportBatchSize)
+	flush := func() error {
+		tags, err := findCashflowTags(db, user.UserNo, util.MapTo(batch, func(c exportCashflow) string { return c.TransId }))
+		if err != nil {
+			return err
+		}
+		for _, c := range batch {
+			if err := rw.Write(buildExportRow(c, extraKeys, accounts, tags[cashflowTagKey(c.Category, c.TransId)])); err != nil {
+				return err
+			}
+		}
+		n += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for rows.Next() {
+		var c exportCashflow
+		if err := db.ScanRows(rows, &c); err != nil {
+			return n, fmt.Errorf("failed to scan cashflow, %w", err)
+		}
+		batch = append(batch, c)
+		if len(batch) >= exportBatchSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("failed to iterate cashflows, %w", err)
+	}
+	return n, flush()
+}
+
+func buildExportRow(c exportCashflow, extraKeys []string, accounts map[string]string, tags []string) []string {
+	categoryName := ""
+	if v, ok := categoryConfs[c.Category]; ok {
+		categoryName = v.Name
+	}
+	row := []string{
+		c.TransTime.Format(exportTimeFormat),
+		c.Direction,
+		money.UnitFmt(c.Amount, c.Currency),
+		exportCell(c.Currency),
+		exportCell(c.Category),
+		exportCell(categoryName),
+		exportCell(c.TransId),
+		exportCell(c.Counterparty),
+		exportCell(c.PaymentMethod),
+		exportCell(accounts[c.AccountNo]),
+		exportCell(strings.Join(tags, ",")),
+		exportCell(c.Remark),
+	}
+	extra := decodeExtra(c.Extra)
+	for _, k := range extraKeys {
+		row = append(row, exportCell(extra[k]))
+	}
+	return row
+}
+
+// Neutralise text that spreadsheets may evaluate as formula (CSV/XLSX injection), it's prefixed with a single quote.
+func exportCell(s string) string {
+	if s == "" {
+		return s
+	}
+	switch s[0] {
+	case '=', '+', '-', '@', '\t', '\r':
+		return "'" + s
+	}
+	return s
+}
+
+// Decode extra json into flat key-value pairs, non-string values are kept as json.
+func decodeExtra(extra string) map[string]string {
+	m := map[string]any{}
+	if extra == "" {
+		return map[string]string{}
+	}
+	if err := encoding.SParseJson(extra, &m); err != nil {
+		return map[string]string{}
+	}
+	res := make(map[string]string, len(m))
+	for k, v := range m {
+		if s, ok := v.(string); ok {
+			res[k] = s
+		} else if v != nil {
+			s, _ := encoding.SWriteJson(v)
+			res[k] = s
+		}
+	}
+	return res
+}
+
+// Find keys of extra json of the matching cashflows, each key is exported as a column.
+func findExtraKeys(db *gorm.DB, user common.User, req ListCashFlowReq) ([]string, error) {
+	var l []string
+	err := filterCashflows(db, user, req).
+		Where("JSON_VALID(extra)").
+		Distinct("JSON_KEYS(extra)").
+		Scan(&l).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cashflow extra keys, %w", err)
+	}
+	set := util.NewSet[string]()
+	for _, v := range l {
+		var keys []string
+		if err := encoding.SParseJson(v, &keys); err != nil {
+			continue
+		}
+		for _, k := range keys {
+			set.Add(k)
+		}
+	}
+	keys := set.CopyKeys()
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func findAccountNames(db *gorm.DB, userNo string) (map[string]string, error) {
+	var l []Account
+	err := db.Raw(`SELECT account_no, name FROM account WHERE user_no = ?`, userNo).Scan(&l).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list account, %w", err)
+	}
+	m := make(map[string]string, len(l))
+	for _, a := range l {
+		m[a.AccountNo] = a.Name
+	}
+	return m, nil
+}
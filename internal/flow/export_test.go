@@ -0,0 +1,94 @@
+package flow
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/util"
+)
+
+func TestBuildExportRow(t *testing.T) {
+	c := exportCashflow{
+		Direction:     DirectionOut,
+		TransTime:     util.ToETime(time.Date(2024, 6, 1, 12, 30, 0, 0, time.Local)),
+		TransId:       "123",
+		Counterparty:  "Shop",
+		PaymentMethod: "零钱",
+		Amount:        "12.5",
+		Currency:      "CNY",
+		Extra:         `{"商品":"Coffee","count":2}`,
+		Category:      "WECHAT",
+		AccountNo:     "ACC_1",
+	}
+	row := buildExportRow(c, []string{"count", "商户单号", "商品"}, map[string]string{"ACC_1": "Wallet"}, []string{"food", "daily"})
+	exp := []string{"2024-06-01 12:30:00", "OUT", "12.50", "CNY", "WECHAT", "", "123", "Shop", "零钱", "Wallet", "food,daily", "",
+		"2", "", "Coffee"}
+	if strings.Join(row, "|") != strings.Join(exp, "|") {
+		t.Fatalf("row: %v", row)
+	}
+}
+
+func TestCsvRowWriter(t *testing.T) {
+	buf := bytes.Buffer{}
+	w, err := newCsvRowWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write([]string{"a", "b,c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "\xEF\xBB\xBFa,\"b,c\"\n" {
+		t.Fatalf("csv: %q", buf.String())
+	}
+}
+
+func TestExportCell(t *testing.T) {
+	tab := map[string]string{
+		"":                        "",
+		"Shop":                    "Shop",
+		"=HYPERLINK(\"x\",\"y\")": "'=HYPERLINK(\"x\",\"y\")",
+		"+1":                      "'+1",
+		"-2+3":                    "'-2+3",
+		"@SUM(A1)":                "'@SUM(A1)",
+		"\t=1":                    "'\t=1",
+		"\r=1":                    "'\r=1",
+		"a=1":                     "a=1",
+	}
+	for in, exp := range tab {
+		if act := exportCell(in); act != exp {
+			t.Fatalf("in: %q, expected: %q, actual: %q", in, exp, act)
+		}
+	}
+
+	c := exportCashflow{
+		Direction:    DirectionOut,
+		Amount:       "12.5",
+		Currency:     "CNY",
+		Counterparty: "=cmd|' /C calc'!A0",
+		Remark:       "-refund",
+		Extra:        `{"note":"@SUM(1)"}`,
+	}
+	row := buildExportRow(c, []string{"note"}, map[string]string{}, nil)
+	if row[7] != "'=cmd|' /C calc'!A0" || row[11] != "'-refund" || row[12] != "'@SUM(1)" {
+		t.Fatalf("row: %v", row)
+	}
+}
+
+func TestXlsxCells(t *testing.T) {
+	row := []string{"2024-06-01 12:30:00", "OUT", "12.50", "CNY"}
+	cells := xlsxCells(row, false)
+	if v, ok := cells[exportAmountCol].(float64); !ok || v != 12.5 {
+		t.Fatalf("amount: %#v", cells[exportAmountCol])
+	}
+	if _, ok := cells[3].(string); !ok {
+		t.Fatalf("currency: %#v", cells[3])
+	}
+	if _, ok := xlsxCells(exportColumns, true)[exportAmountCol].(string); !ok {
+		t.Fatal("header should be string")
+	}
+}
@@ -0,0 +1,169 @@
+package flow
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	FxRateFormatEcb = "ECB"
+	FxRateFormatCsv = "CSV"
+
+	// ECB eurofxref rates are always based on EUR
+	EcbBaseCurrency = "EUR"
+)
+
+type ecbEnvelope struct {
+	Cube struct {
+		Days []struct {
+			Time  string `xml:"time,attr"`
+			Rates []struct {
+				Currency string `xml:"currency,attr"`
+				Rate     string `xml:"rate,attr"`
+			} `xml:"Cube"`
+		} `xml:"Cube"`
+	} `xml:"Cube"`
+}
+
+// Parse exchange rates in ECB eurofxref XML format, e.g., eurofxref-daily.xml or eurofxref-hist.xml.
+func ParseEcbFxRates(rail miso.Rail, r io.Reader) ([]ApiFxRate, error) {
+	var env ecbEnvelope
+	if err := xml.NewDecoder(r).Decode(&env); err != nil {
+		return nil, fmt.Errorf("failed to decode ECB eurofxref xml, %w", err)
+	}
+
+	rates := make([]ApiFxRate, 0, len(env.Cube.Days)*30)
+	for _, d := range env.Cube.Days {
+		t, err := time.ParseInLocation(FxRateDateFormat, d.Time, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ECB rate date '%v', %w", d.Time, err)
+		}
+		for _, r := range d.Rates {
+			rates = append(rates, ApiFxRate{
+				BaseCurrency:  EcbBaseCurrency,
+				QuoteCurrency: strings.ToUpper(strings.TrimSpace(r.Currency)),
+				RateDate:      util.ToETime(t),
+				Rate:          strings.TrimSpace(r.Rate),
+			})
+		}
+	}
+	rail.Debugf("Parsed %d ECB exchange rates", len(rates))
+	return rates, nil
+}
+
+// Parse exchange rates in CSV format, each line is: date,base,quote,rate, e.g., 2024-06-11,USD,CNY,7.2443.
+//
+// The header line is optional.
+func ParseCsvFxRates(rail miso.Rail, r io.Reader) ([]ApiFxRate, error) {
+	rates := make([]ApiFxRate, 0, 30)
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+	line := 0
+	for {
+		l, err := csvReader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("failed to read csv, %w", err)
+		}
+		line++
+		if len(l) < 4 {
+			rail.Debugf("skipped line %d, l: %+v", line, l)
+			continue
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(l[0]), "date") {
+			continue
+		}
+
+		t, err := time.ParseInLocation(FxRateDateFormat, strings.TrimSpace(l[0]), time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate date '%v' at line %d, %w", l[0], line, err)
+		}
+		rates = append(rates, ApiFxRate{
+			BaseCurrency:  strings.ToUpper(strings.TrimSpace(l[1])),
+			QuoteCurrency: strings.ToUpper(strings.TrimSpace(l[2])),
+			RateDate:      util.ToETime(t),
+			Rate:          strings.TrimSpace(l[3]),
+		})
+	}
+	rail.Debugf("Parsed %d exchange rates from csv", len(rates))
+	return rates, nil
+}
+
+// Parse and save exchange rates in the given format, returns the number of rates saved.
+func ImportFxRates(rail miso.Rail, db *gorm.DB, format string, r io.Reader) (int, error) {
+	var rates []ApiFxRate
+	var err error
+	switch strings.ToUpper(format) {
+	case FxRateFormatEcb:
+		rates, err = ParseEcbFxRates(rail, r)
+	case FxRateFormatCsv:
+		rates, err = ParseCsvFxRates(rail, r)
+	default:
+		return 0, miso.NewErrf("Invalid format '%v', should be either %v or %v", format, FxRateFormatEcb, FxRateFormatCsv)
+	}
+	if err != nil {
+		return 0, miso.NewErrf("Failed to parse exchange rates").WithInternalMsg("%v", err)
+	}
+
+	rates = util.Filter(rates, func(r ApiFxRate) bool {
+		if r.BaseCurrency == "" || r.QuoteCurrency == "" || r.BaseCurrency == r.QuoteCurrency {
+			return false
+		}
+		if money.NewAmt(r.Rate).Cmp(money.Zero()) <= 0 {
+			rail.Warnf("Invalid exchange rate '%v' for %v/%v on %v, ignored", r.Rate, r.BaseCurrency, r.QuoteCurrency,
+				r.RateDate.Format(FxRateDateFormat))
+			return false
+		}
+		return true
+	})
+
+	for i := 0; i < len(rates); i += 500 {
+		end := util.MinInt(i+500, len(rates))
+		if err := saveFxRates(rail, db, rates[i:end]); err != nil {
+			return i, err
+		}
+	}
+	return len(rates), nil
+}
+
+// Import exchange rates from file, the file is in either ECB eurofxref XML format or CSV format.
+func ImportFxRateFile(rail miso.Rail, db *gorm.DB, format string, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file %v, %w", path, err)
+	}
+	defer f.Close()
+	return ImportFxRates(rail, db, format, f)
+}
+
+type ApiImportFxRatesRes struct {
+	Imported int `desc:"Number of exchange rates imported"`
+}
+
+func ImportUploadedFxRates(inb *miso.Inbound, db *gorm.DB) (ApiImportFxRatesRes, error) {
+	rail := inb.Rail()
+	format := inb.Query("format")
+	_, r := inb.Unwrap()
+	defer r.Body.Close()
+
+	n, err := ImportFxRates(rail, db, format, r.Body)
+	if err != nil {
+		return ApiImportFxRatesRes{}, err
+	}
+	rail.Infof("Imported %d exchange rates in %v format", n, format)
+	return ApiImportFxRatesRes{Imported: n}, nil
+}
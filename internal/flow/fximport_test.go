@@ -0,0 +1,50 @@
+package flow
+
+import (
+	"os"
+	"testing"
+
+	"github.com/curtisnewbie/miso/miso"
+)
+
+func TestParseEcbFxRates(t *testing.T) {
+	rail := miso.EmptyRail()
+	f, err := os.Open("../../testdata/ecb_eurofxref_test.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rates, err := ParseEcbFxRates(rail, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 6 {
+		t.Fatalf("expected 6 rates, actual: %d", len(rates))
+	}
+	r := rates[1]
+	if r.BaseCurrency != "EUR" || r.QuoteCurrency != "CNY" || r.Rate != "7.7864" || r.RateDate.Format(FxRateDateFormat) != "2024-06-11" {
+		t.Fatalf("invalid rate: %+v", r)
+	}
+}
+
+func TestParseCsvFxRates(t *testing.T) {
+	rail := miso.EmptyRail()
+	f, err := os.Open("../../testdata/fx_rate_test.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rates, err := ParseCsvFxRates(rail, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 2 {
+		t.Fatalf("expected 2 rates, actual: %d", len(rates))
+	}
+	r := rates[1]
+	if r.BaseCurrency != "HKD" || r.QuoteCurrency != "CNY" || r.Rate != "0.9277" || r.RateDate.Format(FxRateDateFormat) != "2024-06-11" {
+		t.Fatalf("invalid rate: %+v", r)
+	}
+}
@@ -0,0 +1,287 @@
+package flow
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	FxRateDateFormat = "2006-01-02"
+
+	// scale of converted amount before it's rounded to the currency's scale
+	fxRateScale = 8
+
+	// rates older than this are considered stale and not used, rates are not published on weekends and holidays
+	fxRateMaxAgeDays = 7
+)
+
+type ApiFxRate struct {
+	BaseCurrency  string     `desc:"Base Currency, e.g., 1 unit of base currency = rate * quote currency" valid:"notEmpty"`
+	QuoteCurrency string     `desc:"Quote Currency" valid:"notEmpty"`
+	RateDate      util.ETime `desc:"Date of the exchange rate"`
+	Rate          string     `desc:"Exchange rate" valid:"notEmpty"`
+}
+
+type ApiSaveFxRatesReq struct {
+	Rates []ApiFxRate `desc:"Exchange rates" valid:"notEmpty"`
+}
+
+func SaveFxRates(rail miso.Rail, db *gorm.DB, req ApiSaveFxRatesReq) error {
+	for _, r := range req.Rates {
+		if err := miso.Validate(r); err != nil {
+			return err
+		}
+		if err := validateFxRate(r); err != nil {
+			return err
+		}
+	}
+	return saveFxRates(rail, db, req.Rates)
+}
+
+func validateFxRate(r ApiFxRate) error {
+	rate := money.NewAmt(r.Rate)
+	if rate.Cmp(money.Zero()) <= 0 {
+		return miso.NewErrf("Invalid exchange rate '%v' for %v/%v", r.Rate, r.BaseCurrency, r.QuoteCurrency)
+	}
+	if r.BaseCurrency == r.QuoteCurrency {
+		return miso.NewErrf("Base currency and quote currency must be different")
+	}
+	if r.RateDate.IsZero() {
+		return miso.NewErrf("Rate date of %v/%v is missing", r.BaseCurrency, r.QuoteCurrency)
+	}
+	return nil
+}
+
+func saveFxRates(rail miso.Rail, db *gorm.DB, rates []ApiFxRate) error {
+	if len(rates) < 1 {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, r := range rates {
+			err := tx.Exec(`INSERT INTO fx_rate (base_currency, quote_currency, rate_date, rate) VALUES (?,?,?,?)
+				ON DUPLICATE KEY UPDATE rate = VALUES(rate)`,
+				r.BaseCurrency, r.QuoteCurrency, r.RateDate.Format(FxRateDateFormat), r.Rate).Error
+			if err != nil {
+				return fmt.Errorf("failed to save fx_rate, %w", err)
+			}
+		}
+		rail.Infof("Saved %d exchange rates", len(rates))
+		return nil
+	})
+}
+
+type ApiListFxRatesReq struct {
+	Paging        miso.Paging `desc:"Paging"`
+	BaseCurrency  string      `desc:"Base Currency"`
+	QuoteCurrency string      `desc:"Quote Currency"`
+	StartDate     *util.ETime `desc:"Rate Date Range Start"`
+	EndDate       *util.ETime `desc:"Rate Date Range End"`
+}
+
+func ListFxRates(rail miso.Rail, db *gorm.DB, req ApiListFxRatesReq) (miso.PageRes[ApiFxRate], error) {
+	return miso.NewPageQuery[ApiFxRate]().
+		WithPage(req.Paging).
+		WithBaseQuery(func(tx *gorm.DB) *gorm.DB {
+			tx = tx.Table(`fx_rate`)
+			if req.BaseCurrency != "" {
+				tx = tx.Where("base_currency = ?", req.BaseCurrency)
+			}
+			if req.QuoteCurrency != "" {
+				tx = tx.Where("quote_currency = ?", req.QuoteCurrency)
+			}
+			if req.StartDate != nil {
+				tx = tx.Where("rate_date >= ?", req.StartDate.Format(FxRateDateFormat))
+			}
+			if req.EndDate != nil {
+				tx = tx.Where("rate_date <= ?", req.EndDate.Format(FxRateDateFormat))
+			}
+			return tx
+		}).
+		WithSelectQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Select("base_currency", "quote_currency", "rate_date", "rate").
+				Order("rate_date desc, base_currency, quote_currency")
+		}).
+		Exec(rail, db)
+}
+
+// Find exchange rate that converts 1 unit of currency 'from' into currency 'to' on the given date.
+//
+// If the rate on the given date is missing, rate of the nearest previous day within fxRateMaxAgeDays is used. Rate of
+// the inverse pair is used if the exact pair is not found, and if neither is found, cross rate through EUR is calculated.
+func FindFxRate(rail miso.Rail, db *gorm.DB, from string, to string, date time.Time) (*money.Amt, error) {
+	return findFxRate(rail, dbFxRateLookup(db), from, to, date)
+}
+
+func findFxRate(rail miso.Rail, lookup fxRateLookup, from string, to string, date time.Time) (*money.Amt, error) {
+	if from == to {
+		return money.NewAmt("1"), nil
+	}
+
+	rate, ok, err := findPairFxRate(rail, lookup, from, to, date)
+	if err != nil || ok {
+		return rate, err
+	}
+
+	if from != EcbBaseCurrency && to != EcbBaseCurrency {
+		fromRate, ok, err := findPairFxRate(rail, lookup, from, EcbBaseCurrency, date)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			toRate, ok, err := findPairFxRate(rail, lookup, EcbBaseCurrency, to, date)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return fromRate.Mul(toRate).Round(fxRateScale), nil
+			}
+		}
+	}
+
+	return nil, miso.NewErrf("Exchange rate for %v/%v on %v not found, or it's older than %d days", from, to,
+		date.Format(FxRateDateFormat), fxRateMaxAgeDays)
+}
+
+type fxRateRow struct {
+	Rate     string
+	RateDate util.ETime
+}
+
+// Find rate of the pair on the nearest day on or before the date (formatted in FxRateDateFormat).
+type fxRateLookup func(base string, quote string, date string) (fxRateRow, bool, error)
+
+func dbFxRateLookup(db *gorm.DB) fxRateLookup {
+	return func(base string, quote string, date string) (fxRateRow, bool, error) {
+		var r fxRateRow
+		t := db.Raw(`SELECT rate, rate_date FROM fx_rate WHERE base_currency = ? AND quote_currency = ? AND rate_date <= ?
+			ORDER BY rate_date DESC LIMIT 1`, base, quote, date).
+			Scan(&r)
+		if t.Error != nil {
+			return r, false, fmt.Errorf("failed to query fx_rate, %w", t.Error)
+		}
+		return r, t.RowsAffected > 0, nil
+	}
+}
+
+// Find rate of the pair or the inverse pair on the nearest day on or before the given date.
+func findPairFxRate(rail miso.Rail, lookup fxRateLookup, from string, to string, date time.Time) (*money.Amt, bool, error) {
+	d := date.Format(FxRateDateFormat)
+	direct, hasDirect, err := lookup(from, to, d)
+	if err != nil {
+		return nil, false, err
+	}
+	inverse, hasInverse, err := lookup(to, from, d)
+	if err != nil {
+		return nil, false, err
+	}
+	if hasInverse && money.NewAmt(inverse.Rate).Cmp(money.Zero()) == 0 {
+		hasInverse = false
+	}
+	minDate := date.AddDate(0, 0, -fxRateMaxAgeDays).Format(FxRateDateFormat)
+	if hasDirect && direct.RateDate.Format(FxRateDateFormat) < minDate {
+		rail.Debugf("Exchange rate for %v/%v on %v is stale, latest rate is on %v", from, to, d, direct.RateDate.Format(FxRateDateFormat))
+		hasDirect = false
+	}
+	if hasInverse && inverse.RateDate.Format(FxRateDateFormat) < minDate {
+		rail.Debugf("Exchange rate for %v/%v on %v is stale, latest rate is on %v", to, from, d, inverse.RateDate.Format(FxRateDateFormat))
+		hasInverse = false
+	}
+
+	var rate *money.Amt
+	var rateDate util.ETime
+	if hasDirect && (!hasInverse || !direct.RateDate.Before(inverse.RateDate)) {
+		rate, rateDate = money.NewAmt(direct.Rate), direct.RateDate
+	} else if hasInverse {
+		rate, rateDate = money.NewAmt("1").Div(money.NewAmt(inverse.Rate), fxRateScale), inverse.RateDate
+	} else {
+		return nil, false, nil
+	}
+
+	if rd := rateDate.Format(FxRateDateFormat); rd != d {
+		rail.Debugf("Exchange rate for %v/%v on %v not found, using rate on %v", from, to, d, rd)
+	}
+	return rate, true, nil
+}
+
+// Converts amounts into base currency, exchange rates are cached by the converter.
+type fxConverter struct {
+	db    *gorm.DB
+	base  string
+	rates map[string]*money.Amt
+}
+
+func newFxConverter(db *gorm.DB, base string) *fxConverter {
+	return &fxConverter{db: db, base: base, rates: map[string]*money.Amt{}}
+}
+
+func (f *fxConverter) Convert(rail miso.Rail, amt *money.Amt, currency string, date time.Time) (*money.Amt, error) {
+	if currency == f.base {
+		return amt, nil
+	}
+	k := currency + ":" + date.Format(FxRateDateFormat)
+	rate, ok := f.rates[k]
+	if !ok {
+		r, err := FindFxRate(rail, f.db, currency, f.base, date)
+		if err != nil {
+			return nil, err
+		}
+		f.rates[k] = r
+		rate = r
+	}
+	return amt.Mul(rate).Round(fxRateScale), nil
+}
+
+type dailyCashflowSum struct {
+	TransDate string
+	Currency  string
+	AmountSum string
+}
+
+// Calculate cashflow sum in base currency for each aggregation range within the time range.
+//
+// Cashflows are converted using the exchange rates on the date of their TransTime.
+func calcConvertedCashflowSum(rail miso.Rail, db *gorm.DB, tr TimeRange, aggType string, base string, userNo string) (map[string]*money.Amt, error) {
+	if tr.Start.After(tr.End) {
+		tr.Start, tr.End = tr.End, tr.Start
+	}
+	rail.Infof("Calculating cashflow sum in %v between %v, %v, userNo: %v", base, tr.Start, tr.End, userNo)
+
+	var daily []dailyCashflowSum
+	err := db.Raw(`
+	SELECT DATE_FORMAT(trans_time, '%Y%m%d') trans_date, currency,
+	SUM(case when direction = 'IN' then amount else (-1 * amount) end) amount_sum
+	FROM cashflow WHERE user_no = ? and trans_time between ? and ? and transfer_no = '' and stat_excluded = 0 and deleted = 0
+	GROUP BY trans_date, currency
+	`,
+		userNo, tr.Start, tr.End).
+		Scan(&daily).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query daily cashflow sum, %w", err)
+	}
+
+	conv := newFxConverter(db, base)
+	res := map[string]*money.Amt{}
+	for _, d := range daily {
+		td, err := time.ParseInLocation("20060102", d.TransDate, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trans_date '%v', %w", d.TransDate, err)
+		}
+		v, err := conv.Convert(rail, money.NewAmt(d.AmountSum), d.Currency, td)
+		if err != nil {
+			return nil, err
+		}
+		rng := aggRangeOf(aggType, td)
+		if prev, ok := res[rng]; ok {
+			res[rng] = prev.Add(v)
+		} else {
+			res[rng] = v
+		}
+	}
+	return res, nil
+}
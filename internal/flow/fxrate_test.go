@@ -0,0 +1,125 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+)
+
+func TestFindFxRate(t *testing.T) {
+	rail := miso.EmptyRail()
+	if err := miso.LoadConfigFromFile("../../conf.yml", rail); err != nil {
+		t.Fatal(err)
+	}
+	miso.SetLogLevel("debug")
+	if err := miso.InitMySQLFromProp(rail); err != nil {
+		t.Fatal(err)
+	}
+
+	d, _ := time.ParseInLocation(FxRateDateFormat, "2024-06-11", time.Local)
+	err := SaveFxRates(rail, miso.GetMySQL(), ApiSaveFxRatesReq{
+		Rates: []ApiFxRate{{BaseCurrency: "USD", QuoteCurrency: "CNY", RateDate: util.ToETime(d), Rate: "7.2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := FindFxRate(rail, miso.GetMySQL(), "USD", "CNY", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Cmp(money.NewAmt("7.2")) != 0 {
+		t.Fatalf("USD/CNY: %v", r)
+	}
+
+	r, err = FindFxRate(rail, miso.GetMySQL(), "CNY", "USD", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Cmp(money.NewAmt("0.13888889")) != 0 {
+		t.Fatalf("CNY/USD: %v", r)
+	}
+}
+
+// In-memory lookup, rates are keyed by 'base/quote', each with rates of ascending dates.
+func memFxRateLookup(rates map[string][]fxRateRow) fxRateLookup {
+	return func(base string, quote string, date string) (fxRateRow, bool, error) {
+		var r fxRateRow
+		found := false
+		for _, v := range rates[base+"/"+quote] {
+			if v.RateDate.Format(FxRateDateFormat) <= date {
+				r, found = v, true
+			}
+		}
+		return r, found, nil
+	}
+}
+
+func TestFindFxRateLookup(t *testing.T) {
+	day := func(s string) util.ETime {
+		d, _ := time.ParseInLocation(FxRateDateFormat, s, time.Local)
+		return util.ToETime(d)
+	}
+	lookup := memFxRateLookup(map[string][]fxRateRow{
+		"USD/CNY": {{Rate: "7.1", RateDate: day("2024-06-01")}, {Rate: "7.2", RateDate: day("2024-06-10")}},
+		"JPY/USD": {{Rate: "0.0064", RateDate: day("2024-06-10")}},
+		"EUR/GBP": {{Rate: "0.85", RateDate: day("2024-06-10")}},
+		"EUR/CNY": {{Rate: "7.8", RateDate: day("2024-06-10")}},
+	})
+	rail := miso.EmptyRail()
+	d := day("2024-06-11").ToTime()
+
+	tab := []struct {
+		from, to string
+		date     time.Time
+		exp      string
+	}{
+		{"CNY", "CNY", d, "1"},
+		{"USD", "CNY", d, "7.2"},                          // direct
+		{"USD", "CNY", day("2024-06-05").ToTime(), "7.1"}, // nearest previous day
+		{"CNY", "USD", d, "0.13888889"},                   // inverse
+		{"USD", "JPY", d, "156.25"},                       // inverse
+		{"GBP", "CNY", d, "9.1764706"},                    // cross through EUR, 1.17647059 (1/0.85) * 7.8
+	}
+	for _, c := range tab {
+		r, err := findFxRate(rail, lookup, c.from, c.to, c.date)
+		if err != nil {
+			t.Fatalf("%v/%v: %v", c.from, c.to, err)
+		}
+		if r.Cmp(money.NewAmt(c.exp)) != 0 {
+			t.Fatalf("%v/%v on %v, expected: %v, actual: %v", c.from, c.to, c.date, c.exp, r)
+		}
+	}
+
+	if _, err := findFxRate(rail, lookup, "USD", "CNY", day("2024-05-31").ToTime()); err == nil {
+		t.Fatal("rate before the first date should not be found")
+	}
+	if _, err := findFxRate(rail, lookup, "USD", "CNY", day("2024-06-17").ToTime()); err != nil {
+		t.Fatalf("rate within max age should be used, %v", err)
+	}
+	if _, err := findFxRate(rail, lookup, "USD", "CNY", day("2024-06-18").ToTime()); err == nil {
+		t.Fatal("stale rate should not be used")
+	}
+	if _, err := findFxRate(rail, lookup, "HKD", "CNY", d); err == nil {
+		t.Fatal("HKD/CNY should not be found")
+	}
+}
+
+func TestValidateFxRate(t *testing.T) {
+	d := util.ToETime(time.Date(2024, 6, 11, 0, 0, 0, 0, time.Local))
+	if err := validateFxRate(ApiFxRate{BaseCurrency: "USD", QuoteCurrency: "CNY", RateDate: d, Rate: "7.2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateFxRate(ApiFxRate{BaseCurrency: "USD", QuoteCurrency: "CNY", Rate: "7.2"}); err == nil {
+		t.Fatal("rate date is missing")
+	}
+	if err := validateFxRate(ApiFxRate{BaseCurrency: "USD", QuoteCurrency: "CNY", RateDate: d, Rate: "0"}); err == nil {
+		t.Fatal("rate is zero")
+	}
+	if err := validateFxRate(ApiFxRate{BaseCurrency: "USD", QuoteCurrency: "USD", RateDate: d, Rate: "1"}); err == nil {
+		t.Fatal("same currency")
+	}
+}
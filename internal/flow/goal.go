@@ -0,0 +1,251 @@
+package flow
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	GoalMatchTag      = "TAG"
+	GoalMatchCategory = "CATEGORY"
+
+	// scale of monthly contributions before they are rounded to the currency's scale
+	goalDivScale = 8
+)
+
+type ApiSaveGoalReq struct {
+	GoalNo       string      `desc:"Goal No. A new goal is created if it's empty"`
+	Name         string      `desc:"Goal Name" valid:"notEmpty,maxLen:64"`
+	TargetAmount string      `desc:"Target Amount" valid:"notEmpty"`
+	Currency     string      `desc:"Currency" valid:"notEmpty"`
+	Deadline     util.ETime  `desc:"Deadline of the goal"`
+	MatchType    string      `desc:"How cashflows are matched: TAG, CATEGORY" valid:"member:TAG|CATEGORY"`
+	MatchValue   string      `desc:"Tag or Category Code of the cashflows" valid:"notEmpty"`
+	Direction    string      `desc:"Direction of cashflows that contribute to the goal, cashflows in the opposite direction are withdrawals" valid:"member:IN|OUT"`
+	StartTime    *util.ETime `desc:"Only cashflows after the start time are included, all cashflows are included if it's empty"`
+}
+
+type ApiGoalNoReq struct {
+	GoalNo string `desc:"Goal No" valid:"notEmpty"`
+}
+
+type Goal struct {
+	GoalNo       string
+	UserNo       string
+	Name         string
+	TargetAmount string
+	Currency     string
+	Deadline     util.ETime
+	MatchType    string
+	MatchValue   string
+	Direction    string
+	StartTime    *util.ETime
+}
+
+func SaveGoal(rail miso.Rail, db *gorm.DB, req ApiSaveGoalReq, user common.User) (string, error) {
+	if money.NewAmt(req.TargetAmount).Cmp(money.Zero()) <= 0 {
+		return "", miso.NewErrf("Invalid target amount '%v'", req.TargetAmount)
+	}
+
+	if req.GoalNo != "" {
+		// MySQL reports 0 affected rows if nothing is changed, existence is checked beforehand
+		if _, err := findGoal(db, req.GoalNo, user.UserNo); err != nil {
+			return "", err
+		}
+		t := db.Exec(`UPDATE saving_goal SET name = ?, target_amount = ?, currency = ?, deadline = ?, match_type = ?, match_value = ?,
+			direction = ?, start_time = ?, updated_by = ?
+			WHERE goal_no = ? AND user_no = ? AND deleted = 0`,
+			req.Name, req.TargetAmount, req.Currency, req.Deadline, req.MatchType, req.MatchValue, req.Direction, req.StartTime,
+			user.Username, req.GoalNo, user.UserNo)
+		if t.Error != nil {
+			return "", fmt.Errorf("failed to update saving_goal, %w", t.Error)
+		}
+	} else {
+		req.GoalNo = util.GenIdP("GOAL_")
+		err := db.Exec(`INSERT INTO saving_goal (goal_no, user_no, name, target_amount, currency, deadline, match_type, match_value,
+			direction, start_time, created_by) VALUES (?,?,?,?,?,?,?,?,?,?,?)`,
+			req.GoalNo, user.UserNo, req.Name, req.TargetAmount, req.Currency, req.Deadline, req.MatchType, req.MatchValue,
+			req.Direction, req.StartTime, user.Username).Error
+		if err != nil {
+			return "", fmt.Errorf("failed to save saving_goal, %w", err)
+		}
+	}
+	rail.Infof("Goal %v saved by %v", req.GoalNo, user.Username)
+	return req.GoalNo, nil
+}
+
+func findGoal(db *gorm.DB, goalNo string, userNo string) (Goal, error) {
+	var g Goal
+	t := db.Raw(`SELECT goal_no, user_no, name, target_amount, currency, deadline, match_type, match_value, direction, start_time
+		FROM saving_goal WHERE goal_no = ? AND user_no = ? AND deleted = 0`, goalNo, userNo).
+		Scan(&g)
+	if t.Error != nil {
+		return g, fmt.Errorf("failed to query saving_goal, %w", t.Error)
+	}
+	if t.RowsAffected < 1 {
+		return g, miso.NewErrf("Goal not found")
+	}
+	return g, nil
+}
+
+func DeleteGoal(rail miso.Rail, db *gorm.DB, req ApiGoalNoReq, user common.User) error {
+	err := db.Exec(`UPDATE saving_goal SET deleted = 1, updated_by = ? WHERE goal_no = ? AND user_no = ?`,
+		user.Username, req.GoalNo, user.UserNo).Error
+	if err != nil {
+		return fmt.Errorf("failed to delete saving_goal, %w", err)
+	}
+	return nil
+}
+
+type ApiGoalProgressRes struct {
+	GoalNo              string      `desc:"Goal No"`
+	Name                string      `desc:"Goal Name"`
+	Currency            string      `desc:"Currency"`
+	MatchType           string      `desc:"How cashflows are matched: TAG, CATEGORY"`
+	MatchValue          string      `desc:"Tag or Category Code of the cashflows"`
+	TargetAmount        string      `desc:"Target Amount"`
+	Deadline            util.ETime  `desc:"Deadline of the goal"`
+	Saved               string      `desc:"Amount saved so far"`
+	Remaining           string      `desc:"Remaining amount to reach the target"`
+	ProgressPct         string      `desc:"Percentage of target amount saved"`
+	MonthsLeft          int         `desc:"Number of months left before deadline, including current month"`
+	RequiredMonthly     string      `desc:"Monthly contribution required to reach the target before deadline"`
+	AvgMonthly          string      `desc:"Average monthly contribution so far"`
+	ProjectedCompletion *util.ETime `desc:"Projected completion date based on average monthly contribution, empty if it can't be projected"`
+}
+
+// List progress of all goals.
+func GoalProgress(rail miso.Rail, db *gorm.DB, user common.User) ([]ApiGoalProgressRes, error) {
+	var goals []Goal
+	err := db.Raw(`SELECT goal_no, user_no, name, target_amount, currency, deadline, match_type, match_value, direction, start_time
+		FROM saving_goal WHERE user_no = ? AND deleted = 0 ORDER BY deadline`, user.UserNo).
+		Scan(&goals).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list saving_goal, %w", err)
+	}
+
+	now := time.Now()
+	res := make([]ApiGoalProgressRes, 0, len(goals))
+	for _, g := range goals {
+		saved, first, err := calcGoalSaved(db, g)
+		if err != nil {
+			return nil, err
+		}
+		start := now
+		if g.StartTime != nil {
+			start = g.StartTime.ToTime()
+		} else if first != nil {
+			start = first.ToTime()
+		}
+		p := calcGoalProgress(money.NewAmt(g.TargetAmount), saved, start, g.Deadline.ToTime(), now)
+		r := ApiGoalProgressRes{
+			GoalNo:          g.GoalNo,
+			Name:            g.Name,
+			Currency:        g.Currency,
+			MatchType:       g.MatchType,
+			MatchValue:      g.MatchValue,
+			TargetAmount:    money.UnitFmt(g.TargetAmount, g.Currency),
+			Deadline:        g.Deadline,
+			Saved:           money.UnitFmt(saved.String(), g.Currency),
+			Remaining:       money.UnitFmt(p.Remaining.String(), g.Currency),
+			ProgressPct:     p.ProgressPct.String(),
+			MonthsLeft:      p.MonthsLeft,
+			RequiredMonthly: money.UnitFmt(p.RequiredMonthly.String(), g.Currency),
+			AvgMonthly:      money.UnitFmt(p.AvgMonthly.String(), g.Currency),
+		}
+		if p.ProjectedCompletion != nil {
+			pc := util.ToETime(*p.ProjectedCompletion)
+			r.ProjectedCompletion = &pc
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+type goalSavedSum struct {
+	AmountSum string
+	FirstTime *util.ETime
+}
+
+// Calculate amount saved for the goal, and the time of the first matched cashflow.
+func calcGoalSaved(db *gorm.DB, g Goal) (*money.Amt, *util.ETime, error) {
+	var sum goalSavedSum
+	tx := db.Table("cashflow c").
+		Select("COALESCE(SUM(case when c.direction = ? then c.amount else (-1 * c.amount) end), 0) amount_sum, MIN(c.trans_time) first_time", g.Direction).
+		Where("c.user_no = ?", g.UserNo).
+		Where("c.currency = ?", g.Currency).
+		Where("c.stat_excluded = 0").
+		Where("c.deleted = 0")
+	if g.MatchType == GoalMatchTag {
+		tx = tx.Joins("JOIN cashflow_tag t ON c.user_no = t.user_no AND c.category = t.category AND c.trans_id = t.trans_id").
+			Where("t.tag = ?", g.MatchValue)
+	} else {
+		tx = tx.Where("c.category = ?", g.MatchValue)
+	}
+	if g.StartTime != nil {
+		tx = tx.Where("c.trans_time >= ?", g.StartTime)
+	}
+	if err := tx.Scan(&sum).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to calculate goal saved amount, %w", err)
+	}
+	return money.NewAmt(sum.AmountSum), sum.FirstTime, nil
+}
+
+type goalProgress struct {
+	Remaining           *money.Amt
+	ProgressPct         *money.Amt
+	MonthsLeft          int
+	RequiredMonthly     *money.Amt
+	AvgMonthly          *money.Amt
+	ProjectedCompletion *time.Time
+}
+
+// Number of calendar months from t1 to t2, both months are included.
+func monthsBetween(t1 time.Time, t2 time.Time) int {
+	return (t2.Year()-t1.Year())*12 + int(t2.Month()-t1.Month()) + 1
+}
+
+func calcGoalProgress(target *money.Amt, saved *money.Amt, start time.Time, deadline time.Time, now time.Time) goalProgress {
+	p := goalProgress{
+		Remaining:       target.Sub(saved),
+		ProgressPct:     saved.Mul(money.NewAmt("100")).Div(target, 2),
+		RequiredMonthly: money.Zero(),
+		AvgMonthly:      money.Zero(),
+	}
+	if p.Remaining.Cmp(money.Zero()) < 0 {
+		p.Remaining = money.Zero()
+	}
+
+	p.MonthsLeft = util.MaxInt(monthsBetween(now, deadline), 0)
+	if p.Remaining.Cmp(money.Zero()) > 0 {
+		if p.MonthsLeft > 0 {
+			p.RequiredMonthly = p.Remaining.Div(money.NewAmt(fmt.Sprintf("%d", p.MonthsLeft)), goalDivScale)
+		} else {
+			p.RequiredMonthly = p.Remaining
+		}
+	}
+
+	elapsed := util.MaxInt(monthsBetween(start, now), 1)
+	p.AvgMonthly = saved.Div(money.NewAmt(fmt.Sprintf("%d", elapsed)), goalDivScale)
+
+	if p.Remaining.Cmp(money.Zero()) == 0 {
+		p.ProjectedCompletion = &now
+	} else if p.AvgMonthly.Cmp(money.Zero()) > 0 {
+		// number of months needed, rounded up
+		months := p.Remaining.Div(p.AvgMonthly, 0)
+		if months.Mul(p.AvgMonthly).Cmp(p.Remaining) < 0 {
+			months = months.Add(money.NewAmt("1"))
+		}
+		n, _ := strconv.Atoi(months.String())
+		pc := now.AddDate(0, n, 0)
+		p.ProjectedCompletion = &pc
+	}
+	return p
+}
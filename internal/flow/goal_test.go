@@ -0,0 +1,44 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+)
+
+func TestCalcGoalProgress(t *testing.T) {
+	start := time.Date(2024, 1, 10, 0, 0, 0, 0, time.Local)
+	now := time.Date(2024, 6, 15, 0, 0, 0, 0, time.Local)
+	deadline := time.Date(2024, 12, 31, 0, 0, 0, 0, time.Local)
+
+	p := calcGoalProgress(money.NewAmt("10000"), money.NewAmt("3000"), start, deadline, now)
+	if p.Remaining.String() != "7000" {
+		t.Fatalf("remaining: %v", p.Remaining)
+	}
+	if p.ProgressPct.String() != "30.00" {
+		t.Fatalf("progress: %v", p.ProgressPct)
+	}
+	if p.MonthsLeft != 7 {
+		t.Fatalf("months left: %v", p.MonthsLeft)
+	}
+	if p.RequiredMonthly.Round(2).String() != "1000.00" {
+		t.Fatalf("required monthly: %v", p.RequiredMonthly)
+	}
+	if p.AvgMonthly.Round(2).String() != "500.00" {
+		t.Fatalf("avg monthly: %v", p.AvgMonthly)
+	}
+	if p.ProjectedCompletion == nil || p.ProjectedCompletion.Format("200601") != "202508" {
+		t.Fatalf("projected: %v", p.ProjectedCompletion)
+	}
+
+	p = calcGoalProgress(money.NewAmt("100"), money.NewAmt("120"), start, deadline, now)
+	if p.Remaining.String() != "0" || p.ProjectedCompletion == nil {
+		t.Fatalf("completed goal: %+v", p)
+	}
+
+	p = calcGoalProgress(money.NewAmt("100"), money.Zero(), now, deadline, now)
+	if p.ProjectedCompletion != nil {
+		t.Fatalf("projected: %v", p.ProjectedCompletion)
+	}
+}
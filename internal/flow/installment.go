@@ -0,0 +1,307 @@
+package flow
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	maxInstallmentPeriods = 360
+	installmentScale      = 2
+)
+
+type ApiCreateInstallmentReq struct {
+	Category     string      `desc:"Category Code of the purchase" valid:"notEmpty"`
+	TransId      string      `desc:"Transaction ID of the purchase" valid:"notEmpty"`
+	Periods      int         `desc:"Number of installment periods (months)"`
+	Fee          string      `desc:"Total fee/interest of the installment plan"`
+	FirstDueTime *util.ETime `desc:"Due time of the first installment, by default it's one month after the purchase"`
+	Amortised    bool        `desc:"Whether the purchase is amortised over the plan in statistics, i.e., the installments are counted instead of the purchase"`
+}
+
+type purchaseCashflow struct {
+	Direction     string
+	TransTime     util.ETime
+	Counterparty  string
+	Amount        string
+	Currency      string
+	InstallmentNo string
+}
+
+// Mark a purchase as an installment plan, the scheduled installment cashflows are generated immediately.
+//
+// Only one of the purchase and the installments is counted in statistics, based on whether the plan is amortised.
+// Installments are saved in the same category as the purchase, so that the spending stays in the category's budgets and envelopes.
+func CreateInstallmentPlan(rail miso.Rail, db *gorm.DB, req ApiCreateInstallmentReq, user common.User) (string, error) {
+	if req.Periods < 2 || req.Periods > maxInstallmentPeriods {
+		return "", miso.NewErrf("Invalid number of installment periods")
+	}
+	if req.Fee == "" {
+		req.Fee = "0"
+	}
+	if money.NewAmt(req.Fee).Cmp(money.Zero()) < 0 {
+		return "", miso.NewErrf("Invalid installment fee '%v'", req.Fee)
+	}
+
+	var p purchaseCashflow
+	t := db.Raw(`SELECT direction, trans_time, counterparty, amount, currency, installment_no FROM cashflow
+		WHERE user_no = ? AND category = ? AND trans_id = ? AND deleted = 0`, user.UserNo, req.Category, req.TransId).
+		Scan(&p)
+	if t.Error != nil {
+		return "", fmt.Errorf("failed to query cashflow, %w", t.Error)
+	}
+	if t.RowsAffected < 1 {
+		return "", miso.NewErrf("Cashflow not found")
+	}
+	if p.Direction != DirectionOut {
+		return "", miso.NewErrf("Only purchases (OUT) can be paid in installments")
+	}
+	if p.InstallmentNo != "" {
+		return "", miso.NewErrf("Cashflow is already paid in installments")
+	}
+
+	firstDue := p.TransTime.ToTime().AddDate(0, 1, 0)
+	if req.FirstDueTime != nil {
+		firstDue = req.FirstDueTime.ToTime()
+	}
+	planNo := util.GenIdP("INST_")
+	flows := buildInstallmentCashflows(planNo, p, req, firstDue)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// the purchase is claimed first, so that concurrent requests can't create two plans for it
+		t := tx.Exec(`UPDATE cashflow SET installment_no = ?, stat_excluded = ?, updated_by = ?
+			WHERE user_no = ? AND category = ? AND trans_id = ? AND installment_no = '' AND deleted = 0`,
+			planNo, installmentStatExcluded(true, req.Amortised), user.Username, user.UserNo, req.Category, req.TransId)
+		if t.Error != nil {
+			return fmt.Errorf("failed to update cashflow installment_no, %w", t.Error)
+		}
+		if t.RowsAffected < 1 {
+			return miso.NewErrf("Cashflow is already paid in installments")
+		}
+		err := tx.Exec(`INSERT INTO installment_plan (plan_no, user_no, category, trans_id, periods, principal, fee, currency, first_due_time, amortised, created_by)
+			VALUES (?,?,?,?,?,?,?,?,?,?,?)`,
+			planNo, user.UserNo, req.Category, req.TransId, req.Periods, p.Amount, req.Fee, p.Currency, firstDue, req.Amortised, user.Username).Error
+		if err != nil {
+			return fmt.Errorf("failed to save installment_plan, %w", err)
+		}
+		_, err = SaveCashflows(rail, tx, SaveCashflowParams{Cashflows: flows, Category: req.Category, User: user})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	rail.Infof("Installment plan %v created for %v by %v, %d periods", planNo, req.TransId, user.Username, req.Periods)
+
+	changes := util.MapTo(flows, func(nc NewCashflow) CashflowChange { return CashflowChange{TransTime: nc.TransTime} })
+	changes = append(changes, CashflowChange{TransTime: p.TransTime})
+	if err := OnCashflowChanged(rail, changes, user.UserNo); err != nil {
+		rail.Errorf("Failed to update cashflow statistics for installment plan %v, userNo: %v, %v", planNo, user.UserNo, err)
+	}
+	return planNo, nil
+}
+
+func buildInstallmentCashflows(planNo string, p purchaseCashflow, req ApiCreateInstallmentReq, firstDue time.Time) []NewCashflow {
+	amounts := splitInstallments(money.NewAmt(p.Amount), money.NewAmt(req.Fee), req.Periods)
+	flows := make([]NewCashflow, 0, len(amounts))
+	for i, amt := range amounts {
+		flows = append(flows, NewCashflow{
+			Direction:     DirectionOut,
+			TransTime:     util.ToETime(firstDue.AddDate(0, i, 0)),
+			TransId:       installmentTransId(planNo, i+1),
+			Counterparty:  p.Counterparty,
+			Amount:        amt.String(),
+			Currency:      p.Currency,
+			Extra:         "{}",
+			Remark:        fmt.Sprintf("Installment %d/%d", i+1, req.Periods),
+			InstallmentNo: planNo,
+			StatExcluded:  installmentStatExcluded(false, req.Amortised),
+		})
+	}
+	return flows
+}
+
+// Whether the purchase or the installment is excluded from statistics, only one of them is counted.
+func installmentStatExcluded(purchase bool, amortised bool) bool {
+	return purchase == amortised
+}
+
+func installmentTransId(planNo string, period int) string {
+	return fmt.Sprintf("%v_%d", planNo, period)
+}
+
+// Split principal and fee into installments evenly, the last installment absorbs the rounding difference.
+func splitInstallments(principal *money.Amt, fee *money.Amt, periods int) []*money.Amt {
+	total := principal.Add(fee)
+	each := total.Div(money.NewAmt(fmt.Sprintf("%d", periods)), installmentScale)
+	res := make([]*money.Amt, 0, periods)
+	sum := money.Zero()
+	for i := 0; i < periods-1; i++ {
+		res = append(res, each)
+		sum = sum.Add(each)
+	}
+	return append(res, total.Sub(sum))
+}
+
+type ApiAmortiseInstallmentReq struct {
+	PlanNo    string `desc:"Installment Plan No" valid:"notEmpty"`
+	Amortised bool   `desc:"Whether the purchase is amortised over the plan in statistics"`
+}
+
+// Switch between counting the purchase or the installments in statistics.
+func AmortiseInstallmentPlan(rail miso.Rail, db *gorm.DB, req ApiAmortiseInstallmentReq, user common.User) error {
+	plan, err := findInstallmentPlan(db, req.PlanNo, user.UserNo)
+	if err != nil {
+		return err
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`UPDATE installment_plan SET amortised = ?, updated_by = ? WHERE plan_no = ? AND user_no = ? AND deleted = 0`,
+			req.Amortised, user.Username, req.PlanNo, user.UserNo).Error
+		if err != nil {
+			return fmt.Errorf("failed to update installment_plan, %w", err)
+		}
+		err = tx.Exec(`UPDATE cashflow SET stat_excluded = case when category = ? and trans_id = ? then ? else ? end
+			WHERE user_no = ? AND installment_no = ? AND deleted = 0`,
+			plan.Category, plan.TransId, installmentStatExcluded(true, req.Amortised), installmentStatExcluded(false, req.Amortised),
+			user.UserNo, req.PlanNo).Error
+		if err != nil {
+			return fmt.Errorf("failed to update cashflow stat_excluded, %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return onInstallmentPlanChanged(rail, db, req.PlanNo, user.UserNo)
+}
+
+// Cancel the installment plan, the generated installments are removed.
+func CancelInstallmentPlan(rail miso.Rail, db *gorm.DB, req ApiInstallmentPlanNoReq, user common.User) error {
+	plan, err := findInstallmentPlan(db, req.PlanNo, user.UserNo)
+	if err != nil {
+		return err
+	}
+	changes, err := installmentPlanChanges(db, req.PlanNo, user.UserNo)
+	if err != nil {
+		return err
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`UPDATE installment_plan SET deleted = 1, updated_by = ? WHERE plan_no = ? AND user_no = ? AND deleted = 0`,
+			user.Username, req.PlanNo, user.UserNo).Error
+		if err != nil {
+			return fmt.Errorf("failed to delete installment_plan, %w", err)
+		}
+		err = tx.Exec(`UPDATE cashflow SET deleted = 1, updated_by = ?
+			WHERE user_no = ? AND installment_no = ? AND NOT (category = ? AND trans_id = ?)`,
+			user.Username, user.UserNo, req.PlanNo, plan.Category, plan.TransId).Error
+		if err != nil {
+			return fmt.Errorf("failed to delete installment cashflows, %w", err)
+		}
+		err = tx.Exec(`UPDATE cashflow SET installment_no = '', stat_excluded = 0, updated_by = ? WHERE user_no = ? AND installment_no = ?`,
+			user.Username, user.UserNo, req.PlanNo).Error
+		if err != nil {
+			return fmt.Errorf("failed to reset cashflow installment_no, %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := OnCashflowChanged(rail, changes, user.UserNo); err != nil {
+		rail.Errorf("Failed to update cashflow statistics for installment plan %v, userNo: %v, %v", req.PlanNo, user.UserNo, err)
+	}
+	return nil
+}
+
+type installmentPlan struct {
+	PlanNo    string
+	Category  string
+	TransId   string
+	Amortised bool
+}
+
+func findInstallmentPlan(db *gorm.DB, planNo string, userNo string) (installmentPlan, error) {
+	var p installmentPlan
+	t := db.Raw(`SELECT plan_no, category, trans_id, amortised FROM installment_plan WHERE plan_no = ? AND user_no = ? AND deleted = 0`,
+		planNo, userNo).
+		Scan(&p)
+	if t.Error != nil {
+		return p, fmt.Errorf("failed to query installment_plan, %w", t.Error)
+	}
+	if t.RowsAffected < 1 {
+		return p, miso.NewErrf("Installment plan not found")
+	}
+	return p, nil
+}
+
+func installmentPlanChanges(db *gorm.DB, planNo string, userNo string) ([]CashflowChange, error) {
+	var changes []CashflowChange
+	err := db.Raw(`SELECT trans_time FROM cashflow WHERE user_no = ? AND installment_no = ? AND deleted = 0`, userNo, planNo).
+		Scan(&changes).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query installment cashflows, %w", err)
+	}
+	return changes, nil
+}
+
+func onInstallmentPlanChanged(rail miso.Rail, db *gorm.DB, planNo string, userNo string) error {
+	changes, err := installmentPlanChanges(db, planNo, userNo)
+	if err != nil {
+		return err
+	}
+	if err := OnCashflowChanged(rail, changes, userNo); err != nil {
+		rail.Errorf("Failed to update cashflow statistics for installment plan %v, userNo: %v, %v", planNo, userNo, err)
+	}
+	return nil
+}
+
+type ApiInstallmentPlanNoReq struct {
+	PlanNo string `desc:"Installment Plan No" valid:"notEmpty"`
+}
+
+type ApiListInstallmentPlanReq struct {
+	Paging miso.Paging `desc:"Paging"`
+}
+
+type ApiListInstallmentPlanRes struct {
+	PlanNo       string     `desc:"Installment Plan No"`
+	Category     string     `desc:"Category Code of the purchase"`
+	TransId      string     `desc:"Transaction ID of the purchase"`
+	Periods      int        `desc:"Number of installment periods"`
+	Principal    string     `desc:"Amount of the purchase"`
+	Fee          string     `desc:"Total fee/interest"`
+	Currency     string     `desc:"Currency"`
+	FirstDueTime util.ETime `desc:"Due time of the first installment"`
+	Amortised    bool       `desc:"Whether the purchase is amortised over the plan in statistics"`
+	PaidPeriods  int        `desc:"Number of installments that are due" gorm:"-"`
+	CreatedAt    util.ETime `desc:"Create Time"`
+}
+
+func ListInstallmentPlans(rail miso.Rail, db *gorm.DB, req ApiListInstallmentPlanReq, user common.User) (miso.PageRes[ApiListInstallmentPlanRes], error) {
+	now := time.Now()
+	return miso.NewPageQuery[ApiListInstallmentPlanRes]().
+		WithPage(req.Paging).
+		WithBaseQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Table(`installment_plan`).
+				Where("user_no = ?", user.UserNo).
+				Where("deleted = 0")
+		}).
+		WithSelectQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Select("plan_no", "category", "trans_id", "periods", "principal", "fee", "currency", "first_due_time", "amortised", "created_at").
+				Order("id desc")
+		}).
+		ForEach(func(t ApiListInstallmentPlanRes) ApiListInstallmentPlanRes {
+			for t.PaidPeriods < t.Periods && !t.FirstDueTime.ToTime().AddDate(0, t.PaidPeriods, 0).After(now) {
+				t.PaidPeriods++
+			}
+			t.Principal = money.UnitFmt(t.Principal, t.Currency)
+			t.Fee = money.UnitFmt(t.Fee, t.Currency)
+			return t
+		}).
+		Exec(rail, db)
+}
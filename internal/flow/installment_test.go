@@ -0,0 +1,66 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+)
+
+func TestSplitInstallments(t *testing.T) {
+	l := splitInstallments(money.NewAmt("1000"), money.NewAmt("20"), 3)
+	exp := []string{"340.00", "340.00", "340.00"}
+	for i, v := range l {
+		if v.String() != exp[i] {
+			t.Fatalf("installments: %v", l)
+		}
+	}
+
+	l = splitInstallments(money.NewAmt("100"), money.Zero(), 3)
+	exp = []string{"33.33", "33.33", "33.34"}
+	sum := money.Zero()
+	for i, v := range l {
+		if v.String() != exp[i] {
+			t.Fatalf("installments: %v", l)
+		}
+		sum = sum.Add(v)
+	}
+	if sum.Cmp(money.NewAmt("100")) != 0 {
+		t.Fatalf("sum: %v", sum)
+	}
+}
+
+func TestBuildInstallmentCashflows(t *testing.T) {
+	p := purchaseCashflow{Direction: DirectionOut, Counterparty: "Apple", Amount: "1000", Currency: "CNY"}
+	firstDue := time.Date(2024, 2, 10, 0, 0, 0, 0, time.Local)
+
+	for _, amortised := range []bool{true, false} {
+		req := ApiCreateInstallmentReq{Category: "WECHAT", TransId: "T1", Periods: 3, Fee: "20", Amortised: amortised}
+		flows := buildInstallmentCashflows("INST_1", p, req, firstDue)
+		if len(flows) != 3 {
+			t.Fatalf("len: %v", len(flows))
+		}
+		for _, f := range flows {
+			if f.StatExcluded != !amortised {
+				t.Fatalf("amortised: %v, installment stat_excluded: %v", amortised, f.StatExcluded)
+			}
+			if f.InstallmentNo != "INST_1" || f.Amount != "340.00" {
+				t.Fatalf("installment: %+v", f)
+			}
+		}
+		if flows[2].TransId != "INST_1_3" || !flows[2].TransTime.ToTime().Equal(firstDue.AddDate(0, 2, 0)) {
+			t.Fatalf("last installment: %+v", flows[2])
+		}
+	}
+}
+
+func TestInstallmentStatExcluded(t *testing.T) {
+	// amortised, the installments are counted instead of the purchase
+	if !installmentStatExcluded(true, true) || installmentStatExcluded(false, true) {
+		t.Fatal("amortised")
+	}
+	// not amortised, the purchase is counted
+	if installmentStatExcluded(true, false) || !installmentStatExcluded(false, false) {
+		t.Fatal("not amortised")
+	}
+}
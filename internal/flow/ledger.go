@@ -0,0 +1,360 @@
+package flow
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/curtisnewbie/miso/encoding"
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	LedgerFormatBeancount = "BEANCOUNT"
+	LedgerFormatLedger    = "LEDGER" // ledger-cli and hledger
+
+	LedgerMappingExpense = "EXPENSE" // category code -> expense account, for OUT cashflows
+	LedgerMappingIncome  = "INCOME"  // category code -> income account, for IN cashflows
+	LedgerMappingAsset   = "ASSET"   // payment method -> asset account
+
+	// transfers are booked against the clearing account, so that both sides of the transfer net to zero
+	LedgerTransferAccount = "Assets:Transfer"
+	ledgerUnknownAsset    = "Assets:Unknown"
+)
+
+type ApiSaveLedgerMappingReq struct {
+	MappingType   string `desc:"Mapping Type: EXPENSE (category code), INCOME (category code), ASSET (payment method)" valid:"member:EXPENSE|INCOME|ASSET"`
+	Source        string `desc:"Category Code or Payment Method" valid:"notEmpty,maxLen:255"`
+	LedgerAccount string `desc:"Ledger account, e.g., Expenses:Food" valid:"notEmpty,maxLen:255"`
+}
+
+type ApiDeleteLedgerMappingReq struct {
+	MappingType string `desc:"Mapping Type: EXPENSE, INCOME, ASSET" valid:"notEmpty"`
+	Source      string `desc:"Category Code or Payment Method" valid:"notEmpty"`
+}
+
+type ApiLedgerMapping struct {
+	MappingType   string     `desc:"Mapping Type: EXPENSE, INCOME, ASSET"`
+	Source        string     `desc:"Category Code or Payment Method"`
+	LedgerAccount string     `desc:"Ledger account"`
+	UpdatedAt     util.ETime `desc:"Update Time"`
+}
+
+func SaveLedgerMapping(rail miso.Rail, db *gorm.DB, req ApiSaveLedgerMappingReq, user common.User) error {
+	account := normalizeLedgerAccount(req.LedgerAccount)
+	if !strings.Contains(account, ":") {
+		return miso.NewErrf("Invalid ledger account '%v'", req.LedgerAccount)
+	}
+	err := db.Exec(`INSERT INTO ledger_account_mapping (user_no, mapping_type, source, ledger_account, created_by) VALUES (?,?,?,?,?)
+		ON DUPLICATE KEY UPDATE ledger_account = VALUES(ledger_account), updated_by = VALUES(created_by)`,
+		user.UserNo, req.MappingType, strings.TrimSpace(req.Source), account, user.Username).Error
+	if err != nil {
+		return fmt.Errorf("failed to save ledger_account_mapping, %w", err)
+	}
+	return nil
+}
+
+func DeleteLedgerMapping(rail miso.Rail, db *gorm.DB, req ApiDeleteLedgerMappingReq, user common.User) error {
+	err := db.Exec(`DELETE FROM ledger_account_mapping WHERE user_no = ? AND mapping_type = ? AND source = ?`,
+		user.UserNo, req.MappingType, req.Source).Error
+	if err != nil {
+		return fmt.Errorf("failed to delete ledger_account_mapping, %w", err)
+	}
+	return nil
+}
+
+func ListLedgerMappings(rail miso.Rail, db *gorm.DB, user common.User) ([]ApiLedgerMapping, error) {
+	var l []ApiLedgerMapping
+	err := db.Raw(`SELECT mapping_type, source, ledger_account, updated_at FROM ledger_account_mapping
+		WHERE user_no = ? ORDER BY mapping_type, source`, user.UserNo).
+		Scan(&l).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ledger_account_mapping, %w", err)
+	}
+	if l == nil {
+		l = []ApiLedgerMapping{}
+	}
+	return l, nil
+}
+
+// Ledger account mapping of a user, keyed by mapping type and then source.
+type ledgerMappings map[string]map[string]string
+
+func loadLedgerMappings(db *gorm.DB, userNo string) (ledgerMappings, error) {
+	var l []ApiLedgerMapping
+	err := db.Raw(`SELECT mapping_type, source, ledger_account FROM ledger_account_mapping WHERE user_no = ?`, userNo).
+		Scan(&l).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ledger_account_mapping, %w", err)
+	}
+	m := ledgerMappings{}
+	for _, v := range l {
+		if m[v.MappingType] == nil {
+			m[v.MappingType] = map[string]string{}
+		}
+		m[v.MappingType][v.Source] = v.LedgerAccount
+	}
+	return m, nil
+}
+
+// Resolve the asset account and the counter account (expense, income or the transfer clearing account) of the cashflow.
+//
+// Unmapped categories and payment methods are converted to account names, e.g., 'Expenses:WECHAT', 'Assets:零钱'.
+func (m ledgerMappings) Accounts(c exportCashflow, accounts map[string]string) (asset string, counter string) {
+	if v, ok := m[LedgerMappingAsset][c.PaymentMethod]; ok && c.PaymentMethod != "" {
+		asset = v
+	} else if name := accounts[c.AccountNo]; name != "" {
+		asset = ledgerAccountName("Assets", name)
+	} else if c.PaymentMethod != "" {
+		asset = ledgerAccountName("Assets", c.PaymentMethod)
+	} else {
+		asset = ledgerUnknownAsset
+	}
+
+	switch {
+	case c.TransferNo != "":
+		counter = LedgerTransferAccount
+	case c.Direction == DirectionIn:
+		if v, ok := m[LedgerMappingIncome][c.Category]; ok {
+			counter = v
+		} else {
+			counter = ledgerAccountName("Income", c.Category)
+		}
+	default:
+		if v, ok := m[LedgerMappingExpense][c.Category]; ok {
+			counter = v
+		} else {
+			counter = ledgerAccountName("Expenses", c.Category)
+		}
+	}
+	return asset, counter
+}
+
+// Build account name from the root and an arbitrary name, characters that are not allowed are replaced with '-'.
+func ledgerAccountName(root string, name string) string {
+	return normalizeLedgerAccount(root + ":" + name)
+}
+
+// Normalize account name, each component should start with an uppercase letter (or non-ASCII letter) or a digit.
+func normalizeLedgerAccount(account string) string {
+	comps := strings.Split(strings.TrimSpace(account), ":")
+	res := make([]string, 0, len(comps))
+	for _, c := range comps {
+		rs := []rune(strings.TrimSpace(c))
+		for i, r := range rs {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' {
+				rs[i] = '-'
+			}
+		}
+		s := strings.Trim(string(rs), "-")
+		if s == "" {
+			continue
+		}
+		rs = []rune(s)
+		rs[0] = unicode.ToUpper(rs[0])
+		res = append(res, string(rs))
+	}
+	return strings.Join(res, ":")
+}
+
+type ledgerPosting struct {
+	Account string
+	Amount  string // signed amount
+}
+
+type ledgerTxn struct {
+	Date     time.Time
+	Payee    string
+	Narr     string
+	Meta     [][2]string
+	Currency string
+	Postings []ledgerPosting
+}
+
+func buildLedgerTxn(c exportCashflow, m ledgerMappings, accounts map[string]string) ledgerTxn {
+	asset, counter := m.Accounts(c, accounts)
+	amt := money.UnitFmt(c.Amount, c.Currency)
+	neg := money.UnitFmt(money.Zero().Sub(money.NewAmt(c.Amount)).String(), c.Currency)
+	t := ledgerTxn{
+		Date:     c.TransTime.ToTime(),
+		Payee:    c.Counterparty,
+		Narr:     c.Remark,
+		Currency: c.Currency,
+		Meta:     [][2]string{{"trans_id", c.TransId}, {"category", c.Category}},
+	}
+	if c.PaymentMethod != "" {
+		t.Meta = append(t.Meta, [2]string{"payment_method", c.PaymentMethod})
+	}
+	if c.TransferNo != "" {
+		t.Meta = append(t.Meta, [2]string{"transfer_no", c.TransferNo})
+	}
+	if c.Direction == DirectionIn {
+		t.Postings = []ledgerPosting{{Account: asset, Amount: amt}, {Account: counter, Amount: neg}}
+	} else {
+		t.Postings = []ledgerPosting{{Account: counter, Amount: amt}, {Account: asset, Amount: neg}}
+	}
+	return t
+}
+
+func beancountQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", " ") + `"`
+}
+
+func renderBeancountTxn(t ledgerTxn) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%v * %v %v\n", t.Date.Format("2006-01-02"), beancountQuote(t.Payee), beancountQuote(t.Narr))
+	for _, m := range t.Meta {
+		fmt.Fprintf(&b, "  %v: %v\n", m[0], beancountQuote(m[1]))
+	}
+	for _, p := range t.Postings {
+		fmt.Fprintf(&b, "  %v  %v %v\n", p.Account, p.Amount, t.Currency)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func renderLedgerTxn(t ledgerTxn) string {
+	oneLine := func(s string) string { return strings.ReplaceAll(s, "\n", " ") }
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%v * %v", t.Date.Format("2006/01/02"), oneLine(t.Payee))
+	if t.Narr != "" {
+		fmt.Fprintf(&b, "  ; %v", oneLine(t.Narr))
+	}
+	b.WriteString("\n")
+	for _, m := range t.Meta {
+		fmt.Fprintf(&b, "    ; %v: %v\n", m[0], oneLine(m[1]))
+	}
+	for _, p := range t.Postings {
+		fmt.Fprintf(&b, "    %v  %v %v\n", p.Account, p.Amount, t.Currency)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// Beancount requires accounts to be opened before they are used.
+func renderBeancountOpens(date time.Time, accounts []string) string {
+	b := strings.Builder{}
+	for _, a := range accounts {
+		fmt.Fprintf(&b, "%v open %v\n", date.Format("2006-01-02"), a)
+	}
+	return b.String()
+}
+
+// Export cashflows matching the filters in the request body (ListCashFlowReq, paging is ignored) as plain-text ledger.
+//
+// The format is specified in query param 'format', either BEANCOUNT or LEDGER.
+func ExportLedger(inb *miso.Inbound, db *gorm.DB) error {
+	rail := inb.Rail()
+	user := common.GetUser(rail)
+	format := strings.ToUpper(inb.Query("format"))
+	if format == "" {
+		format = LedgerFormatBeancount
+	}
+	if format != LedgerFormatBeancount && format != LedgerFormatLedger {
+		return miso.NewErrf("Invalid format '%v', should be either %v or %v", format, LedgerFormatBeancount, LedgerFormatLedger)
+	}
+
+	w, r := inb.Unwrap()
+	defer r.Body.Close()
+	var req ListCashFlowReq
+	if err := encoding.DecodeJson(r.Body, &req); err != nil && err != io.EOF {
+		return miso.NewErrf("Illegal Arguments").WithInternalMsg("%v", err)
+	}
+	if err := miso.Validate(req); err != nil {
+		return err
+	}
+	mappings, err := loadLedgerMappings(db, user.UserNo)
+	if err != nil {
+		return err
+	}
+	accounts, err := findAccountNames(db, user.UserNo)
+	if err != nil {
+		return err
+	}
+
+	ext := "beancount"
+	if format == LedgerFormatLedger {
+		ext = "ledger"
+	}
+	name := fmt.Sprintf("cashflows_%v.%v", time.Now().Format("20060102150405"), ext)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, name))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	// the response is already committed, errors below are only logged
+	bw := bufio.NewWriter(w)
+	n, err := writeLedgerTxns(db, user, req, bw, format, mappings, accounts)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		rail.Errorf("Failed to export ledger for %v, %v", user.Username, err)
+		return nil
+	}
+	rail.Infof("Exported %d cashflows in %v for %v", n, format, user.Username)
+	return nil
+}
+
+func writeLedgerTxns(db *gorm.DB, user common.User, req ListCashFlowReq, w io.Writer, format string, mappings ledgerMappings,
+	accounts map[string]string) (int, error) {
+
+	rows, err := filterCashflows(db, user, req).
+		Select("direction", "trans_time", "trans_id", "counterparty", "payment_method", "amount", "currency",
+			"category", "remark", "account_no", "transfer_no").
+		Order("trans_time").
+		Rows()
+	if err != nil {
+		return 0, fmt.Errorf("failed to query cashflows, %w", err)
+	}
+	defer rows.Close()
+
+	n := 0
+	var first time.Time
+	used := util.NewSet[string]()
+	for rows.Next() {
+		var c exportCashflow
+		if err := db.ScanRows(rows, &c); err != nil {
+			return n, fmt.Errorf("failed to scan cashflow, %w", err)
+		}
+		t := buildLedgerTxn(c, mappings, accounts)
+		var s string
+		if format == LedgerFormatBeancount {
+			s = renderBeancountTxn(t)
+		} else {
+			s = renderLedgerTxn(t)
+		}
+		if _, err := io.WriteString(w, s); err != nil {
+			return n, err
+		}
+		if n == 0 {
+			first = t.Date
+		}
+		for _, p := range t.Postings {
+			used.Add(p.Account)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("failed to iterate cashflows, %w", err)
+	}
+
+	if format == LedgerFormatBeancount && n > 0 {
+		opens := used.CopyKeys()
+		sort.Strings(opens)
+		if _, err := io.WriteString(w, renderBeancountOpens(first, opens)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,66 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/util"
+)
+
+func TestNormalizeLedgerAccount(t *testing.T) {
+	cases := map[string]string{
+		"expenses:food":      "Expenses:Food",
+		"Assets:零钱":          "Assets:零钱",
+		"Assets: bank card ": "Assets:Bank-card",
+		"Expenses::a_b":      "Expenses:A-b",
+	}
+	for in, exp := range cases {
+		if v := normalizeLedgerAccount(in); v != exp {
+			t.Fatalf("%v: expected %v, actual %v", in, exp, v)
+		}
+	}
+}
+
+func TestRenderLedgerTxn(t *testing.T) {
+	m := ledgerMappings{LedgerMappingExpense: {"WECHAT": "Expenses:Daily"}}
+	c := exportCashflow{
+		Direction:     DirectionOut,
+		TransTime:     util.ToETime(time.Date(2024, 6, 1, 12, 30, 0, 0, time.Local)),
+		TransId:       "123",
+		Counterparty:  `Shop "A"`,
+		PaymentMethod: "零钱",
+		Amount:        "12.5",
+		Currency:      "CNY",
+		Category:      "WECHAT",
+		Remark:        "coffee",
+	}
+	txn := buildLedgerTxn(c, m, map[string]string{})
+	exp := `2024-06-01 * "Shop \"A\"" "coffee"
+  trans_id: "123"
+  category: "WECHAT"
+  payment_method: "零钱"
+  Expenses:Daily  12.50 CNY
+  Assets:零钱  -12.50 CNY
+
+`
+	if v := renderBeancountTxn(txn); v != exp {
+		t.Fatalf("beancount: %v", v)
+	}
+
+	c.Direction = DirectionIn
+	c.TransferNo = "TRF_1"
+	c.Remark = ""
+	txn = buildLedgerTxn(c, m, map[string]string{})
+	exp = `2024/06/01 * Shop "A"
+    ; trans_id: 123
+    ; category: WECHAT
+    ; payment_method: 零钱
+    ; transfer_no: TRF_1
+    Assets:零钱  12.50 CNY
+    Assets:Transfer  -12.50 CNY
+
+`
+	if v := renderLedgerTxn(txn); v != exp {
+		t.Fatalf("ledger: %v", v)
+	}
+}
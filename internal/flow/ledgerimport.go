@@ -0,0 +1,425 @@
+package flow
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/curtisnewbie/miso/encoding"
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	maxCategoryLen = 32
+)
+
+var (
+	beancountTxnRegex = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})\s+(\*|!|txn)(\s+.*)?$`)
+	beancountStrRegex = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"`)
+	ledgerTxnRegex    = regexp.MustCompile(`^(\d{4}[/-]\d{1,2}[/-]\d{1,2})(?:=\S+)?(?:\s+([*!]))?(?:\s+\(([^)]*)\))?\s*(.*)$`)
+	journalMetaRegex  = regexp.MustCompile(`^([a-zA-Z][\w-]*):\s*(.*)$`)
+	postingSplitRegex = regexp.MustCompile(`\t|\s{2,}`)
+	amountRegex       = regexp.MustCompile(`^(-?[\d,]*\.?\d+)\s*([^\d\s-]*)$|^([^\d\s-]+)\s*(-?[\d,]*\.?\d+)$`)
+
+	commoditySymbols = map[string]string{"$": "USD", "¥": "CNY", "€": "EUR", "£": "GBP"}
+)
+
+type journalPosting struct {
+	Account  string
+	Amount   *money.Amt // nil if the amount is elided
+	Currency string
+}
+
+type journalTxn struct {
+	Date     time.Time
+	Payee    string
+	Narr     string
+	Meta     map[string]string
+	Postings []journalPosting
+}
+
+// Parse transactions in Beancount or ledger journal, directives other than transactions are ignored.
+func ParseJournal(rail miso.Rail, format string, r io.Reader) ([]journalTxn, error) {
+	beancount := format == LedgerFormatBeancount
+	txns := []journalTxn{}
+	var curr *journalTxn
+	closeTxn := func() {
+		if curr != nil {
+			txns = append(txns, *curr)
+			curr = nil
+		}
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	line := 0
+	for sc.Scan() {
+		line++
+		raw := strings.TrimRight(sc.Text(), " \t\r")
+		if line == 1 {
+			raw = strings.TrimPrefix(raw, "\xEF\xBB\xBF")
+		}
+		if raw == "" {
+			closeTxn()
+			continue
+		}
+
+		// directive or transaction header
+		if raw[0] != ' ' && raw[0] != '\t' {
+			closeTxn()
+			var t journalTxn
+			var ok bool
+			var err error
+			if beancount {
+				t, ok, err = parseBeancountHeader(raw)
+			} else {
+				t, ok, err = parseLedgerHeader(raw)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid transaction at line %d, %w", line, err)
+			}
+			if ok {
+				curr = &t
+			}
+			continue
+		}
+		if curr == nil {
+			continue
+		}
+
+		s := strings.TrimSpace(raw)
+		if strings.HasPrefix(s, ";") || strings.HasPrefix(s, "#") {
+			// ledger metadata is written in comments
+			if !beancount {
+				if m := journalMetaRegex.FindStringSubmatch(strings.TrimSpace(strings.TrimLeft(s, ";#"))); m != nil {
+					curr.Meta[m[1]] = strings.TrimSpace(m[2])
+				}
+			}
+			continue
+		}
+		if beancount {
+			if m := journalMetaRegex.FindStringSubmatch(s); m != nil && unicode.IsLower(rune(s[0])) {
+				curr.Meta[m[1]] = unquoteBeancount(strings.TrimSpace(m[2]))
+				continue
+			}
+		}
+		p, err := parsePosting(s, beancount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid posting at line %d, %w", line, err)
+		}
+		curr.Postings = append(curr.Postings, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read journal, %w", err)
+	}
+	closeTxn()
+	rail.Debugf("Parsed %d transactions from %v journal", len(txns), format)
+	return txns, nil
+}
+
+func parseBeancountHeader(s string) (journalTxn, bool, error) {
+	m := beancountTxnRegex.FindStringSubmatch(s)
+	if m == nil {
+		return journalTxn{}, false, nil
+	}
+	d, err := time.ParseInLocation("2006-01-02", m[1], time.Local)
+	if err != nil {
+		return journalTxn{}, false, err
+	}
+	t := journalTxn{Date: d, Meta: map[string]string{}}
+	strs := beancountStrRegex.FindAllStringSubmatch(m[3], -1)
+	switch len(strs) {
+	case 0:
+	case 1:
+		t.Narr = unescapeBeancount(strs[0][1])
+	default:
+		t.Payee = unescapeBeancount(strs[0][1])
+		t.Narr = unescapeBeancount(strs[1][1])
+	}
+	return t, true, nil
+}
+
+func parseLedgerHeader(s string) (journalTxn, bool, error) {
+	m := ledgerTxnRegex.FindStringSubmatch(s)
+	if m == nil {
+		return journalTxn{}, false, nil
+	}
+	d, err := time.ParseInLocation("2006/1/2", strings.ReplaceAll(m[1], "-", "/"), time.Local)
+	if err != nil {
+		return journalTxn{}, false, err
+	}
+	t := journalTxn{Date: d, Meta: map[string]string{}}
+	payee := m[4]
+	if i := strings.Index(payee, ";"); i > -1 {
+		t.Narr = strings.TrimSpace(payee[i+1:])
+		payee = payee[:i]
+	}
+	t.Payee = strings.TrimSpace(payee)
+	if m[3] != "" {
+		t.Meta["code"] = m[3]
+	}
+	return t, true, nil
+}
+
+func unescapeBeancount(s string) string {
+	s = strings.ReplaceAll(s, `\"`, `"`)
+	return strings.ReplaceAll(s, `\\`, `\`)
+}
+
+func unquoteBeancount(s string) string {
+	if m := beancountStrRegex.FindStringSubmatch(s); m != nil && strings.HasPrefix(s, `"`) {
+		return unescapeBeancount(m[1])
+	}
+	return s
+}
+
+func parsePosting(s string, beancount bool) (journalPosting, error) {
+	// posting flag
+	if len(s) > 1 && (s[0] == '*' || s[0] == '!') && (s[1] == ' ' || s[1] == '\t') {
+		s = strings.TrimSpace(s[1:])
+	}
+	// inline comment
+	if i := strings.Index(s, ";"); i > -1 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if s == "" {
+		return journalPosting{}, fmt.Errorf("account of the posting is missing")
+	}
+
+	var account, amt string
+	if beancount {
+		// accounts in beancount never contain spaces
+		f := strings.Fields(s)
+		account = f[0]
+		amt = strings.Join(f[1:], " ")
+	} else {
+		f := postingSplitRegex.Split(s, 2)
+		account = strings.TrimSpace(f[0])
+		if len(f) > 1 {
+			amt = strings.TrimSpace(f[1])
+		}
+	}
+	// cost and price annotations
+	if i := strings.IndexAny(amt, "{@"); i > -1 {
+		amt = strings.TrimSpace(amt[:i])
+	}
+
+	p := journalPosting{Account: strings.Trim(account, "()[]")}
+	if amt == "" {
+		return p, nil
+	}
+	// e.g., -$12.50
+	neg := len(amt) > 1 && amt[0] == '-' && !unicode.IsDigit(rune(amt[1]))
+	if neg {
+		amt = strings.TrimSpace(amt[1:])
+	}
+	m := amountRegex.FindStringSubmatch(amt)
+	if m == nil {
+		return p, fmt.Errorf("invalid amount '%v'", amt)
+	}
+	num, ccy := m[1], m[2]
+	if num == "" {
+		num, ccy = m[4], m[3]
+	}
+	if v, ok := commoditySymbols[ccy]; ok {
+		ccy = v
+	}
+	p.Amount = money.NewAmt(strings.ReplaceAll(num, ",", ""))
+	if neg {
+		p.Amount = money.Zero().Sub(p.Amount)
+	}
+	p.Currency = strings.ToUpper(ccy)
+	return p, nil
+}
+
+// Convert postings on the asset account into cashflows, the category is derived from the balancing account.
+//
+// Transactions exported by acct keep their category and transaction id in metadata, so they can be imported back.
+func journalCashflows(txns []journalTxn, assetAccount string, defCurrency string, m ledgerMappings) (map[string][]NewCashflow, int) {
+	reverse := map[string]map[string]string{}
+	for typ, sources := range m {
+		reverse[typ] = map[string]string{}
+		for src, acc := range sources {
+			reverse[typ][acc] = src
+		}
+	}
+	paymentMethod := reverse[LedgerMappingAsset][assetAccount]
+	if paymentMethod == "" {
+		comps := strings.Split(assetAccount, ":")
+		paymentMethod = comps[len(comps)-1]
+	}
+
+	seen := map[string]int{}
+	res := map[string][]NewCashflow{}
+	skipped := 0
+	for _, t := range txns {
+		var posting *journalPosting
+		var balancing string
+		sum := money.Zero()
+		for i, p := range t.Postings {
+			if p.Amount != nil {
+				sum = sum.Add(p.Amount)
+			}
+			if p.Account == assetAccount && posting == nil {
+				posting = &t.Postings[i]
+			} else if balancing == "" {
+				balancing = p.Account
+			}
+		}
+		if posting == nil {
+			continue
+		}
+		amt, ccy := posting.Amount, posting.Currency
+		if amt == nil {
+			// elided amount balances the transaction
+			amt = money.Zero().Sub(sum)
+			for _, p := range t.Postings {
+				if p.Currency != "" {
+					ccy = p.Currency
+					break
+				}
+			}
+		}
+		if ccy == "" {
+			ccy = defCurrency
+		}
+		if amt.Cmp(money.Zero()) == 0 || ccy == "" {
+			skipped++
+			continue
+		}
+
+		direction := DirectionIn
+		mappingType := LedgerMappingIncome
+		if amt.Cmp(money.Zero()) < 0 {
+			direction = DirectionOut
+			mappingType = LedgerMappingExpense
+		}
+		category := t.Meta["category"]
+		if category == "" {
+			category = reverse[mappingType][balancing]
+		}
+		if category == "" {
+			category = journalCategory(balancing)
+		}
+
+		transId := t.Meta["trans_id"]
+		if transId == "" {
+			k := fmt.Sprintf("%v|%v|%v|%v|%v|%v", t.Date.Format("20060102"), t.Payee, t.Narr, assetAccount, amt.String(), ccy)
+			seen[k]++
+			h := sha1.Sum([]byte(fmt.Sprintf("%v|%d", k, seen[k])))
+			transId = "LDG_" + hex.EncodeToString(h[:])[:24]
+		}
+
+		pm := paymentMethod
+		if v := t.Meta["payment_method"]; v != "" {
+			pm = v
+		}
+		extra, _ := encoding.SWriteJson(map[string]string{"ledger_account": balancing})
+		res[category] = append(res[category], NewCashflow{
+			Direction:     direction,
+			TransTime:     util.ToETime(t.Date),
+			TransId:       transId,
+			PaymentMethod: pm,
+			Counterparty:  t.Payee,
+			Amount:        amt.Abs().String(),
+			Currency:      ccy,
+			Extra:         extra,
+			Remark:        t.Narr,
+		})
+	}
+	return res, skipped
+}
+
+// Derive category code from account name, e.g., 'Expenses:Food:Dining' is 'FOOD_DINING'.
+func journalCategory(account string) string {
+	comps := strings.Split(account, ":")
+	if len(comps) > 1 {
+		comps = comps[1:]
+	}
+	rs := []rune(strings.ToUpper(strings.Join(comps, "_")))
+	for i, r := range rs {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			rs[i] = '_'
+		}
+	}
+	if len(rs) > maxCategoryLen {
+		rs = rs[:maxCategoryLen]
+	}
+	if len(rs) < 1 {
+		return "LEDGER"
+	}
+	return string(rs)
+}
+
+type ApiImportJournalRes struct {
+	Parsed   int `desc:"Number of transactions on the asset account"`
+	Imported int `desc:"Number of cashflows imported, existing ones are skipped"`
+}
+
+// Import Beancount or ledger journal uploaded in request body.
+//
+// Query params: 'format' is either BEANCOUNT or LEDGER, 'account' is the asset account whose postings are imported,
+// 'currency' is the default currency for amounts without commodity.
+func ImportUploadedJournal(inb *miso.Inbound, db *gorm.DB) (ApiImportJournalRes, error) {
+	rail := inb.Rail()
+	user := common.GetUser(rail)
+	format := strings.ToUpper(inb.Query("format"))
+	account := strings.TrimSpace(inb.Query("account"))
+	if format != LedgerFormatBeancount && format != LedgerFormatLedger {
+		return ApiImportJournalRes{}, miso.NewErrf("Invalid format '%v', should be either %v or %v", format,
+			LedgerFormatBeancount, LedgerFormatLedger)
+	}
+	if account == "" {
+		return ApiImportJournalRes{}, miso.NewErrf("Asset account is required")
+	}
+	_, r := inb.Unwrap()
+	defer r.Body.Close()
+
+	txns, err := ParseJournal(rail, format, r.Body)
+	if err != nil {
+		return ApiImportJournalRes{}, miso.NewErrf("Failed to parse journal").WithInternalMsg("%v", err)
+	}
+	mappings, err := loadLedgerMappings(db, user.UserNo)
+	if err != nil {
+		return ApiImportJournalRes{}, err
+	}
+	flows, skipped := journalCashflows(txns, account, strings.ToUpper(inb.Query("currency")), mappings)
+	if skipped > 0 {
+		rail.Warnf("Skipped %d transactions without amount or currency", skipped)
+	}
+
+	res := ApiImportJournalRes{}
+	categories := make([]string, 0, len(flows))
+	for c := range flows {
+		categories = append(categories, c)
+	}
+	sort.Strings(categories)
+
+	changes := []CashflowChange{}
+	for _, c := range categories {
+		res.Parsed += len(flows[c])
+		saved, err := SaveCashflows(rail, db, SaveCashflowParams{Cashflows: flows[c], Category: c, User: user})
+		if err != nil {
+			return res, err
+		}
+		res.Imported += len(saved)
+		changes = append(changes, util.MapTo(saved, func(nc NewCashflow) CashflowChange { return CashflowChange{TransTime: nc.TransTime} })...)
+	}
+	rail.Infof("Imported %d cashflows from %v journal (%v) for %v", res.Imported, format, account, user.Username)
+
+	if err := OnCashflowChanged(rail, changes, user.UserNo); err != nil {
+		rail.Errorf("Failed to update cashflow statistics for journal import, userNo: %v, %v", user.UserNo, err)
+	}
+	return res, nil
+}
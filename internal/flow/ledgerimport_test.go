@@ -0,0 +1,115 @@
+package flow
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/curtisnewbie/miso/miso"
+)
+
+func TestParseBeancountJournal(t *testing.T) {
+	journal := `option "title" "test"
+2024-01-01 open Assets:Alipay
+
+2024-06-01 * "Shop \"A\"" "coffee" #daily
+  trans_id: "123"
+  category: "WECHAT"
+  Expenses:Daily  12.50 CNY
+  Assets:Alipay  -12.50 CNY
+
+2024-06-02 * "salary"
+  Assets:Alipay  1,000.00 CNY
+  Income:Salary
+
+2024-06-03 txn "Bank" "withdraw"
+  Assets:Bank  -20 CNY
+  Assets:Cash
+`
+	txns, err := ParseJournal(miso.EmptyRail(), LedgerFormatBeancount, strings.NewReader(journal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 3 {
+		t.Fatalf("txns: %+v", txns)
+	}
+	if txns[0].Payee != `Shop "A"` || txns[0].Narr != "coffee" || txns[0].Meta["trans_id"] != "123" || len(txns[0].Postings) != 2 {
+		t.Fatalf("txn: %+v", txns[0])
+	}
+	if txns[1].Payee != "" || txns[1].Narr != "salary" || txns[1].Postings[1].Amount != nil {
+		t.Fatalf("txn: %+v", txns[1])
+	}
+
+	m := ledgerMappings{LedgerMappingIncome: {"SALARY": "Income:Salary"}}
+	flows, skipped := journalCashflows(txns, "Assets:Alipay", "", m)
+	if skipped != 0 || len(flows) != 2 {
+		t.Fatalf("flows: %+v, skipped: %v", flows, skipped)
+	}
+	f := flows["WECHAT"][0]
+	if f.TransId != "123" || f.Direction != DirectionOut || f.Amount != "12.50" || f.Currency != "CNY" || f.PaymentMethod != "Alipay" {
+		t.Fatalf("flow: %+v", f)
+	}
+	f = flows["SALARY"][0]
+	if !strings.HasPrefix(f.TransId, "LDG_") || f.Direction != DirectionIn || f.Amount != "1000.00" {
+		t.Fatalf("flow: %+v", f)
+	}
+}
+
+func TestParseLedgerJournal(t *testing.T) {
+	journal := `2024/06/01 * (42) Coffee Shop  ; morning coffee
+    ; trans_id: 123
+    Expenses:Food and Drink  $4.50
+    Assets:Checking
+
+2024-06-02 Refund
+    Assets:Checking  $1.00
+    Expenses:Food and Drink
+`
+	txns, err := ParseJournal(miso.EmptyRail(), LedgerFormatLedger, strings.NewReader(journal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 2 {
+		t.Fatalf("txns: %+v", txns)
+	}
+	if txns[0].Payee != "Coffee Shop" || txns[0].Narr != "morning coffee" || txns[0].Meta["code"] != "42" ||
+		txns[0].Postings[0].Account != "Expenses:Food and Drink" || txns[0].Postings[0].Currency != "USD" {
+		t.Fatalf("txn: %+v", txns[0])
+	}
+
+	flows, _ := journalCashflows(txns, "Assets:Checking", "", ledgerMappings{})
+	l := flows["FOOD_AND_DRINK"]
+	if len(l) != 2 || l[0].Direction != DirectionOut || l[0].Amount != "4.50" || l[1].Direction != DirectionIn || l[1].Amount != "1.00" {
+		t.Fatalf("flows: %+v", flows)
+	}
+}
+
+func TestParsePosting(t *testing.T) {
+	p, err := parsePosting("Assets:Checking  -$1,200.50 @ 7.2 CNY", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Amount.String() != "-1200.50" || p.Currency != "USD" {
+		t.Fatalf("posting: %+v", p)
+	}
+
+	for _, s := range []string{"! ; note", "* ;"} {
+		if _, err := parsePosting(s, true); err == nil {
+			t.Fatalf("posting without account should be rejected: %q", s)
+		}
+		if _, err := parsePosting(s, false); err == nil {
+			t.Fatalf("posting without account should be rejected: %q", s)
+		}
+	}
+}
+
+func TestJournalCategory(t *testing.T) {
+	if v := journalCategory("Expenses:Food:Dining"); v != "FOOD_DINING" {
+		t.Fatal(v)
+	}
+	if v := journalCategory("Expenses:餐饮"); v != "餐饮" {
+		t.Fatal(v)
+	}
+	if v := journalCategory(""); v != "LEDGER" {
+		t.Fatal(v)
+	}
+}
@@ -0,0 +1,543 @@
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	RepaymentEqualInstallment = "EQUAL_INSTALLMENT" // 等额本息
+	RepaymentEqualPrincipal   = "EQUAL_PRINCIPAL"   // 等额本金
+
+	maxLoanTermMonths = 600
+	loanScale         = 2
+	loanRateScale     = 16
+
+	// repayment cashflows within these days of the due date are matched against the period
+	loanRepaymentMatchDays = 7
+)
+
+type ApiSaveLoanReq struct {
+	LoanNo          string     `desc:"Loan No. A new loan is created if it's empty"`
+	Name            string     `desc:"Loan Name" valid:"notEmpty,maxLen:64"`
+	Counterparty    string     `desc:"Lender, only repayments to the lender are matched if it's not empty"`
+	AccountNo       string     `desc:"Account No, only repayments from the account are matched if it's not empty"`
+	Principal       string     `desc:"Principal" valid:"notEmpty"`
+	AnnualRate      string     `desc:"Annual interest rate in percentage, e.g., 4.9"`
+	TermMonths      int        `desc:"Term in months"`
+	RepaymentMethod string     `desc:"Repayment Method: EQUAL_INSTALLMENT, EQUAL_PRINCIPAL" valid:"member:EQUAL_INSTALLMENT|EQUAL_PRINCIPAL"`
+	Currency        string     `desc:"Currency" valid:"notEmpty"`
+	FirstDueTime    util.ETime `desc:"Due time of the first repayment"`
+}
+
+type ApiLoanNoReq struct {
+	LoanNo string `desc:"Loan No" valid:"notEmpty"`
+}
+
+type Loan struct {
+	LoanNo          string
+	UserNo          string
+	Name            string
+	Counterparty    string
+	AccountNo       string
+	Principal       string
+	AnnualRate      string
+	TermMonths      int
+	RepaymentMethod string
+	Currency        string
+	FirstDueTime    util.ETime
+}
+
+func (l Loan) Schedule() []loanPeriod {
+	return buildLoanSchedule(money.NewAmt(l.Principal), money.NewAmt(l.AnnualRate), l.TermMonths, l.RepaymentMethod,
+		l.FirstDueTime.ToTime())
+}
+
+func SaveLoan(rail miso.Rail, db *gorm.DB, req ApiSaveLoanReq, user common.User) (string, error) {
+	if req.AnnualRate == "" {
+		req.AnnualRate = "0"
+	}
+	if money.NewAmt(req.Principal).Cmp(money.Zero()) <= 0 {
+		return "", miso.NewErrf("Invalid principal '%v'", req.Principal)
+	}
+	if money.NewAmt(req.AnnualRate).Cmp(money.Zero()) < 0 {
+		return "", miso.NewErrf("Invalid annual interest rate '%v'", req.AnnualRate)
+	}
+	if req.TermMonths < 1 || req.TermMonths > maxLoanTermMonths {
+		return "", miso.NewErrf("Invalid loan term")
+	}
+	if req.AccountNo != "" {
+		if _, err := findAccount(db, req.AccountNo, user.UserNo); err != nil {
+			return "", err
+		}
+	}
+
+	if req.LoanNo != "" {
+		// MySQL reports 0 affected rows if nothing is changed, existence is checked beforehand
+		if _, err := findLoan(db, req.LoanNo, user.UserNo); err != nil {
+			return "", err
+		}
+		t := db.Exec(`UPDATE loan SET name = ?, counterparty = ?, account_no = ?, principal = ?, annual_rate = ?, term_months = ?,
+			repayment_method = ?, currency = ?, first_due_time = ?, updated_by = ?
+			WHERE loan_no = ? AND user_no = ? AND deleted = 0`,
+			req.Name, req.Counterparty, req.AccountNo, req.Principal, req.AnnualRate, req.TermMonths,
+			req.RepaymentMethod, req.Currency, req.FirstDueTime, user.Username, req.LoanNo, user.UserNo)
+		if t.Error != nil {
+			return "", fmt.Errorf("failed to update loan, %w", t.Error)
+		}
+
+		// the schedule may be shortened
+		err := db.Exec(`DELETE FROM loan_repayment WHERE loan_no = ? AND period > ?`, req.LoanNo, req.TermMonths).Error
+		if err != nil {
+			return "", fmt.Errorf("failed to delete loan_repayment, %w", err)
+		}
+	} else {
+		req.LoanNo = util.GenIdP("LOAN_")
+		err := db.Exec(`INSERT INTO loan (loan_no, user_no, name, counterparty, account_no, principal, annual_rate, term_months,
+			repayment_method, currency, first_due_time, created_by)
+			VALUES (?,?,?,?,?,?,?,?,?,?,?,?)`,
+			req.LoanNo, user.UserNo, req.Name, req.Counterparty, req.AccountNo, req.Principal, req.AnnualRate, req.TermMonths,
+			req.RepaymentMethod, req.Currency, req.FirstDueTime, user.Username).Error
+		if err != nil {
+			return "", fmt.Errorf("failed to save loan, %w", err)
+		}
+	}
+	rail.Infof("Loan %v saved by %v", req.LoanNo, user.Username)
+	return req.LoanNo, nil
+}
+
+func DeleteLoan(rail miso.Rail, db *gorm.DB, req ApiLoanNoReq, user common.User) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		t := tx.Exec(`UPDATE loan SET deleted = 1, updated_by = ? WHERE loan_no = ? AND user_no = ? AND deleted = 0`,
+			user.Username, req.LoanNo, user.UserNo)
+		if t.Error != nil {
+			return fmt.Errorf("failed to delete loan, %w", t.Error)
+		}
+		if t.RowsAffected < 1 {
+			return miso.NewErrf("Loan not found")
+		}
+		if err := tx.Exec(`DELETE FROM loan_repayment WHERE loan_no = ?`, req.LoanNo).Error; err != nil {
+			return fmt.Errorf("failed to delete loan_repayment, %w", err)
+		}
+		return nil
+	})
+}
+
+func findLoan(db *gorm.DB, loanNo string, userNo string) (Loan, error) {
+	var l Loan
+	t := db.Raw(`SELECT loan_no, user_no, name, counterparty, account_no, principal, annual_rate, term_months, repayment_method,
+		currency, first_due_time FROM loan WHERE loan_no = ? AND user_no = ? AND deleted = 0`, loanNo, userNo).
+		Scan(&l)
+	if t.Error != nil {
+		return l, fmt.Errorf("failed to query loan, %w", t.Error)
+	}
+	if t.RowsAffected < 1 {
+		return l, miso.NewErrf("Loan not found")
+	}
+	return l, nil
+}
+
+type loanPeriod struct {
+	Period    int
+	DueTime   time.Time
+	Payment   *money.Amt
+	Principal *money.Amt
+	Interest  *money.Amt
+	Remaining *money.Amt // outstanding principal after the repayment
+}
+
+// Build amortization schedule of the loan, the last period absorbs the rounding difference.
+func buildLoanSchedule(principal *money.Amt, annualRate *money.Amt, term int, method string, firstDue time.Time) []loanPeriod {
+	r := annualRate.Div(money.NewAmt("1200"), loanRateScale)
+	zero := r.Cmp(money.Zero()) == 0
+
+	var payment *money.Amt // EQUAL_INSTALLMENT
+	var principalPart *money.Amt
+	if method == RepaymentEqualPrincipal || zero {
+		principalPart = principal.Div(money.NewAmt(fmt.Sprintf("%d", term)), loanScale)
+	} else {
+		// P * r * (1+r)^n / ((1+r)^n - 1)
+		f := money.NewAmt("1")
+		g := money.NewAmt("1").Add(r)
+		for i := 0; i < term; i++ {
+			f = f.Mul(g).Round(loanRateScale)
+		}
+		payment = principal.Mul(r).Mul(f).Div(f.Sub(money.NewAmt("1")), loanScale)
+	}
+
+	schedule := make([]loanPeriod, 0, term)
+	remaining := principal
+	for i := 1; i <= term; i++ {
+		interest := remaining.Mul(r).Round(loanScale)
+		p := principalPart
+		if payment != nil {
+			p = payment.Sub(interest)
+		}
+		if i == term || p.Cmp(remaining) > 0 {
+			p = remaining
+		}
+		remaining = remaining.Sub(p)
+		schedule = append(schedule, loanPeriod{
+			Period:    i,
+			DueTime:   firstDue.AddDate(0, i-1, 0),
+			Payment:   p.Add(interest),
+			Principal: p,
+			Interest:  interest,
+			Remaining: remaining,
+		})
+	}
+	return schedule
+}
+
+type loanRepayment struct {
+	Period    int
+	Category  string
+	TransId   string
+	TransTime util.ETime
+	Amount    string
+}
+
+func listLoanRepayments(db *gorm.DB, loanNo string) (map[int]loanRepayment, error) {
+	var l []loanRepayment
+	// repayments whose cashflow is deleted are not counted
+	err := db.Raw(`SELECT r.period, r.category, r.trans_id, c.trans_time, c.amount FROM loan_repayment r
+		JOIN cashflow c ON c.user_no = r.user_no AND c.category = r.category AND c.trans_id = r.trans_id AND c.deleted = 0
+		WHERE r.loan_no = ?`, loanNo).
+		Scan(&l).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list loan_repayment, %w", err)
+	}
+	m := make(map[int]loanRepayment, len(l))
+	for _, r := range l {
+		m[r.Period] = r
+	}
+	return m, nil
+}
+
+type loanProgress struct {
+	PaidPeriods          int
+	PrincipalPaid        *money.Amt
+	InterestPaid         *money.Amt
+	OutstandingPrincipal *money.Amt
+}
+
+func calcLoanProgress(principal *money.Amt, schedule []loanPeriod, repayments map[int]loanRepayment) loanProgress {
+	p := loanProgress{PrincipalPaid: money.Zero(), InterestPaid: money.Zero()}
+	for _, s := range schedule {
+		if _, ok := repayments[s.Period]; !ok {
+			continue
+		}
+		p.PaidPeriods++
+		p.PrincipalPaid = p.PrincipalPaid.Add(s.Principal)
+		p.InterestPaid = p.InterestPaid.Add(s.Interest)
+	}
+	p.OutstandingPrincipal = principal.Sub(p.PrincipalPaid)
+	return p
+}
+
+type ApiListLoanReq struct {
+	Paging miso.Paging `desc:"Paging"`
+}
+
+type ApiListLoanRes struct {
+	LoanNo               string     `desc:"Loan No"`
+	Name                 string     `desc:"Loan Name"`
+	Counterparty         string     `desc:"Lender"`
+	AccountNo            string     `desc:"Account No"`
+	Principal            string     `desc:"Principal"`
+	AnnualRate           string     `desc:"Annual interest rate in percentage"`
+	TermMonths           int        `desc:"Term in months"`
+	RepaymentMethod      string     `desc:"Repayment Method"`
+	Currency             string     `desc:"Currency"`
+	FirstDueTime         util.ETime `desc:"Due time of the first repayment"`
+	PaidPeriods          int        `desc:"Number of periods repaid" gorm:"-"`
+	PrincipalPaid        string     `desc:"Principal repaid to date" gorm:"-"`
+	InterestPaid         string     `desc:"Interest paid to date" gorm:"-"`
+	OutstandingPrincipal string     `desc:"Outstanding principal" gorm:"-"`
+	CreatedAt            util.ETime `desc:"Create Time"`
+}
+
+func ListLoans(rail miso.Rail, db *gorm.DB, req ApiListLoanReq, user common.User) (miso.PageRes[ApiListLoanRes], error) {
+	res, err := miso.NewPageQuery[ApiListLoanRes]().
+		WithPage(req.Paging).
+		WithBaseQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Table(`loan`).
+				Where("user_no = ?", user.UserNo).
+				Where("deleted = 0")
+		}).
+		WithSelectQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Select("loan_no", "name", "counterparty", "account_no", "principal", "annual_rate", "term_months",
+				"repayment_method", "currency", "first_due_time", "created_at").
+				Order("id desc")
+		}).
+		Exec(rail, db)
+	if err != nil {
+		return res, err
+	}
+
+	for i, l := range res.Payload {
+		repayments, err := listLoanRepayments(db, l.LoanNo)
+		if err != nil {
+			return res, err
+		}
+		principal := money.NewAmt(l.Principal)
+		schedule := buildLoanSchedule(principal, money.NewAmt(l.AnnualRate), l.TermMonths, l.RepaymentMethod, l.FirstDueTime.ToTime())
+		p := calcLoanProgress(principal, schedule, repayments)
+		l.PaidPeriods = p.PaidPeriods
+		l.PrincipalPaid = money.UnitFmt(p.PrincipalPaid.String(), l.Currency)
+		l.InterestPaid = money.UnitFmt(p.InterestPaid.String(), l.Currency)
+		l.OutstandingPrincipal = money.UnitFmt(p.OutstandingPrincipal.String(), l.Currency)
+		l.Principal = money.UnitFmt(l.Principal, l.Currency)
+		res.Payload[i] = l
+	}
+	return res, nil
+}
+
+type ApiLoanPeriod struct {
+	Period    int            `desc:"Period, starting from 1"`
+	DueTime   util.ETime     `desc:"Due time"`
+	Payment   string         `desc:"Scheduled repayment"`
+	Principal string         `desc:"Principal part of the repayment"`
+	Interest  string         `desc:"Interest part of the repayment"`
+	Remaining string         `desc:"Outstanding principal after the repayment"`
+	Repaid    bool           `desc:"Whether a repayment cashflow is matched"`
+	Repayment ApiCashflowRef `desc:"The matched repayment cashflow"`
+	PaidTime  *util.ETime    `desc:"Transaction time of the matched repayment cashflow"`
+	Overdue   bool           `desc:"Whether the due time passed and no repayment is matched"`
+}
+
+type ApiLoanScheduleRes struct {
+	LoanNo               string          `desc:"Loan No"`
+	Currency             string          `desc:"Currency"`
+	PaidPeriods          int             `desc:"Number of periods repaid"`
+	PrincipalPaid        string          `desc:"Principal repaid to date"`
+	InterestPaid         string          `desc:"Interest paid to date"`
+	OutstandingPrincipal string          `desc:"Outstanding principal"`
+	TotalInterest        string          `desc:"Total interest of the loan"`
+	Periods              []ApiLoanPeriod `desc:"Amortization schedule"`
+}
+
+// Amortization schedule of the loan with the matched repayments.
+func LoanSchedule(rail miso.Rail, db *gorm.DB, req ApiLoanNoReq, user common.User) (ApiLoanScheduleRes, error) {
+	l, err := findLoan(db, req.LoanNo, user.UserNo)
+	if err != nil {
+		return ApiLoanScheduleRes{}, err
+	}
+	repayments, err := listLoanRepayments(db, l.LoanNo)
+	if err != nil {
+		return ApiLoanScheduleRes{}, err
+	}
+	schedule := l.Schedule()
+	p := calcLoanProgress(money.NewAmt(l.Principal), schedule, repayments)
+
+	now := time.Now()
+	totalInterest := money.Zero()
+	periods := make([]ApiLoanPeriod, 0, len(schedule))
+	for _, s := range schedule {
+		totalInterest = totalInterest.Add(s.Interest)
+		ap := ApiLoanPeriod{
+			Period:    s.Period,
+			DueTime:   util.ToETime(s.DueTime),
+			Payment:   money.UnitFmt(s.Payment.String(), l.Currency),
+			Principal: money.UnitFmt(s.Principal.String(), l.Currency),
+			Interest:  money.UnitFmt(s.Interest.String(), l.Currency),
+			Remaining: money.UnitFmt(s.Remaining.String(), l.Currency),
+		}
+		if r, ok := repayments[s.Period]; ok {
+			ap.Repaid = true
+			ap.Repayment = ApiCashflowRef{Category: r.Category, TransId: r.TransId}
+			t := r.TransTime
+			ap.PaidTime = &t
+		} else {
+			ap.Overdue = now.After(s.DueTime.AddDate(0, 0, 1))
+		}
+		periods = append(periods, ap)
+	}
+	return ApiLoanScheduleRes{
+		LoanNo:               l.LoanNo,
+		Currency:             l.Currency,
+		PaidPeriods:          p.PaidPeriods,
+		PrincipalPaid:        money.UnitFmt(p.PrincipalPaid.String(), l.Currency),
+		InterestPaid:         money.UnitFmt(p.InterestPaid.String(), l.Currency),
+		OutstandingPrincipal: money.UnitFmt(p.OutstandingPrincipal.String(), l.Currency),
+		TotalInterest:        money.UnitFmt(totalInterest.String(), l.Currency),
+		Periods:              periods,
+	}, nil
+}
+
+type ApiLinkLoanRepaymentReq struct {
+	LoanNo    string         `desc:"Loan No" valid:"notEmpty"`
+	Period    int            `desc:"Period, starting from 1"`
+	Repayment ApiCashflowRef `desc:"The repayment cashflow"`
+}
+
+// Manually link a repayment cashflow to a period of the loan.
+func LinkLoanRepayment(rail miso.Rail, db *gorm.DB, req ApiLinkLoanRepaymentReq, user common.User) error {
+	l, err := findLoan(db, req.LoanNo, user.UserNo)
+	if err != nil {
+		return err
+	}
+	if req.Period < 1 || req.Period > l.TermMonths {
+		return miso.NewErrf("Invalid period")
+	}
+	var cf struct {
+		Direction string
+		Currency  string
+	}
+	t := db.Raw(`SELECT direction, currency FROM cashflow WHERE user_no = ? AND category = ? AND trans_id = ? AND deleted = 0`,
+		user.UserNo, req.Repayment.Category, req.Repayment.TransId).
+		Scan(&cf)
+	if t.Error != nil {
+		return fmt.Errorf("failed to query cashflow, %w", t.Error)
+	}
+	if t.RowsAffected < 1 {
+		return miso.NewErrf("Cashflow not found")
+	}
+	if cf.Direction != DirectionOut {
+		return miso.NewErrf("Repayment must be an OUT cashflow")
+	}
+	if cf.Currency != l.Currency {
+		return miso.NewErrf("Currency of the cashflow %v doesn't match the loan currency %v", cf.Currency, l.Currency)
+	}
+
+	// each cashflow repays one period only, it must be unlinked explicitly before it's linked elsewhere
+	var linked struct {
+		LoanNo string
+		Period int
+	}
+	t = db.Raw(`SELECT loan_no, period FROM loan_repayment WHERE user_no = ? AND category = ? AND trans_id = ?`,
+		user.UserNo, req.Repayment.Category, req.Repayment.TransId).
+		Scan(&linked)
+	if t.Error != nil {
+		return fmt.Errorf("failed to query loan_repayment, %w", t.Error)
+	}
+	if t.RowsAffected > 0 {
+		if linked.LoanNo == l.LoanNo && linked.Period == req.Period {
+			return nil
+		}
+		return miso.NewErrf("Cashflow is already linked to loan %v period %d", linked.LoanNo, linked.Period)
+	}
+
+	// the cashflow previously linked to the period is replaced
+	err = db.Exec(`INSERT INTO loan_repayment (loan_no, user_no, period, category, trans_id, created_by) VALUES (?,?,?,?,?,?)
+		ON DUPLICATE KEY UPDATE category = VALUES(category), trans_id = VALUES(trans_id)`,
+		l.LoanNo, user.UserNo, req.Period, req.Repayment.Category, req.Repayment.TransId, user.Username).Error
+	if err != nil {
+		return fmt.Errorf("failed to save loan_repayment, %w", err)
+	}
+	rail.Infof("Linked repayment %v to loan %v period %d by %v", req.Repayment.TransId, l.LoanNo, req.Period, user.Username)
+	return nil
+}
+
+type ApiUnlinkLoanRepaymentReq struct {
+	LoanNo string `desc:"Loan No" valid:"notEmpty"`
+	Period int    `desc:"Period, starting from 1"`
+}
+
+func UnlinkLoanRepayment(rail miso.Rail, db *gorm.DB, req ApiUnlinkLoanRepaymentReq, user common.User) error {
+	return db.Exec(`DELETE FROM loan_repayment WHERE loan_no = ? AND user_no = ? AND period = ?`,
+		req.LoanNo, user.UserNo, req.Period).Error
+}
+
+type repaymentCandidate struct {
+	Category  string
+	TransId   string
+	TransTime util.ETime
+	Amount    string
+}
+
+// Match repayment cashflows against the unpaid periods of the loan.
+//
+// A cashflow is matched if it's paid within a few days of the due time and the amount equals to the scheduled repayment.
+func MatchLoanRepayments(rail miso.Rail, db *gorm.DB, req ApiLoanNoReq, user common.User) (int, error) {
+	l, err := findLoan(db, req.LoanNo, user.UserNo)
+	if err != nil {
+		return 0, err
+	}
+	repayments, err := listLoanRepayments(db, l.LoanNo)
+	if err != nil {
+		return 0, err
+	}
+	schedule := l.Schedule()
+	unpaid := util.Filter(schedule, func(p loanPeriod) bool { _, ok := repayments[p.Period]; return !ok })
+	if len(unpaid) < 1 {
+		return 0, nil
+	}
+
+	q := db.Table("cashflow c").
+		Select("c.category", "c.trans_id", "c.trans_time", "c.amount").
+		Joins("LEFT JOIN loan_repayment r ON r.user_no = c.user_no AND r.category = c.category AND r.trans_id = c.trans_id").
+		Where("c.user_no = ? AND c.direction = ? AND c.currency = ? AND c.deleted = 0", user.UserNo, DirectionOut, l.Currency).
+		Where("c.trans_time BETWEEN ? AND ?", unpaid[0].DueTime.AddDate(0, 0, -loanRepaymentMatchDays),
+			unpaid[len(unpaid)-1].DueTime.AddDate(0, 0, loanRepaymentMatchDays+1)).
+		Where("r.id IS NULL")
+	if l.Counterparty != "" {
+		q = q.Where("c.counterparty = ?", l.Counterparty)
+	}
+	if l.AccountNo != "" {
+		q = q.Where("c.account_no = ?", l.AccountNo)
+	}
+	var candidates []repaymentCandidate
+	if err := q.Scan(&candidates).Error; err != nil {
+		return 0, fmt.Errorf("failed to query repayment candidates, %w", err)
+	}
+
+	matched := pickLoanRepayments(unpaid, candidates)
+	for period, c := range matched {
+		// candidates are not linked to any loan, only the link of a deleted cashflow of the period may be replaced
+		err := db.Exec(`INSERT INTO loan_repayment (loan_no, user_no, period, category, trans_id, created_by) VALUES (?,?,?,?,?,?)
+			ON DUPLICATE KEY UPDATE category = VALUES(category), trans_id = VALUES(trans_id)`,
+			l.LoanNo, user.UserNo, period, c.Category, c.TransId, user.Username).Error
+		if err != nil {
+			return 0, fmt.Errorf("failed to save loan_repayment, %w", err)
+		}
+	}
+	rail.Infof("Matched %d repayments for loan %v by %v", len(matched), l.LoanNo, user.Username)
+	return len(matched), nil
+}
+
+// Pick repayment for each period, cashflow paid closest to the due time goes first, each cashflow is only matched once.
+func pickLoanRepayments(periods []loanPeriod, candidates []repaymentCandidate) map[int]repaymentCandidate {
+	type pair struct {
+		period int
+		c      repaymentCandidate
+		diff   time.Duration
+	}
+	window := time.Duration(loanRepaymentMatchDays) * 24 * time.Hour
+	pairs := []pair{}
+	for _, p := range periods {
+		for _, c := range candidates {
+			if money.NewAmt(c.Amount).Cmp(p.Payment) != 0 {
+				continue
+			}
+			d := c.TransTime.ToTime().Sub(p.DueTime)
+			if d < 0 {
+				d = -d
+			}
+			if d > window {
+				continue
+			}
+			pairs = append(pairs, pair{period: p.Period, c: c, diff: d})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].diff < pairs[j].diff })
+
+	used := util.NewSet[string]()
+	matched := map[int]repaymentCandidate{}
+	for _, p := range pairs {
+		k := p.c.Category + ":" + p.c.TransId
+		if _, ok := matched[p.period]; ok || used.Has(k) {
+			continue
+		}
+		used.Add(k)
+		matched[p.period] = p.c
+	}
+	return matched
+}
@@ -0,0 +1,56 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/util"
+)
+
+func TestBuildLoanSchedule(t *testing.T) {
+	due := time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local)
+
+	s := buildLoanSchedule(money.NewAmt("100000"), money.NewAmt("4.9"), 12, RepaymentEqualInstallment, due)
+	if len(s) != 12 {
+		t.Fatalf("len: %v", len(s))
+	}
+	if s[0].Payment.String() != "8556.17" || s[0].Interest.String() != "408.33" {
+		t.Fatalf("first period: %+v", s[0])
+	}
+	sum := money.Zero()
+	for _, p := range s {
+		sum = sum.Add(p.Principal)
+	}
+	if sum.Cmp(money.NewAmt("100000")) != 0 || s[11].Remaining.Cmp(money.Zero()) != 0 {
+		t.Fatalf("principal sum: %v, remaining: %v", sum, s[11].Remaining)
+	}
+	if !s[11].DueTime.Equal(time.Date(2024, 12, 15, 0, 0, 0, 0, time.Local)) {
+		t.Fatalf("last due: %v", s[11].DueTime)
+	}
+
+	s = buildLoanSchedule(money.NewAmt("12000"), money.NewAmt("12"), 12, RepaymentEqualPrincipal, due)
+	if s[0].Payment.String() != "1120.00" || s[11].Payment.String() != "1010.00" {
+		t.Fatalf("first: %v, last: %v", s[0].Payment, s[11].Payment)
+	}
+
+	s = buildLoanSchedule(money.NewAmt("1000"), money.Zero(), 3, RepaymentEqualInstallment, due)
+	if s[0].Payment.String() != "333.33" || s[2].Payment.String() != "333.34" {
+		t.Fatalf("first: %v, last: %v", s[0].Payment, s[2].Payment)
+	}
+}
+
+func TestPickLoanRepayments(t *testing.T) {
+	due := time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local)
+	periods := buildLoanSchedule(money.NewAmt("12000"), money.NewAmt("12"), 12, RepaymentEqualPrincipal, due)[:2]
+	candidates := []repaymentCandidate{
+		{Category: "WECHAT", TransId: "1", TransTime: util.ToETime(due.AddDate(0, 0, 3)), Amount: "1120"},
+		{Category: "WECHAT", TransId: "2", TransTime: util.ToETime(due.AddDate(0, 0, -1)), Amount: "1120"},
+		{Category: "WECHAT", TransId: "3", TransTime: util.ToETime(due.AddDate(0, 1, 0)), Amount: "1110"},
+		{Category: "WECHAT", TransId: "4", TransTime: util.ToETime(due.AddDate(0, 1, 10)), Amount: "1110"},
+	}
+	m := pickLoanRepayments(periods, candidates)
+	if len(m) != 2 || m[1].TransId != "2" || m[2].TransId != "3" {
+		t.Fatalf("matched: %+v", m)
+	}
+}
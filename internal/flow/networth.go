@@ -0,0 +1,231 @@
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	PropNetWorthBaseCurrency = "acct.net-worth.base-currency"
+
+	// max number of monthly snapshots recalculated in one request
+	maxNetWorthRecalcMonths = 120
+)
+
+var (
+	// balances of these accounts are liabilities, the rest are assets
+	LiabilityAccountTypes = []string{AccountTypeCreditCard}
+)
+
+func init() {
+	miso.SetDefProp(PropNetWorthBaseCurrency, "CNY")
+}
+
+type netWorthStat struct {
+	AggRange     string
+	BaseCurrency string
+	Assets       *money.Amt
+	Liabilities  *money.Amt
+	NetWorth     *money.Amt
+}
+
+func isLiabilityAccount(accountType string) bool {
+	for _, t := range LiabilityAccountTypes {
+		if t == accountType {
+			return true
+		}
+	}
+	return false
+}
+
+// Calculate monthly net worth snapshot using account balances at the end of the month (or now for current month).
+func calcNetWorth(rail miso.Rail, db *gorm.DB, userNo string, aggRange string, base string) (netWorthStat, error) {
+	st, err := ParseAggRangeTime(AggTypeMonthly, aggRange)
+	if err != nil {
+		return netWorthStat{}, err
+	}
+	at := aggTimeRange(AggTypeMonthly, st.ToTime()).End
+	if now := time.Now(); at.After(now) {
+		at = now
+	}
+
+	var accounts []Account
+	err = db.Raw(`SELECT account_no, user_no, name, account_type, currency, opening_balance, opening_time FROM account
+		WHERE user_no = ? AND deleted = 0`, userNo).
+		Scan(&accounts).Error
+	if err != nil {
+		return netWorthStat{}, fmt.Errorf("failed to list account, %w", err)
+	}
+
+	conv := newFxConverter(db, base)
+	stat := netWorthStat{AggRange: aggRange, BaseCurrency: base, Assets: money.Zero(), Liabilities: money.Zero()}
+	for _, acc := range accounts {
+		if acc.OpeningTime != nil && acc.OpeningTime.After(util.ToETime(at)) {
+			continue
+		}
+		bal, err := calcAccountBalance(db, acc, at)
+		if err != nil {
+			return stat, err
+		}
+		v, err := conv.Convert(rail, bal, acc.Currency, at)
+		if err != nil {
+			return stat, err
+		}
+		if isLiabilityAccount(acc.AccountType) {
+			stat.Liabilities = stat.Liabilities.Sub(v)
+		} else {
+			stat.Assets = stat.Assets.Add(v)
+		}
+	}
+	stat.NetWorth = stat.Assets.Sub(stat.Liabilities)
+	return stat, nil
+}
+
+func updateNetWorthStat(rail miso.Rail, db *gorm.DB, userNo string, aggRange string, base string) error {
+	stat, err := calcNetWorth(rail, db, userNo, aggRange, base)
+	if err != nil {
+		return err
+	}
+	err = db.Exec(`INSERT INTO net_worth_statistics (user_no, agg_range, base_currency, assets, liabilities, net_worth, stale) VALUES (?,?,?,?,?,?,0)
+		ON DUPLICATE KEY UPDATE assets = VALUES(assets), liabilities = VALUES(liabilities), net_worth = VALUES(net_worth), stale = 0`,
+		userNo, aggRange, base, stat.Assets.String(), stat.Liabilities.String(), stat.NetWorth.String()).Error
+	if err != nil {
+		return fmt.Errorf("failed to save net_worth_statistics, %w", err)
+	}
+	rail.Debugf("Updated net worth for %v in %v: %v %v", userNo, aggRange, stat.NetWorth, base)
+	return nil
+}
+
+// Mark net worth snapshots since the aggregation range as stale, all snapshots are marked if fromRange is empty.
+//
+// Stale snapshots are recalculated by the scheduled job.
+func markNetWorthStale(db *gorm.DB, userNo string, fromRange string) error {
+	err := db.Exec(`UPDATE net_worth_statistics SET stale = 1 WHERE user_no = ? AND agg_range >= ?`, userNo, fromRange).Error
+	if err != nil {
+		return fmt.Errorf("failed to mark net_worth_statistics stale, %w", err)
+	}
+	return nil
+}
+
+type ApiRecalcNetWorthReq struct {
+	StartTime    util.ETime `desc:"Start time"`
+	EndTime      util.ETime `desc:"End time"`
+	BaseCurrency string     `desc:"Base Currency, by default it's the configured base currency"`
+}
+
+// Recalculate monthly net worth snapshots within the time range, e.g., to backfill snapshots for previous months.
+func RecalcNetWorth(rail miso.Rail, db *gorm.DB, req ApiRecalcNetWorthReq, user common.User) error {
+	if req.BaseCurrency == "" {
+		req.BaseCurrency = miso.GetPropStr(PropNetWorthBaseCurrency)
+	}
+	ranges := aggRangesBetween(AggTypeMonthly, req.StartTime.ToTime(), req.EndTime.ToTime())
+	if len(ranges) > maxNetWorthRecalcMonths {
+		return miso.NewErrf("Time range too large, at most %d months are allowed", maxNetWorthRecalcMonths)
+	}
+	for _, rng := range ranges {
+		if err := updateNetWorthStat(rail, db, user.UserNo, rng, req.BaseCurrency); err != nil {
+			return err
+		}
+	}
+	rail.Infof("Recalculated %d net worth snapshots in %v for %v", len(ranges), req.BaseCurrency, user.Username)
+	return nil
+}
+
+func ScheduleNetWorthJob() error {
+	return miso.ScheduleDistributedTask(miso.Job{
+		Name:                   "UpdateNetWorthJob",
+		Cron:                   "30 * * * *",
+		Run:                    func(rail miso.Rail) error { return UpdateNetWorthSnapshots(rail, miso.GetMySQL()) },
+		TriggeredOnBoostrapped: true,
+	})
+}
+
+// Update net worth snapshots of current month in the configured base currency, and recalculate the stale ones.
+func UpdateNetWorthSnapshots(rail miso.Rail, db *gorm.DB) error {
+	base := miso.GetPropStr(PropNetWorthBaseCurrency)
+	curr := aggRangeOf(AggTypeMonthly, time.Now())
+
+	var users []string
+	err := db.Raw(`SELECT DISTINCT user_no FROM account WHERE deleted = 0`).Scan(&users).Error
+	if err != nil {
+		return fmt.Errorf("failed to list users with accounts, %w", err)
+	}
+	for _, userNo := range users {
+		if err := updateNetWorthStat(rail, db, userNo, curr, base); err != nil {
+			rail.Errorf("Failed to update net worth for %v, %v", userNo, err)
+		}
+	}
+
+	var stale []struct {
+		UserNo       string
+		AggRange     string
+		BaseCurrency string
+	}
+	err = db.Raw(`SELECT user_no, agg_range, base_currency FROM net_worth_statistics WHERE stale = 1`).Scan(&stale).Error
+	if err != nil {
+		return fmt.Errorf("failed to list stale net_worth_statistics, %w", err)
+	}
+	for _, s := range stale {
+		if err := updateNetWorthStat(rail, db, s.UserNo, s.AggRange, s.BaseCurrency); err != nil {
+			rail.Errorf("Failed to update stale net worth for %v in %v, %v", s.UserNo, s.AggRange, err)
+		}
+	}
+	return nil
+}
+
+type ApiPlotNetWorthReq struct {
+	StartTime    util.ETime `desc:"Start time"`
+	EndTime      util.ETime `desc:"End time"`
+	BaseCurrency string     `desc:"Base Currency, by default it's the configured base currency"`
+}
+
+type ApiPlotNetWorthRes struct {
+	AggRange    string `desc:"Aggregation Range, the corresponding month (YYYYMM)"`
+	Assets      string `desc:"Total balance of asset accounts"`
+	Liabilities string `desc:"Total amount owed on liability accounts"`
+	NetWorth    string `desc:"Assets - Liabilities"`
+}
+
+// Plot monthly net worth snapshots, months without snapshot are zero-filled.
+func PlotNetWorth(rail miso.Rail, db *gorm.DB, req ApiPlotNetWorthReq, user common.User) ([]ApiPlotNetWorthRes, error) {
+	if req.StartTime.After(req.EndTime) {
+		req.StartTime, req.EndTime = req.EndTime, req.StartTime
+	}
+	if req.BaseCurrency == "" {
+		req.BaseCurrency = miso.GetPropStr(PropNetWorthBaseCurrency)
+	}
+
+	var res []ApiPlotNetWorthRes
+	err := db.Raw(`
+		SELECT agg_range, assets, liabilities, net_worth FROM net_worth_statistics
+		WHERE user_no = ? AND base_currency = ?
+		AND str_to_date(concat(agg_range, '01'), '%Y%m%d') BETWEEN ? AND ?`,
+		user.UserNo, req.BaseCurrency, req.StartTime, req.EndTime).Scan(&res).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query net_worth_statistics, %w", err)
+	}
+	if res == nil {
+		res = []ApiPlotNetWorthRes{}
+	}
+
+	set := util.NewSet[string]()
+	for i, r := range res {
+		set.Add(r.AggRange)
+		res[i].Assets = money.UnitFmt(r.Assets, req.BaseCurrency)
+		res[i].Liabilities = money.UnitFmt(r.Liabilities, req.BaseCurrency)
+		res[i].NetWorth = money.UnitFmt(r.NetWorth, req.BaseCurrency)
+	}
+	for _, rng := range missingAggRanges(AggTypeMonthly, req.StartTime, req.EndTime, set) {
+		res = append(res, ApiPlotNetWorthRes{AggRange: rng, Assets: "0", Liabilities: "0", NetWorth: "0"})
+	}
+	sort.Slice(res, func(i, j int) bool { return strings.Compare(res[i].AggRange, res[j].AggRange) < 0 })
+	return res, nil
+}
@@ -0,0 +1,316 @@
+package flow
+
+import (
+	"fmt"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+type ApiSaveStatementReq struct {
+	AccountNo      string     `desc:"Account No" valid:"notEmpty"`
+	StatementDate  util.ETime `desc:"Closing date of the statement"`
+	ClosingBalance string     `desc:"Closing balance on the statement" valid:"notEmpty"`
+}
+
+type ApiStatementNoReq struct {
+	StatementNo string `desc:"Statement No" valid:"notEmpty"`
+}
+
+type AccountStatement struct {
+	StatementNo    string
+	UserNo         string
+	AccountNo      string
+	StatementDate  util.ETime
+	ClosingBalance string
+}
+
+func SaveStatement(rail miso.Rail, db *gorm.DB, req ApiSaveStatementReq, user common.User) (string, error) {
+	if _, err := parseAmt(req.ClosingBalance); err != nil {
+		return "", miso.NewErrf("Invalid closing balance '%v'", req.ClosingBalance)
+	}
+	if _, err := findAccount(db, req.AccountNo, user.UserNo); err != nil {
+		return "", err
+	}
+	statementNo := util.GenIdP("STMT_")
+	err := db.Exec(`INSERT INTO account_statement (statement_no, user_no, account_no, statement_date, closing_balance, created_by)
+		VALUES (?,?,?,?,?,?)`,
+		statementNo, user.UserNo, req.AccountNo, req.StatementDate, req.ClosingBalance, user.Username).Error
+	if err != nil {
+		return "", fmt.Errorf("failed to save account_statement, %w", err)
+	}
+	rail.Infof("Statement %v saved for account %v by %v", statementNo, req.AccountNo, user.Username)
+	return statementNo, nil
+}
+
+func DeleteStatement(rail miso.Rail, db *gorm.DB, req ApiStatementNoReq, user common.User) error {
+	err := db.Exec(`UPDATE account_statement SET deleted = 1, updated_by = ? WHERE statement_no = ? AND user_no = ?`,
+		user.Username, req.StatementNo, user.UserNo).Error
+	if err != nil {
+		return fmt.Errorf("failed to delete account_statement, %w", err)
+	}
+	return nil
+}
+
+type ApiListStatementReq struct {
+	Paging    miso.Paging `desc:"Paging"`
+	AccountNo string      `desc:"Account No" valid:"notEmpty"`
+}
+
+type ApiListStatementRes struct {
+	StatementNo    string     `desc:"Statement No"`
+	AccountNo      string     `desc:"Account No"`
+	StatementDate  util.ETime `desc:"Closing date of the statement"`
+	ClosingBalance string     `desc:"Closing balance on the statement"`
+	CreatedAt      util.ETime `desc:"Create Time"`
+}
+
+func ListStatements(rail miso.Rail, db *gorm.DB, req ApiListStatementReq, user common.User) (miso.PageRes[ApiListStatementRes], error) {
+	return miso.NewPageQuery[ApiListStatementRes]().
+		WithPage(req.Paging).
+		WithBaseQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Table(`account_statement`).
+				Where("user_no = ?", user.UserNo).
+				Where("account_no = ?", req.AccountNo).
+				Where("deleted = 0")
+		}).
+		WithSelectQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Select("statement_no", "account_no", "statement_date", "closing_balance", "created_at").
+				Order("statement_date desc")
+		}).
+		Exec(rail, db)
+}
+
+type ApiStatementCashflow struct {
+	Direction    string     `desc:"Flow Direction: IN / OUT"`
+	TransTime    util.ETime `desc:"Transaction Time"`
+	TransId      string     `desc:"Transaction ID"`
+	Category     string     `desc:"Category Code"`
+	Counterparty string     `desc:"Counterparty of the transaction"`
+	Amount       string     `desc:"Amount"`
+	Currency     string     `desc:"Currency"`
+}
+
+type ApiReconcileStatementRes struct {
+	StatementNo     string                 `desc:"Statement No"`
+	AccountNo       string                 `desc:"Account No"`
+	PeriodStart     *util.ETime            `desc:"Start of the statement period, it's the date of the previous statement"`
+	StatementDate   util.ETime             `desc:"Closing date of the statement"`
+	ClosingBalance  string                 `desc:"Closing balance on the statement"`
+	ComputedBalance string                 `desc:"Balance computed from the opening balance and cashflows of the account"`
+	Difference      string                 `desc:"Closing balance - computed balance"`
+	Matched         bool                   `desc:"Whether the computed balance matches the closing balance"`
+	Unreconciled    []ApiStatementCashflow `desc:"Cashflows in the statement period that are not reconciled yet"`
+}
+
+// Compare closing balance of the statement with the computed balance, and list unreconciled cashflows in the statement period.
+func ReconcileStatement(rail miso.Rail, db *gorm.DB, req ApiStatementNoReq, user common.User) (ApiReconcileStatementRes, error) {
+	st, err := findStatement(db, req.StatementNo, user.UserNo)
+	if err != nil {
+		return ApiReconcileStatementRes{}, err
+	}
+	acc, err := findAccount(db, st.AccountNo, user.UserNo)
+	if err != nil {
+		return ApiReconcileStatementRes{}, err
+	}
+	computed, err := calcAccountBalance(db, acc, st.StatementDate.ToTime())
+	if err != nil {
+		return ApiReconcileStatementRes{}, err
+	}
+	periodStart, err := prevStatementDate(db, st)
+	if err != nil {
+		return ApiReconcileStatementRes{}, err
+	}
+	if periodStart == nil {
+		periodStart = acc.OpeningTime
+	}
+
+	var unreconciled []ApiStatementCashflow
+	tx := db.Table("cashflow c").
+		Select("c.direction, c.trans_time, c.trans_id, c.category, c.counterparty, c.amount, c.currency").
+		Joins("LEFT JOIN cashflow_reconciliation r ON c.user_no = r.user_no AND c.category = r.category AND c.trans_id = r.trans_id").
+		Where("c.user_no = ?", user.UserNo).
+		Where("c.account_no = ?", acc.AccountNo).
+		Where("c.trans_time <= ?", st.StatementDate).
+		Where("c.deleted = 0").
+		Where("r.id IS NULL")
+	if periodStart != nil {
+		tx = tx.Where("c.trans_time > ?", periodStart)
+	}
+	if err := tx.Order("c.trans_time").Scan(&unreconciled).Error; err != nil {
+		return ApiReconcileStatementRes{}, fmt.Errorf("failed to query unreconciled cashflows, %w", err)
+	}
+	for i, u := range unreconciled {
+		unreconciled[i].Amount = money.UnitFmt(u.Amount, u.Currency)
+	}
+
+	return buildReconcileRes(st, acc, computed, periodStart, unreconciled), nil
+}
+
+func buildReconcileRes(st AccountStatement, acc Account, computed *money.Amt, periodStart *util.ETime,
+	unreconciled []ApiStatementCashflow) ApiReconcileStatementRes {
+
+	closing := money.NewAmt(st.ClosingBalance)
+	diff := closing.Sub(computed)
+	return ApiReconcileStatementRes{
+		StatementNo:     st.StatementNo,
+		AccountNo:       st.AccountNo,
+		PeriodStart:     periodStart,
+		StatementDate:   st.StatementDate,
+		ClosingBalance:  money.UnitFmt(closing.String(), acc.Currency),
+		ComputedBalance: money.UnitFmt(computed.String(), acc.Currency),
+		Difference:      money.UnitFmt(diff.String(), acc.Currency),
+		Matched:         diff.Cmp(money.Zero()) == 0,
+		Unreconciled:    unreconciled,
+	}
+}
+
+func findStatement(db *gorm.DB, statementNo string, userNo string) (AccountStatement, error) {
+	var st AccountStatement
+	t := db.Raw(`SELECT statement_no, user_no, account_no, statement_date, closing_balance FROM account_statement
+		WHERE statement_no = ? AND user_no = ? AND deleted = 0`, statementNo, userNo).
+		Scan(&st)
+	if t.Error != nil {
+		return st, fmt.Errorf("failed to query account_statement, %w", t.Error)
+	}
+	if t.RowsAffected < 1 {
+		return st, miso.NewErrf("Statement not found")
+	}
+	return st, nil
+}
+
+func prevStatementDate(db *gorm.DB, st AccountStatement) (*util.ETime, error) {
+	var prev *util.ETime
+	err := db.Raw(`SELECT MAX(statement_date) FROM account_statement WHERE user_no = ? AND account_no = ? AND statement_date < ? AND deleted = 0`,
+		st.UserNo, st.AccountNo, st.StatementDate).
+		Scan(&prev).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query previous account_statement, %w", err)
+	}
+	return prev, nil
+}
+
+type ApiMarkReconciledReq struct {
+	StatementNo string           `desc:"Statement No" valid:"notEmpty"`
+	Cashflows   []ApiCashflowRef `desc:"Cashflows to be marked as reconciled" valid:"notEmpty"`
+}
+
+// Mark cashflows as reconciled, a snapshot of the cashflow is kept so that later edits to them are flagged.
+func MarkReconciled(rail miso.Rail, db *gorm.DB, req ApiMarkReconciledReq, user common.User) error {
+	st, err := findStatement(db, req.StatementNo, user.UserNo)
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, ref := range req.Cashflows {
+			// MySQL reports 0 affected rows if the upsert changes nothing, existence is checked beforehand
+			var n int
+			err := tx.Raw(`SELECT COUNT(*) FROM cashflow WHERE user_no = ? AND category = ? AND trans_id = ? AND account_no = ? AND deleted = 0`,
+				user.UserNo, ref.Category, ref.TransId, st.AccountNo).
+				Scan(&n).Error
+			if err != nil {
+				return fmt.Errorf("failed to query cashflow, %w", err)
+			}
+			if n < 1 {
+				return miso.NewErrf("Cashflow %v not found in account", ref.TransId)
+			}
+			err = tx.Exec(`INSERT INTO cashflow_reconciliation (user_no, category, trans_id, statement_no, direction, trans_time, amount, currency, account_no, created_by)
+				SELECT user_no, category, trans_id, ?, direction, trans_time, amount, currency, account_no, ? FROM cashflow
+				WHERE user_no = ? AND category = ? AND trans_id = ? AND account_no = ? AND deleted = 0
+				ON DUPLICATE KEY UPDATE statement_no = VALUES(statement_no), direction = VALUES(direction), trans_time = VALUES(trans_time),
+				amount = VALUES(amount), currency = VALUES(currency), account_no = VALUES(account_no), created_by = VALUES(created_by)`,
+				st.StatementNo, user.Username, user.UserNo, ref.Category, ref.TransId, st.AccountNo).Error
+			if err != nil {
+				return fmt.Errorf("failed to save cashflow_reconciliation, %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+type ApiUnmarkReconciledReq struct {
+	Cashflows []ApiCashflowRef `desc:"Cashflows to be marked as unreconciled" valid:"notEmpty"`
+}
+
+func UnmarkReconciled(rail miso.Rail, db *gorm.DB, req ApiUnmarkReconciledReq, user common.User) error {
+	for _, ref := range req.Cashflows {
+		err := db.Exec(`DELETE FROM cashflow_reconciliation WHERE user_no = ? AND category = ? AND trans_id = ?`,
+			user.UserNo, ref.Category, ref.TransId).Error
+		if err != nil {
+			return fmt.Errorf("failed to delete cashflow_reconciliation, %w", err)
+		}
+	}
+	return nil
+}
+
+type ApiFlaggedReconciliation struct {
+	StatementNo         string      `desc:"Statement No"`
+	Category            string      `desc:"Category Code"`
+	TransId             string      `desc:"Transaction ID"`
+	ReconciledDirection string      `desc:"Flow Direction when it's reconciled"`
+	ReconciledTransTime util.ETime  `desc:"Transaction Time when it's reconciled"`
+	ReconciledAmount    string      `desc:"Amount when it's reconciled"`
+	ReconciledCurrency  string      `desc:"Currency when it's reconciled"`
+	ReconciledAccountNo string      `desc:"Account No when it's reconciled"`
+	Deleted             bool        `desc:"Whether the cashflow is deleted after it's reconciled"`
+	Direction           string      `desc:"Current Flow Direction"`
+	TransTime           *util.ETime `desc:"Current Transaction Time"`
+	Amount              string      `desc:"Current Amount"`
+	Currency            string      `desc:"Current Currency"`
+	AccountNo           string      `desc:"Current Account No"`
+	Changes             []string    `desc:"What's changed after it's reconciled: DELETED, DIRECTION, TRANS_TIME, AMOUNT, CURRENCY, ACCOUNT" gorm:"-"`
+}
+
+// List what's changed in the cashflow after it's reconciled.
+func reconciliationChanges(f ApiFlaggedReconciliation) []string {
+	if f.Deleted {
+		return []string{"DELETED"}
+	}
+	changes := []string{}
+	if f.Direction != f.ReconciledDirection {
+		changes = append(changes, "DIRECTION")
+	}
+	if f.TransTime == nil || !f.TransTime.ToTime().Equal(f.ReconciledTransTime.ToTime()) {
+		changes = append(changes, "TRANS_TIME")
+	}
+	if money.NewAmt(f.Amount).Cmp(money.NewAmt(f.ReconciledAmount)) != 0 {
+		changes = append(changes, "AMOUNT")
+	}
+	if f.Currency != f.ReconciledCurrency {
+		changes = append(changes, "CURRENCY")
+	}
+	if f.AccountNo != f.ReconciledAccountNo {
+		changes = append(changes, "ACCOUNT")
+	}
+	return changes
+}
+
+// List reconciled cashflows that are edited or deleted after they are reconciled.
+func ListFlaggedReconciliations(rail miso.Rail, db *gorm.DB, user common.User) ([]ApiFlaggedReconciliation, error) {
+	var l []ApiFlaggedReconciliation
+	err := db.Raw(`
+	SELECT r.statement_no, r.category, r.trans_id, r.direction reconciled_direction, r.trans_time reconciled_trans_time,
+	r.amount reconciled_amount, r.currency reconciled_currency, r.account_no reconciled_account_no, c.id IS NULL deleted,
+	c.direction, c.trans_time, c.amount, c.currency, c.account_no
+	FROM cashflow_reconciliation r
+	LEFT JOIN cashflow c ON c.user_no = r.user_no AND c.category = r.category AND c.trans_id = r.trans_id AND c.deleted = 0
+	WHERE r.user_no = ? AND (c.id IS NULL OR c.direction != r.direction OR c.trans_time != r.trans_time
+		OR c.amount != r.amount OR c.currency != r.currency OR c.account_no != r.account_no)
+	ORDER BY r.trans_time DESC
+	`, user.UserNo).
+		Scan(&l).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query flagged cashflow_reconciliation, %w", err)
+	}
+	for i, f := range l {
+		l[i].Changes = reconciliationChanges(f)
+		l[i].ReconciledAmount = money.UnitFmt(f.ReconciledAmount, f.ReconciledCurrency)
+		if !f.Deleted {
+			l[i].Amount = money.UnitFmt(f.Amount, f.Currency)
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,80 @@
+package flow
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/util"
+)
+
+func TestBuildReconcileRes(t *testing.T) {
+	st := AccountStatement{StatementNo: "STMT_1", AccountNo: "ACC_1", ClosingBalance: "1000.50000000"}
+	acc := Account{AccountNo: "ACC_1", Currency: "CNY"}
+
+	res := buildReconcileRes(st, acc, money.NewAmt("980.5"), nil, nil)
+	if res.Difference != "20.00" || res.Matched {
+		t.Fatalf("unmatched: %+v", res)
+	}
+	if res.ClosingBalance != "1000.50" || res.ComputedBalance != "980.50" {
+		t.Fatalf("balances: %+v", res)
+	}
+
+	res = buildReconcileRes(st, acc, money.NewAmt("1000.5"), nil, nil)
+	if res.Difference != "0.00" || !res.Matched {
+		t.Fatalf("matched: %+v", res)
+	}
+
+	res = buildReconcileRes(st, acc, money.NewAmt("1100"), nil, nil)
+	if res.Difference != "-99.50" || res.Matched {
+		t.Fatalf("overstated: %+v", res)
+	}
+}
+
+func TestReconciliationChanges(t *testing.T) {
+	tt := util.ToETime(time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local))
+	f := ApiFlaggedReconciliation{
+		ReconciledDirection: DirectionOut,
+		ReconciledTransTime: tt,
+		ReconciledAmount:    "12.50000000",
+		ReconciledCurrency:  "CNY",
+		ReconciledAccountNo: "ACC_1",
+		Direction:           DirectionOut,
+		TransTime:           &tt,
+		Amount:              "12.5",
+		Currency:            "CNY",
+		AccountNo:           "ACC_1",
+	}
+	if c := reconciliationChanges(f); len(c) != 0 {
+		t.Fatalf("unchanged: %v", c)
+	}
+
+	changed := f
+	changed.Amount = "13.00000000"
+	later := util.ToETime(tt.ToTime().Add(time.Hour))
+	changed.TransTime = &later
+	changed.AccountNo = "ACC_2"
+	if c := reconciliationChanges(changed); !reflect.DeepEqual(c, []string{"TRANS_TIME", "AMOUNT", "ACCOUNT"}) {
+		t.Fatalf("changed: %v", c)
+	}
+
+	deleted := f
+	deleted.Deleted = true
+	deleted.TransTime = nil
+	deleted.Amount = ""
+	if c := reconciliationChanges(deleted); !reflect.DeepEqual(c, []string{"DELETED"}) {
+		t.Fatalf("deleted: %v", c)
+	}
+}
+
+func TestParseAmt(t *testing.T) {
+	if a, err := parseAmt("-12.50"); err != nil || a.String() != "-12.50" {
+		t.Fatalf("valid: %v, %v", a, err)
+	}
+	for _, s := range []string{"", "abc", "12,50"} {
+		if _, err := parseAmt(s); err == nil {
+			t.Fatalf("'%v' should be rejected", s)
+		}
+	}
+}
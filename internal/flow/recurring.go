@@ -0,0 +1,218 @@
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	CadenceWeekly  = "WEEKLY"
+	CadenceMonthly = "MONTHLY"
+	CadenceYearly  = "YEARLY"
+
+	// amounts within the tolerance are considered similar, e.g., 1.2 means at most 20% more than the smallest one
+	recurringAmtTolerance = "1.2"
+
+	// ratio of intervals that must match the cadence
+	recurringRegularity = 0.75
+
+	defaultRecurringMinOccurrences = 3
+
+	// scale of average amount before it's rounded to the currency's scale
+	recurringDivScale = 8
+)
+
+type cadenceWindow struct {
+	Cadence string
+	MinDays float64
+	MaxDays float64
+}
+
+var cadenceWindows = []cadenceWindow{
+	{Cadence: CadenceWeekly, MinDays: 5, MaxDays: 9},
+	{Cadence: CadenceMonthly, MinDays: 26, MaxDays: 35},
+	{Cadence: CadenceYearly, MinDays: 350, MaxDays: 380},
+}
+
+type ApiDetectRecurringReq struct {
+	Since          *util.ETime `desc:"Only cashflows after the time are scanned, by default it's two years ago"`
+	MinOccurrences int         `desc:"Minimum number of occurrences of a recurring cashflow, by default it's 3 (2 for yearly ones)"`
+}
+
+type ApiRecurringCashflow struct {
+	Counterparty string     `desc:"Counterparty of the transaction"`
+	Category     string     `desc:"Category Code"`
+	Direction    string     `desc:"Flow Direction: IN / OUT"`
+	Currency     string     `desc:"Currency"`
+	Cadence      string     `desc:"Detected cadence: WEEKLY, MONTHLY, YEARLY"`
+	Occurrences  int        `desc:"Number of occurrences"`
+	AvgAmount    string     `desc:"Average amount"`
+	LastTime     util.ETime `desc:"Time of the last occurrence"`
+	NextExpected util.ETime `desc:"Next expected time"`
+	Active       bool       `desc:"Whether the recurring cashflow is still active, i.e., the next expected one is not overdue"`
+}
+
+type recurringCandidate struct {
+	Direction    string
+	TransTime    util.ETime
+	Counterparty string
+	Amount       string
+	Currency     string
+	Category     string
+}
+
+// Detect recurring cashflows, e.g., subscriptions, with similar amount paid to the same counterparty regularly.
+//
+// Cashflows excluded from statistics are ignored. Installments and their purchases are also ignored, they are already
+// scheduled by the installment plans, and are not subscriptions that may be forgotten.
+func DetectRecurringCashflows(rail miso.Rail, db *gorm.DB, req ApiDetectRecurringReq, user common.User) ([]ApiRecurringCashflow, error) {
+	since := time.Now().AddDate(-2, 0, 0)
+	if req.Since != nil {
+		since = req.Since.ToTime()
+	}
+	var flows []recurringCandidate
+	err := db.Raw(`SELECT direction, trans_time, counterparty, amount, currency, category FROM cashflow
+		WHERE user_no = ? AND direction = ? AND trans_time >= ? AND transfer_no = '' AND stat_excluded = 0 AND installment_no = ''
+		AND deleted = 0 ORDER BY trans_time`,
+		user.UserNo, DirectionOut, since).
+		Scan(&flows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cashflow, %w", err)
+	}
+	res := detectRecurring(flows, req.MinOccurrences, time.Now())
+	rail.Infof("Detected %d recurring cashflows in %d cashflows for %v", len(res), len(flows), user.Username)
+	return res, nil
+}
+
+func detectRecurring(flows []recurringCandidate, minOccur int, now time.Time) []ApiRecurringCashflow {
+	if minOccur < 2 {
+		minOccur = defaultRecurringMinOccurrences
+	}
+
+	groups := map[string][]recurringCandidate{}
+	for _, f := range flows {
+		cp := strings.ToLower(strings.TrimSpace(f.Counterparty))
+		if cp == "" || cp == "/" {
+			continue
+		}
+		k := f.Direction + ":" + f.Currency + ":" + cp
+		groups[k] = append(groups[k], f)
+	}
+
+	res := []ApiRecurringCashflow{}
+	tolerance := money.NewAmt(recurringAmtTolerance)
+	for _, g := range groups {
+		if len(g) < 2 {
+			continue
+		}
+
+		// cluster by similar amount
+		sort.SliceStable(g, func(i, j int) bool { return money.NewAmt(g[i].Amount).Cmp(money.NewAmt(g[j].Amount)) < 0 })
+		var cluster []recurringCandidate
+		var limit *money.Amt
+		flush := func() {
+			if r, ok := detectCadence(cluster, minOccur, now); ok {
+				res = append(res, r)
+			}
+			cluster = nil
+		}
+		for _, f := range g {
+			amt := money.NewAmt(f.Amount)
+			if limit != nil && amt.Cmp(limit) > 0 {
+				flush()
+			}
+			if len(cluster) < 1 {
+				limit = amt.Mul(tolerance)
+			}
+			cluster = append(cluster, f)
+		}
+		flush()
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].NextExpected.Before(res[j].NextExpected) })
+	return res
+}
+
+func detectCadence(cluster []recurringCandidate, minOccur int, now time.Time) (ApiRecurringCashflow, bool) {
+	if len(cluster) < 2 {
+		return ApiRecurringCashflow{}, false
+	}
+	flows := make([]recurringCandidate, len(cluster))
+	copy(flows, cluster)
+	sort.Slice(flows, func(i, j int) bool { return flows[i].TransTime.Before(flows[j].TransTime) })
+
+	intervals := make([]float64, 0, len(flows)-1)
+	for i := 1; i < len(flows); i++ {
+		intervals = append(intervals, flows[i].TransTime.Sub(flows[i-1].TransTime).Hours()/24)
+	}
+	sorted := make([]float64, len(intervals))
+	copy(sorted, intervals)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var win *cadenceWindow
+	for i := range cadenceWindows {
+		if median >= cadenceWindows[i].MinDays && median <= cadenceWindows[i].MaxDays {
+			win = &cadenceWindows[i]
+			break
+		}
+	}
+	if win == nil {
+		return ApiRecurringCashflow{}, false
+	}
+	if win.Cadence == CadenceYearly {
+		minOccur = util.MinInt(minOccur, 2)
+	}
+	if len(flows) < minOccur {
+		return ApiRecurringCashflow{}, false
+	}
+
+	matched := 0
+	for _, iv := range intervals {
+		if iv >= win.MinDays && iv <= win.MaxDays {
+			matched++
+		}
+	}
+	if float64(matched) < float64(len(intervals))*recurringRegularity {
+		return ApiRecurringCashflow{}, false
+	}
+
+	sum := money.Zero()
+	for _, f := range flows {
+		sum = sum.Add(money.NewAmt(f.Amount))
+	}
+	last := flows[len(flows)-1]
+	next := nextRecurringTime(win.Cadence, last.TransTime.ToTime())
+	overdue := next.Add(time.Duration((win.MaxDays-win.MinDays)*24) * time.Hour)
+	return ApiRecurringCashflow{
+		Counterparty: last.Counterparty,
+		Category:     last.Category,
+		Direction:    last.Direction,
+		Currency:     last.Currency,
+		Cadence:      win.Cadence,
+		Occurrences:  len(flows),
+		AvgAmount:    money.UnitFmt(sum.Div(money.NewAmt(fmt.Sprintf("%d", len(flows))), recurringDivScale).String(), last.Currency),
+		LastTime:     last.TransTime,
+		NextExpected: util.ToETime(next),
+		Active:       now.Before(overdue),
+	}, true
+}
+
+func nextRecurringTime(cadence string, last time.Time) time.Time {
+	switch cadence {
+	case CadenceWeekly:
+		return last.AddDate(0, 0, 7)
+	case CadenceYearly:
+		return last.AddDate(1, 0, 0)
+	default:
+		return last.AddDate(0, 1, 0)
+	}
+}
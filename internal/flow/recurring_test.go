@@ -0,0 +1,71 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/util"
+)
+
+func TestDetectRecurring(t *testing.T) {
+	start := time.Date(2024, 1, 5, 10, 0, 0, 0, time.Local)
+	var flows []recurringCandidate
+	for i := 0; i < 6; i++ {
+		flows = append(flows, recurringCandidate{
+			Direction:    DirectionOut,
+			TransTime:    util.ToETime(start.AddDate(0, i, 0)),
+			Counterparty: "Music Streaming",
+			Amount:       "15.00",
+			Currency:     "CNY",
+		})
+		flows = append(flows, recurringCandidate{
+			Direction:    DirectionOut,
+			TransTime:    util.ToETime(start.AddDate(0, 0, i*7)),
+			Counterparty: "Coffee Shop",
+			Amount:       "30",
+			Currency:     "CNY",
+		})
+	}
+	// irregular spending at the same counterparty with very different amount
+	flows = append(flows, recurringCandidate{
+		Direction:    DirectionOut,
+		TransTime:    util.ToETime(start.AddDate(0, 0, 3)),
+		Counterparty: "Coffee Shop",
+		Amount:       "300",
+		Currency:     "CNY",
+	})
+	// random spending
+	for i := 0; i < 4; i++ {
+		flows = append(flows, recurringCandidate{
+			Direction:    DirectionOut,
+			TransTime:    util.ToETime(start.AddDate(0, 0, i*i*11)),
+			Counterparty: "Supermarket",
+			Amount:       "100",
+			Currency:     "CNY",
+		})
+	}
+
+	now := start.AddDate(0, 5, 10)
+	res := detectRecurring(flows, 0, now)
+	if len(res) != 2 {
+		t.Fatalf("expected 2 recurring cashflows, actual: %+v", res)
+	}
+	for _, r := range res {
+		t.Logf("%+v", r)
+		switch r.Counterparty {
+		case "Music Streaming":
+			if r.Cadence != CadenceMonthly || r.Occurrences != 6 || r.AvgAmount != "15.00" || !r.Active {
+				t.Fatalf("invalid: %+v", r)
+			}
+			if r.NextExpected.Format("20060102") != "20240705" {
+				t.Fatalf("invalid next expected: %v", r.NextExpected)
+			}
+		case "Coffee Shop":
+			if r.Cadence != CadenceWeekly || r.Occurrences != 6 || r.Active {
+				t.Fatalf("invalid: %+v", r)
+			}
+		default:
+			t.Fatalf("unexpected: %+v", r)
+		}
+	}
+}
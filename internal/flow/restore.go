@@ -0,0 +1,519 @@
+package flow
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/curtisnewbie/miso/encoding"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	RestoreConflictSkip      = "SKIP"      // keep the existing records
+	RestoreConflictOverwrite = "OVERWRITE" // replace the existing records with the archived ones
+
+	restoreBatchSize = 200
+)
+
+// Table restored from archive, tables are restored in order so that the remapped keys are known before they are referenced.
+type restoreTable struct {
+	Table         string
+	Key           string // business key owned by the table, it's remapped if it's already taken by another user
+	CashflowChild bool   // rows referencing cashflow by category and trans_id, they are skipped with the cashflows
+}
+
+var (
+	restoreTables = []restoreTable{
+		{Table: "account", Key: "account_no"},
+		{Table: "installment_plan", Key: "plan_no"},
+		{Table: "budget", Key: "budget_no"},
+		{Table: "envelope", Key: "envelope_no"},
+		{Table: "saving_goal", Key: "goal_no"},
+		{Table: "cashflow_template", Key: "template_no"},
+		{Table: "account_statement", Key: "statement_no"},
+		{Table: "loan", Key: "loan_no"},
+		{Table: "cashflow"},
+		{Table: "cashflow_tag", CashflowChild: true},
+		{Table: "cashflow_currency"},
+		{Table: "account_payment_method"},
+		{Table: "budget_alert"},
+		{Table: "envelope_category"},
+		{Table: "bill_reminder"},
+		{Table: "cashflow_reconciliation", CashflowChild: true},
+		{Table: "loan_repayment", CashflowChild: true},
+		{Table: "ledger_account_mapping"},
+	}
+
+	// columns referencing business keys, mapped to the key column of the owning table
+	restoreKeyRefs = map[string]string{
+		"account_no":     "account_no",
+		"plan_no":        "plan_no",
+		"installment_no": "plan_no",
+		"budget_no":      "budget_no",
+		"envelope_no":    "envelope_no",
+		"goal_no":        "goal_no",
+		"template_no":    "template_no",
+		"statement_no":   "statement_no",
+		"loan_no":        "loan_no",
+	}
+)
+
+// Tables owning the business keys, keyed by key column.
+func restoreKeyTables() map[string]string {
+	m := map[string]string{}
+	for _, t := range restoreTables {
+		if t.Key != "" {
+			m[t.Key] = t.Table
+		}
+	}
+	return m
+}
+
+// Check business keys referenced by the row, each of them must be owned by the user, otherwise the archive may be used
+// to write into other user's data.
+//
+// ownKey is the key column owned by the table itself, it's not checked as it's already remapped.
+func checkRestoreKeyRefs(table string, row map[string]any, ownKey string, owned func(keyCol string, key string) (bool, error)) error {
+	cols := make([]string, 0, len(restoreKeyRefs))
+	for col := range restoreKeyRefs {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	for _, col := range cols {
+		if col == ownKey {
+			continue
+		}
+		v, ok := row[col].(string)
+		if !ok || v == "" {
+			continue
+		}
+		ok, err := owned(restoreKeyRefs[col], v)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return miso.NewErrf("Invalid archive, %v.%v '%v' is not found", table, col, v)
+		}
+	}
+	return nil
+}
+
+// Remapped business keys, keyed by key column and then the archived value.
+type restoreKeyMap map[string]map[string]string
+
+func (m restoreKeyMap) Put(keyCol string, old string, new string) {
+	if m[keyCol] == nil {
+		m[keyCol] = map[string]string{}
+	}
+	m[keyCol][old] = new
+}
+
+// Replace user_no and the remapped business keys of the archived row, id is dropped as it's reassigned.
+func (m restoreKeyMap) Apply(row map[string]any, userNo string) {
+	delete(row, "id")
+	if _, ok := row["user_no"]; ok {
+		row["user_no"] = userNo
+	}
+	for col, keyCol := range restoreKeyRefs {
+		v, ok := row[col].(string)
+		if !ok || v == "" {
+			continue
+		}
+		if nv, ok := m[keyCol][v]; ok {
+			row[col] = nv
+		}
+	}
+}
+
+// Prefix of the business key, e.g., 'ACC_' for 'ACC_123'.
+func restoreKeyPrefix(key string) string {
+	if i := strings.Index(key, "_"); i > -1 {
+		return key[:i+1]
+	}
+	return ""
+}
+
+func buildRestoreInsert(table string, cols []string, rows int, overwrite bool) string {
+	b := strings.Builder{}
+	if overwrite {
+		b.WriteString("INSERT INTO ")
+	} else {
+		b.WriteString("INSERT IGNORE INTO ")
+	}
+	b.WriteString(table)
+	b.WriteString(" (")
+	b.WriteString(strings.Join(cols, ","))
+	b.WriteString(") VALUES ")
+	placeholder := "(" + strings.TrimSuffix(strings.Repeat("?,", len(cols)), ",") + ")"
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(placeholder)
+	}
+	if overwrite {
+		b.WriteString(" ON DUPLICATE KEY UPDATE ")
+		for i, c := range cols {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, "%v = VALUES(%v)", c, c)
+		}
+	}
+	return b.String()
+}
+
+type ApiRestoreUserDataRes struct {
+	Restored map[string]int `desc:"Number of rows restored in each table"`
+	Remapped int            `desc:"Number of business keys remapped as they are taken by other users"`
+	Skipped  int            `desc:"Number of cashflows skipped as the transaction ids already exist"`
+}
+
+// Restore user data from archive uploaded in request body, query param 'conflict' is either SKIP (default) or OVERWRITE.
+func RestoreUploadedUserData(inb *miso.Inbound, db *gorm.DB) (ApiRestoreUserDataRes, error) {
+	rail := inb.Rail()
+	user := common.GetUser(rail)
+	conflict := strings.ToUpper(inb.Query("conflict"))
+	if conflict == "" {
+		conflict = RestoreConflictSkip
+	}
+	if conflict != RestoreConflictSkip && conflict != RestoreConflictOverwrite {
+		return ApiRestoreUserDataRes{}, miso.NewErrf("Invalid conflict handling '%v', should be either %v or %v", conflict,
+			RestoreConflictSkip, RestoreConflictOverwrite)
+	}
+
+	_, r := inb.Unwrap()
+	defer r.Body.Close()
+	path, err := util.SaveTmpFile("/tmp", r.Body)
+	if err != nil {
+		return ApiRestoreUserDataRes{}, err
+	}
+	defer os.Remove(path)
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return ApiRestoreUserDataRes{}, miso.NewErrf("Invalid archive").WithInternalMsg("%v", err)
+	}
+	defer zr.Close()
+	return RestoreUserData(rail, db, &zr.Reader, conflict == RestoreConflictOverwrite, user)
+}
+
+func RestoreUserData(rail miso.Rail, db *gorm.DB, zr *zip.Reader, overwrite bool, user common.User) (ApiRestoreUserDataRes, error) {
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	var manifest UserArchiveManifest
+	if err := readArchiveJson(files[userArchiveManifest], &manifest); err != nil {
+		return ApiRestoreUserDataRes{}, miso.NewErrf("Invalid archive, manifest is missing").WithInternalMsg("%v", err)
+	}
+	if manifest.Version < 1 || manifest.Version > UserArchiveVersion {
+		return ApiRestoreUserDataRes{}, miso.NewErrf("Archive version %v is not supported", manifest.Version)
+	}
+
+	lock := userCashflowLock(rail, user.UserNo)
+	if err := lock.Lock(); err != nil {
+		return ApiRestoreUserDataRes{}, err
+	}
+	defer lock.Unlock()
+
+	res := ApiRestoreUserDataRes{Restored: map[string]int{}}
+	changes := []CashflowChange{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		st := &restoreState{
+			keys:    restoreKeyMap{},
+			owned:   util.NewSet[string](),
+			skipped: util.NewSet[string](),
+		}
+		for _, t := range restoreTables {
+			f, ok := files[t.Table+".jsonl"]
+			if !ok {
+				continue
+			}
+			cols, err := tableColumns(tx, t.Table)
+			if err != nil {
+				return err
+			}
+			r := &tableRestorer{tx: tx, table: t, cols: cols, restoreState: st, overwrite: overwrite, user: user, res: &res}
+			if err := forEachArchiveRow(f, r.Add); err != nil {
+				return err
+			}
+			if err := r.Flush(); err != nil {
+				return err
+			}
+			changes = append(changes, r.changes...)
+		}
+		return nil
+	})
+	if err != nil {
+		return ApiRestoreUserDataRes{}, err
+	}
+	rail.Infof("Restored user data (exported by %v at %v) for %v, %+v, remapped: %d, skipped: %d", manifest.Username,
+		manifest.ExportedAt, user.Username, res.Restored, res.Remapped, res.Skipped)
+
+	// statistics are not restored, they are rebuilt from the cashflows
+	if err := OnCashflowChanged(rail, changes, user.UserNo); err != nil {
+		rail.Errorf("Failed to update cashflow statistics for restore, userNo: %v, %v", user.UserNo, err)
+	}
+	if err := markNetWorthStale(db, user.UserNo, ""); err != nil {
+		rail.Errorf("Failed to mark net worth stale for restore, userNo: %v, %v", user.UserNo, err)
+	}
+	return res, nil
+}
+
+func readArchiveJson(f *zip.File, ptr any) error {
+	if f == nil {
+		return fmt.Errorf("file not found")
+	}
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return encoding.DecodeJson(r, ptr)
+}
+
+func forEachArchiveRow(f *zip.File, fn func(row map[string]any) error) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) < 1 {
+			continue
+		}
+		row := map[string]any{}
+		if err := encoding.ParseJson(sc.Bytes(), &row); err != nil {
+			return fmt.Errorf("invalid row in %v, %w", f.Name, err)
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read %v, %w", f.Name, err)
+	}
+	return nil
+}
+
+// Columns of the table in current schema, archived columns that no longer exist or are generated are ignored.
+func tableColumns(db *gorm.DB, table string) (util.Set[string], error) {
+	var cols []string
+	err := db.Raw(`SELECT COLUMN_NAME FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?
+		AND GENERATION_EXPRESSION = ''`, table).
+		Scan(&cols).Error
+	if err != nil {
+		return util.Set[string]{}, fmt.Errorf("failed to query columns of %v, %w", table, err)
+	}
+	set := util.NewSet[string]()
+	set.AddAll(cols)
+	return set, nil
+}
+
+// State shared by the tables restored in the same run.
+type restoreState struct {
+	keys    restoreKeyMap    // remapped business keys
+	owned   util.Set[string] // business keys known to be owned by the user, keyed by restoreOwnedKey
+	skipped util.Set[string] // cashflows skipped as conflicts, keyed by cashflowTagKey
+}
+
+type tableRestorer struct {
+	*restoreState
+	tx        *gorm.DB
+	table     restoreTable
+	cols      util.Set[string]
+	overwrite bool
+	user      common.User
+	res       *ApiRestoreUserDataRes
+	batch     []map[string]any
+	changes   []CashflowChange
+}
+
+func (r *tableRestorer) Add(row map[string]any) error {
+	if r.table.CashflowChild {
+		category, _ := row["category"].(string)
+		transId, _ := row["trans_id"].(string)
+		if r.skipped.Has(cashflowTagKey(category, transId)) {
+			return nil
+		}
+	}
+	if r.table.Key != "" {
+		if err := r.remapKey(row); err != nil {
+			return err
+		}
+	}
+	r.keys.Apply(row, r.user.UserNo)
+	if err := checkRestoreKeyRefs(r.table.Table, row, r.table.Key, r.isOwned); err != nil {
+		return err
+	}
+	if key, ok := row[r.table.Key].(string); ok && key != "" {
+		r.owned.Add(restoreOwnedKey(r.table.Key, key))
+	}
+	r.batch = append(r.batch, row)
+	if len(r.batch) >= restoreBatchSize {
+		return r.Flush()
+	}
+	return nil
+}
+
+// Remap business key of the row if it's taken by another user.
+func (r *tableRestorer) remapKey(row map[string]any) error {
+	key, ok := row[r.table.Key].(string)
+	if !ok || key == "" {
+		return nil
+	}
+	var owner string
+	err := r.tx.Raw(fmt.Sprintf("SELECT user_no FROM %v WHERE %v = ?", r.table.Table, r.table.Key), key).Scan(&owner).Error
+	if err != nil {
+		return fmt.Errorf("failed to query %v, %w", r.table.Table, err)
+	}
+	if owner == "" || owner == r.user.UserNo {
+		return nil
+	}
+	r.keys.Put(r.table.Key, key, util.GenIdP(restoreKeyPrefix(key)))
+	r.res.Remapped++
+	return nil
+}
+
+func restoreOwnedKey(keyCol string, key string) string {
+	return keyCol + ":" + key
+}
+
+// Whether the business key is restored in this run or owned by the user.
+func (r *tableRestorer) isOwned(keyCol string, key string) (bool, error) {
+	if r.owned.Has(restoreOwnedKey(keyCol, key)) {
+		return true, nil
+	}
+	table, ok := restoreKeyTables()[keyCol]
+	if !ok {
+		return false, nil
+	}
+	var n int
+	err := r.tx.Raw(fmt.Sprintf("SELECT COUNT(*) FROM %v WHERE %v = ? AND user_no = ?", table, keyCol), key, r.user.UserNo).
+		Scan(&n).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to query %v, %w", table, err)
+	}
+	if n < 1 {
+		return false, nil
+	}
+	r.owned.Add(restoreOwnedKey(keyCol, key))
+	return true, nil
+}
+
+func (r *tableRestorer) Flush() error {
+	if len(r.batch) < 1 {
+		return nil
+	}
+	defer func() { r.batch = r.batch[:0] }()
+
+	rows := r.batch
+	if r.table.Table == "cashflow" {
+		var err error
+		if rows, err = r.resolveCashflowConflicts(rows); err != nil {
+			return err
+		}
+	}
+
+	// rows of the same table share the same columns, unless the archive is hand-crafted
+	groups := map[string][]map[string]any{}
+	groupCols := map[string][]string{}
+	for _, row := range rows {
+		cols := make([]string, 0, len(row))
+		for c := range row {
+			if r.cols.Has(c) {
+				cols = append(cols, c)
+			}
+		}
+		sort.Strings(cols)
+		k := strings.Join(cols, ",")
+		groups[k] = append(groups[k], row)
+		groupCols[k] = cols
+	}
+	for k, l := range groups {
+		cols := groupCols[k]
+		if len(cols) < 1 {
+			continue
+		}
+		args := make([]any, 0, len(cols)*len(l))
+		for _, row := range l {
+			for _, c := range cols {
+				args = append(args, row[c])
+			}
+		}
+		t := r.tx.Exec(buildRestoreInsert(r.table.Table, cols, len(l), r.overwrite), args...)
+		if t.Error != nil {
+			return fmt.Errorf("failed to restore %v, %w", r.table.Table, t.Error)
+		}
+		if r.overwrite {
+			// all rows are written, MySQL reports 2 affected rows for each updated row and 0 for unchanged ones
+			r.res.Restored[r.table.Table] += len(l)
+		} else {
+			// rows ignored as duplicates are not restored
+			r.res.Restored[r.table.Table] += int(t.RowsAffected)
+		}
+	}
+	return nil
+}
+
+// Cashflows are identified by category and transaction id, existing ones are either kept or replaced.
+func (r *tableRestorer) resolveCashflowConflicts(rows []map[string]any) ([]map[string]any, error) {
+	transIds := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if id, ok := row["trans_id"].(string); ok {
+			transIds = append(transIds, id)
+		}
+	}
+	var existing []cashflowTag
+	err := r.tx.Raw(`SELECT category, trans_id FROM cashflow WHERE user_no = ? AND trans_id IN ? AND deleted = 0`,
+		r.user.UserNo, transIds).
+		Scan(&existing).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cashflow, %w", err)
+	}
+	exists := util.NewSet[string]()
+	for _, e := range existing {
+		exists.Add(cashflowTagKey(e.Category, e.TransId))
+	}
+
+	kept := make([]map[string]any, 0, len(rows))
+	for _, row := range rows {
+		category, _ := row["category"].(string)
+		transId, _ := row["trans_id"].(string)
+		deleted := fmt.Sprintf("%v", row["deleted"]) == "1"
+		k := cashflowTagKey(category, transId)
+		if !deleted && exists.Has(k) {
+			if !r.overwrite {
+				r.res.Skipped++
+				r.skipped.Add(k)
+				continue
+			}
+			err := r.tx.Exec(`DELETE FROM cashflow WHERE user_no = ? AND category = ? AND trans_id = ? AND deleted = 0`,
+				r.user.UserNo, category, transId).Error
+			if err != nil {
+				return nil, fmt.Errorf("failed to replace cashflow, %w", err)
+			}
+		}
+		if !deleted {
+			if s, ok := row["trans_time"].(string); ok {
+				if t, err := time.ParseInLocation(userArchiveTimeFormat, s, time.Local); err == nil {
+					r.changes = append(r.changes, CashflowChange{TransTime: util.ToETime(t)})
+				}
+			}
+		}
+		kept = append(kept, row)
+	}
+	return kept, nil
+}
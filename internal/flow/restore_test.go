@@ -0,0 +1,71 @@
+package flow
+
+import "testing"
+
+func TestRestoreKeyMapApply(t *testing.T) {
+	m := restoreKeyMap{}
+	m.Put("plan_no", "INST_1", "INST_2")
+	m.Put("account_no", "ACC_1", "ACC_2")
+	row := map[string]any{
+		"id":             float64(10),
+		"user_no":        "UE_OLD",
+		"installment_no": "INST_1",
+		"account_no":     "ACC_1",
+		"trans_id":       "T1",
+	}
+	m.Apply(row, "UE_NEW")
+	if _, ok := row["id"]; ok {
+		t.Fatal("id should be dropped")
+	}
+	if row["user_no"] != "UE_NEW" {
+		t.Fatalf("user_no: %v", row["user_no"])
+	}
+	if row["installment_no"] != "INST_2" || row["account_no"] != "ACC_2" {
+		t.Fatalf("keys not remapped: %+v", row)
+	}
+	if row["trans_id"] != "T1" {
+		t.Fatalf("trans_id: %v", row["trans_id"])
+	}
+}
+
+func TestRestoreKeyPrefix(t *testing.T) {
+	if p := restoreKeyPrefix("ACC_123"); p != "ACC_" {
+		t.Fatalf("prefix: %v", p)
+	}
+	if p := restoreKeyPrefix("123"); p != "" {
+		t.Fatalf("prefix: %v", p)
+	}
+}
+
+func TestBuildRestoreInsert(t *testing.T) {
+	s := buildRestoreInsert("cashflow_tag", []string{"tag", "user_no"}, 2, false)
+	if s != "INSERT IGNORE INTO cashflow_tag (tag,user_no) VALUES (?,?),(?,?)" {
+		t.Fatalf("skip: %v", s)
+	}
+	s = buildRestoreInsert("budget", []string{"name"}, 1, true)
+	if s != "INSERT INTO budget (name) VALUES (?) ON DUPLICATE KEY UPDATE name = VALUES(name)" {
+		t.Fatalf("overwrite: %v", s)
+	}
+}
+
+func TestCheckRestoreKeyRefs(t *testing.T) {
+	owned := func(keyCol string, key string) (bool, error) {
+		return (keyCol == "envelope_no" && key == "ENV_MINE") || (keyCol == "plan_no" && key == "INST_MINE"), nil
+	}
+	if err := checkRestoreKeyRefs("envelope_category", map[string]any{"envelope_no": "ENV_MINE"}, "", owned); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRestoreKeyRefs("envelope_category", map[string]any{"envelope_no": "ENV_OTHER"}, "", owned); err == nil {
+		t.Fatal("envelope of other user should be rejected")
+	}
+	if err := checkRestoreKeyRefs("cashflow", map[string]any{"installment_no": "INST_MINE", "account_no": ""}, "", owned); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRestoreKeyRefs("cashflow", map[string]any{"account_no": "ACC_OTHER"}, "", owned); err == nil {
+		t.Fatal("account of other user should be rejected")
+	}
+	// key owned by the table itself is remapped instead
+	if err := checkRestoreKeyRefs("envelope", map[string]any{"envelope_no": "ENV_NEW"}, "envelope_no", owned); err != nil {
+		t.Fatal(err)
+	}
+}
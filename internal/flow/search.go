@@ -0,0 +1,165 @@
+package flow
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+const (
+	// same as MySQL's default ngram_token_size, shorter terms are not indexed
+	keywordNgramSize = 2
+	keywordMaxTerms  = 10
+
+	keywordMatchCols = "counterparty, remark, payment_method, extra_values"
+
+	highlightOpen  = "<em>"
+	highlightClose = "</em>"
+)
+
+// Split keyword into search terms, operators of the boolean full-text search are removed.
+func keywordTerms(keyword string) []string {
+	clean := strings.Map(func(r rune) rune {
+		switch r {
+		case '"', '+', '-', '<', '>', '(', ')', '~', '*', '@':
+			return ' '
+		}
+		return r
+	}, keyword)
+	seen := util.NewSet[string]()
+	terms := []string{}
+	for _, t := range strings.Fields(clean) {
+		if len(terms) >= keywordMaxTerms {
+			break
+		}
+		if seen.Add(strings.ToLower(t)) {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// Build boolean mode full-text expression, all terms are required and each term is matched as a phrase.
+//
+// Terms shorter than the ngram token size are not indexed, they are returned separately.
+func keywordAgainst(terms []string) (against string, short []string) {
+	b := strings.Builder{}
+	for _, t := range terms {
+		if utf8.RuneCountInString(t) < keywordNgramSize {
+			short = append(short, t)
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(`+"` + t + `"`)
+	}
+	return b.String(), short
+}
+
+// Filter cashflows by keyword, counterparty, remark, payment method and values of extra info are searched.
+func filterKeyword(tx *gorm.DB, keyword string) *gorm.DB {
+	against, short := keywordAgainst(keywordTerms(keyword))
+	if against != "" {
+		tx = tx.Where("MATCH ("+keywordMatchCols+") AGAINST (? IN BOOLEAN MODE)", against)
+	}
+	for _, t := range short {
+		like := "%" + likeEscaper.Replace(t) + "%"
+		tx = tx.Where("(counterparty LIKE ? OR remark LIKE ? OR payment_method LIKE ? OR extra_values LIKE ?)",
+			like, like, like, like)
+	}
+	return tx
+}
+
+// Order cashflows by relevance of the keyword, it's a no-op if none of the terms is indexed.
+func orderByKeyword(tx *gorm.DB, keyword string) *gorm.DB {
+	against, _ := keywordAgainst(keywordTerms(keyword))
+	if against == "" {
+		return tx
+	}
+	return tx.Order(clause.Expr{
+		SQL:  "MATCH (" + keywordMatchCols + ") AGAINST (? IN BOOLEAN MODE) DESC",
+		Vars: []any{against},
+	})
+}
+
+// Highlight terms in s, matched terms are wrapped in <em></em> and the rest is html escaped.
+//
+// Terms are matched case-insensitively, returns false if none of the terms is found.
+func highlightTerms(s string, terms []string) (string, bool) {
+	if s == "" || len(terms) < 1 {
+		return "", false
+	}
+	lower := strings.ToLower(s)
+	fold := len(lower) == len(s) // byte offsets change, fallback to case-sensitive matching
+	if !fold {
+		lower = s
+	}
+
+	type span struct{ start, end int }
+	spans := []span{}
+	for _, t := range terms {
+		lt := t
+		if fold {
+			lt = strings.ToLower(t)
+		}
+		if lt == "" {
+			continue
+		}
+		for i := 0; i < len(lower); {
+			j := strings.Index(lower[i:], lt)
+			if j < 0 {
+				break
+			}
+			spans = append(spans, span{i + j, i + j + len(lt)})
+			i += j + len(lt)
+		}
+	}
+	if len(spans) < 1 {
+		return "", false
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	b := strings.Builder{}
+	prev := 0
+	for i := 0; i < len(spans); i++ {
+		sp := spans[i]
+		for i+1 < len(spans) && spans[i+1].start <= sp.end {
+			if spans[i+1].end > sp.end {
+				sp.end = spans[i+1].end
+			}
+			i++
+		}
+		b.WriteString(html.EscapeString(s[prev:sp.start]))
+		b.WriteString(highlightOpen)
+		b.WriteString(html.EscapeString(s[sp.start:sp.end]))
+		b.WriteString(highlightClose)
+		prev = sp.end
+	}
+	b.WriteString(html.EscapeString(s[prev:]))
+	return b.String(), true
+}
+
+// Highlight keyword in the searchable fields of the cashflow, keyed by field name, e.g., Counterparty, Extra.商品.
+func highlightCashflow(t ListCashFlowRes, terms []string) map[string]string {
+	hl := map[string]string{}
+	put := func(field string, v string) {
+		if s, ok := highlightTerms(v, terms); ok {
+			hl[field] = s
+		}
+	}
+	put("Counterparty", t.Counterparty)
+	put("Remark", t.Remark)
+	put("PaymentMethod", t.PaymentMethod)
+	for k, v := range decodeExtra(t.Extra) {
+		put("Extra."+k, v)
+	}
+	return hl
+}
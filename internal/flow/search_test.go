@@ -0,0 +1,56 @@
+package flow
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeywordTerms(t *testing.T) {
+	terms := keywordTerms(` +星巴克  "拿铁" Coffee coffee -x `)
+	if !reflect.DeepEqual(terms, []string{"星巴克", "拿铁", "Coffee", "x"}) {
+		t.Fatalf("terms: %#v", terms)
+	}
+	if terms := keywordTerms(" ( ) "); len(terms) != 0 {
+		t.Fatalf("terms: %#v", terms)
+	}
+}
+
+func TestKeywordAgainst(t *testing.T) {
+	against, short := keywordAgainst([]string{"星巴克", "饭", "Coffee"})
+	if against != `+"星巴克" +"Coffee"` {
+		t.Fatalf("against: %v", against)
+	}
+	if !reflect.DeepEqual(short, []string{"饭"}) {
+		t.Fatalf("short: %#v", short)
+	}
+}
+
+func TestHighlightTerms(t *testing.T) {
+	s, ok := highlightTerms("Starbucks 星巴克咖啡", []string{"starbucks", "咖啡"})
+	if !ok || s != "<em>Starbucks</em> 星巴克<em>咖啡</em>" {
+		t.Fatalf("highlight: %v", s)
+	}
+	s, ok = highlightTerms("abcd", []string{"abc", "bcd"})
+	if !ok || s != "<em>abcd</em>" {
+		t.Fatalf("overlapping: %v", s)
+	}
+	s, ok = highlightTerms("<b>tea</b>", []string{"TEA"})
+	if !ok || s != "&lt;b&gt;<em>tea</em>&lt;/b&gt;" {
+		t.Fatalf("escaped: %v", s)
+	}
+	if _, ok = highlightTerms("tea", []string{"coffee"}); ok {
+		t.Fatal("should not match")
+	}
+}
+
+func TestHighlightCashflow(t *testing.T) {
+	hl := highlightCashflow(ListCashFlowRes{
+		Counterparty: "美团",
+		Remark:       "午饭",
+		Extra:        `{"商品":"美团外卖订单","交易类型":"商户消费"}`,
+	}, []string{"美团"})
+	exp := map[string]string{"Counterparty": "<em>美团</em>", "Extra.商品": "<em>美团</em>外卖订单"}
+	if !reflect.DeepEqual(hl, exp) {
+		t.Fatalf("highlights: %#v", hl)
+	}
+}
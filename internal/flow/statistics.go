@@ -65,6 +65,52 @@ func ParseAggRangeTime(aggType string, aggRange string) (util.ETime, error) {
 	return util.ToETime(t), err
 }
 
+// Format the aggregation range that t belongs to.
+func aggRangeOf(aggType string, t time.Time) string {
+	if aggType == AggTypeWeekly {
+		t = t.AddDate(0, 0, -(int(t.Weekday()) - int(time.Sunday)))
+	}
+	return t.Format(RangeFormatMap[aggType])
+}
+
+// Time range of the whole aggregation period that starts at t.
+func aggTimeRange(aggType string, t time.Time) TimeRange {
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	var end time.Time
+	switch aggType {
+	case AggTypeYearly:
+		start = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.Local)
+		end = start.AddDate(1, 0, 0)
+	case AggTypeMonthly:
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local)
+		end = start.AddDate(0, 1, 0)
+	default:
+		end = start.AddDate(0, 0, 7)
+	}
+	return TimeRange{Start: start, End: end.Add(-time.Second)}
+}
+
+// List aggregation ranges of the periods between start and end (both inclusive).
+func aggRangesBetween(aggType string, start time.Time, end time.Time) []string {
+	rng := []string{}
+	t := aggTimeRange(aggType, start).Start
+	if aggType == AggTypeWeekly {
+		t = t.AddDate(0, 0, -(int(t.Weekday()) - int(time.Sunday)))
+	}
+	for !t.After(end) {
+		rng = append(rng, aggRangeOf(aggType, t))
+		switch aggType {
+		case AggTypeYearly:
+			t = t.AddDate(1, 0, 0)
+		case AggTypeMonthly:
+			t = t.AddDate(0, 1, 0)
+		default:
+			t = t.AddDate(0, 0, 7)
+		}
+	}
+	return rng
+}
+
 type CashflowChange struct {
 	TransTime util.ETime
 }
@@ -87,9 +133,9 @@ func OnCashflowChanged(rail miso.Rail, changes []CashflowChange, userNo string)
 
 	for _, c := range changes {
 		tt := c.TransTime.ToTime()
-		mapAddAgg(AggTypeYearly, tt.Format(RangeFormatMap[AggTypeYearly]))
-		mapAddAgg(AggTypeMonthly, tt.Format(RangeFormatMap[AggTypeMonthly]))
-		mapAddAgg(AggTypeWeekly, tt.AddDate(0, 0, -(int(tt.Weekday())-int(time.Sunday))).Format(RangeFormatMap[AggTypeWeekly]))
+		mapAddAgg(AggTypeYearly, aggRangeOf(AggTypeYearly, tt))
+		mapAddAgg(AggTypeMonthly, aggRangeOf(AggTypeMonthly, tt))
+		mapAddAgg(AggTypeWeekly, aggRangeOf(AggTypeWeekly, tt))
 	}
 
 	for typ, set := range aggMap {
@@ -126,15 +172,24 @@ func OnCalcCashflowStatsEvent(rail miso.Rail, evt CalcCashflowStatsEvent) error
 
 	db := miso.GetMySQL()
 	t := evt.AggTime.ToTime()
+	var err error
 	switch evt.AggType {
 	case AggTypeMonthly:
-		return calcMonthlyCashflow(rail, db, t, evt.AggRange, evt.UserNo)
+		err = calcMonthlyCashflow(rail, db, t, evt.AggRange, evt.UserNo)
 	case AggTypeWeekly:
-		return calcWeeklyCashflow(rail, db, t, evt.AggRange, evt.UserNo)
+		err = calcWeeklyCashflow(rail, db, t, evt.AggRange, evt.UserNo)
 	case AggTypeYearly:
-		return calcYearlyCashflow(rail, db, t, evt.AggRange, evt.UserNo)
+		err = calcYearlyCashflow(rail, db, t, evt.AggRange, evt.UserNo)
 	}
-	return nil
+	if err != nil {
+		return err
+	}
+	if evt.AggType == AggTypeMonthly {
+		if err := markNetWorthStale(db, evt.UserNo, evt.AggRange); err != nil {
+			return err
+		}
+	}
+	return CalcBudgetSpending(rail, db, evt.UserNo, evt.AggType, evt.AggRange)
 }
 
 func calcYearlyCashflow(rail miso.Rail, db *gorm.DB, t time.Time, aggRange string, userNo string) error {
@@ -189,7 +244,7 @@ func calcCashflowSum(rail miso.Rail, db *gorm.DB, tr TimeRange, userNo string) (
 	var res []CashflowSum
 	err := db.Raw(`
 	SELECT SUM(case when direction = 'IN' then amount else (-1 * amount) end) amount_sum, currency
-	FROM cashflow WHERE user_no = ? and trans_time between ? and ? and deleted = 0
+	FROM cashflow WHERE user_no = ? and trans_time between ? and ? and transfer_no = '' and stat_excluded = 0 and deleted = 0
 	GROUP BY currency
 	`,
 		userNo, tr.Start, tr.End).
@@ -202,26 +257,33 @@ func calcCashflowSum(rail miso.Rail, db *gorm.DB, tr TimeRange, userNo string) (
 }
 
 func updateCashflowStat(rail miso.Rail, db *gorm.DB, stats []CashflowSum, aggType string, aggRange string, userNo string) error {
-	for _, st := range stats {
-		var id int64
-		err := db.Raw(`SELECT id FROM cashflow_statistics WHERE user_no = ? and agg_type = ? and agg_range = ? and currency = ?`,
-			userNo, aggType, aggRange, st.Currency).Scan(&id).Error
-		if err != nil {
-			return fmt.Errorf("failed to query cashflow_statistics, %w", err)
-		}
-		if id > 0 {
-			err := db.Exec(`UPDATE cashflow_statistics SET agg_value = ? WHERE id = ?`,
-				st.AmountSum, id).Error
-			if err != nil {
-				return fmt.Errorf("failed to update cashflow_statistics, id: %v, %w", id, err)
-			}
-		} else {
-			err := db.Exec(`INSERT INTO cashflow_statistics (user_no, agg_type, agg_range, currency, agg_value) VALUES (?,?,?,?,?)`,
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, st := range stats {
+			err := tx.Exec(`INSERT INTO cashflow_statistics (user_no, agg_type, agg_range, currency, agg_value) VALUES (?,?,?,?,?)
+				ON DUPLICATE KEY UPDATE agg_value = VALUES(agg_value)`,
 				userNo, aggType, aggRange, st.Currency, st.AmountSum).Error
 			if err != nil {
 				return fmt.Errorf("failed to save cashflow_statistics, %w", err)
 			}
 		}
+		return removeStaleCashflowStat(rail, tx, stats, aggType, aggRange, userNo)
+	})
+}
+
+// Remove statistics of currencies that no longer have any cashflow in the aggregation range.
+func removeStaleCashflowStat(rail miso.Rail, db *gorm.DB, stats []CashflowSum, aggType string, aggRange string, userNo string) error {
+	sql := `DELETE FROM cashflow_statistics WHERE user_no = ? and agg_type = ? and agg_range = ?`
+	args := []any{userNo, aggType, aggRange}
+	if len(stats) > 0 {
+		sql += ` and currency NOT IN ?`
+		args = append(args, util.MapTo(stats, func(st CashflowSum) string { return st.Currency }))
+	}
+	t := db.Exec(sql, args...)
+	if t.Error != nil {
+		return fmt.Errorf("failed to remove stale cashflow_statistics, %w", t.Error)
+	}
+	if t.RowsAffected > 0 {
+		rail.Infof("Removed %d stale cashflow_statistics, userNo: %v, aggType: %v, aggRange: %v", t.RowsAffected, userNo, aggType, aggRange)
 	}
 	return nil
 }
@@ -231,6 +293,8 @@ type ApiListStatisticsReq struct {
 	AggType  string      `desc:"Aggregation Type." valid:"member:YEARLY|MONTHLY|WEEKLY"`
 	AggRange string      `desc:"Aggregation Range. The corresponding year (YYYY), month (YYYYMM), sunday of the week (YYYYMMDD)."`
 	Currency string      `desc:"Currency"`
+
+	BaseCurrency string `desc:"Base Currency. If provided, statistics of all currencies are converted into base currency"`
 }
 
 type ApiListStatisticsRes struct {
@@ -249,6 +313,10 @@ func ListCashflowStatistics(rail miso.Rail, db *gorm.DB, req ApiListStatisticsRe
 		}
 	}
 
+	if req.BaseCurrency != "" {
+		return listConvertedCashflowStatistics(rail, db, req, user)
+	}
+
 	return miso.NewPageQuery[ApiListStatisticsRes]().
 		WithPage(req.Paging).
 		WithBaseQuery(func(tx *gorm.DB) *gorm.DB {
@@ -274,11 +342,69 @@ func ListCashflowStatistics(rail miso.Rail, db *gorm.DB, req ApiListStatisticsRe
 		Exec(rail, db)
 }
 
+func listConvertedCashflowStatistics(rail miso.Rail, db *gorm.DB, req ApiListStatisticsReq, user common.User) (miso.PageRes[ApiListStatisticsRes], error) {
+	res, err := miso.NewPageQuery[ApiListStatisticsRes]().
+		WithPage(req.Paging).
+		WithBaseQuery(func(tx *gorm.DB) *gorm.DB {
+			sub := tx.Table(`cashflow_statistics`).
+				Select("DISTINCT agg_type, agg_range").
+				Where(`user_no = ?`, user.UserNo).
+				Where(`agg_type = ?`, req.AggType)
+			if req.AggRange != "" {
+				sub = sub.Where("agg_range = ?", req.AggRange)
+			}
+			return tx.Table("(?) s", sub)
+		}).
+		WithSelectQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Select("agg_type, agg_range").Order("agg_range desc")
+		}).
+		Exec(rail, db)
+	if err != nil {
+		return res, err
+	}
+
+	if len(res.Payload) < 1 {
+		return res, nil
+	}
+
+	// cashflows of the whole page are converted at once, instead of querying for each of the ranges
+	var tr TimeRange
+	for i, p := range res.Payload {
+		t, err := ParseAggRangeTime(p.AggType, p.AggRange)
+		if err != nil {
+			return res, err
+		}
+		ptr := aggTimeRange(p.AggType, t.ToTime())
+		if i == 0 || ptr.Start.Before(tr.Start) {
+			tr.Start = ptr.Start
+		}
+		if i == 0 || ptr.End.After(tr.End) {
+			tr.End = ptr.End
+		}
+	}
+	sums, err := calcConvertedCashflowSum(rail, db, tr, req.AggType, req.BaseCurrency, user.UserNo)
+	if err != nil {
+		return res, err
+	}
+
+	for i, p := range res.Payload {
+		v := "0"
+		if s, ok := sums[p.AggRange]; ok {
+			v = s.String()
+		}
+		res.Payload[i].AggValue = money.UnitFmt(v, req.BaseCurrency)
+		res.Payload[i].Currency = req.BaseCurrency
+	}
+	return res, nil
+}
+
 type ApiPlotStatisticsReq struct {
 	StartTime util.ETime `desc:"Start time"`
 	EndTime   util.ETime `desc:"End time"`
 	AggType   string     `desc:"Aggregation Type." valid:"member:YEARLY|MONTHLY|WEEKLY"`
 	Currency  string     `desc:"Currency"`
+
+	BaseCurrency string `desc:"Base Currency. If provided, cashflows of all currencies are converted into base currency"`
 }
 
 type ApiPlotStatisticsRes struct {
@@ -300,11 +426,18 @@ func PlotCashflowStatistics(rail miso.Rail, db *gorm.DB, req ApiPlotStatisticsRe
 		pad = "0101"
 	}
 
-	err := db.Raw(`
+	var err error
+	currency := req.Currency
+	if req.BaseCurrency != "" {
+		currency = req.BaseCurrency
+		res, err = plotConvertedCashflowStatistics(rail, db, req, user)
+	} else {
+		err = db.Raw(`
 			SELECT agg_range, agg_value FROM cashflow_statistics
 			WHERE user_no = ? AND agg_type = ? AND currency = ?
 			AND str_to_date(concat(agg_range, ?), '%Y%m%d') BETWEEN ? AND ?`,
-		user.UserNo, req.AggType, req.Currency, pad, req.StartTime, req.EndTime).Scan(&res).Error
+			user.UserNo, req.AggType, req.Currency, pad, req.StartTime, req.EndTime).Scan(&res).Error
+	}
 	if err == nil {
 		if res == nil {
 			res = []ApiPlotStatisticsRes{}
@@ -313,37 +446,75 @@ func PlotCashflowStatistics(rail miso.Rail, db *gorm.DB, req ApiPlotStatisticsRe
 		for _, r := range res {
 			set.Add(r.AggRange)
 		}
-		start := req.StartTime
-		for start.Before(req.EndTime) {
-			var next string
-			switch req.AggType {
-			case AggTypeYearly:
-				next = start.Format(RangeFormatMap[AggTypeYearly])
-			case AggTypeMonthly:
-				next = start.Format(RangeFormatMap[AggTypeMonthly])
-			case AggTypeWeekly:
-				sun := start.AddDate(0, 0, -(int(start.Weekday()) - int(time.Sunday)))
-				if !sun.Before(start) {
-					next = start.Format(RangeFormatMap[AggTypeWeekly])
-				} else {
-					start = sun
-				}
-			}
+		for _, rng := range missingAggRanges(req.AggType, req.StartTime, req.EndTime, set) {
+			res = append(res, ApiPlotStatisticsRes{AggRange: rng, AggValue: "0"})
+		}
+		for i := range res {
+			res[i].AggValue = money.UnitFmt(res[i].AggValue, currency)
+		}
+		sort.Slice(res, func(i, j int) bool { return strings.Compare(res[i].AggRange, res[j].AggRange) < 0 })
+	}
+	return res, err
+}
 
-			if next != "" && set.Add(next) {
-				res = append(res, ApiPlotStatisticsRes{AggRange: next, AggValue: "0"})
+// Find aggregation ranges between start and end that are not in the set, these are zero-filled in plotted series.
+func missingAggRanges(aggType string, start util.ETime, end util.ETime, set util.Set[string]) []string {
+	missing := []string{}
+	for start.Before(end) {
+		var next string
+		switch aggType {
+		case AggTypeYearly:
+			next = start.Format(RangeFormatMap[AggTypeYearly])
+		case AggTypeMonthly:
+			next = start.Format(RangeFormatMap[AggTypeMonthly])
+		case AggTypeWeekly:
+			sun := start.AddDate(0, 0, -(int(start.Weekday()) - int(time.Sunday)))
+			if !sun.Before(start) {
+				next = start.Format(RangeFormatMap[AggTypeWeekly])
+			} else {
+				start = sun
 			}
+		}
 
-			switch req.AggType {
-			case AggTypeYearly:
-				start = start.AddDate(1, 0, 0)
-			case AggTypeMonthly:
-				start = start.AddDate(0, 1, 0)
-			case AggTypeWeekly:
-				start = start.AddDate(0, 0, 7)
-			}
+		if next != "" && set.Add(next) {
+			missing = append(missing, next)
+		}
+
+		switch aggType {
+		case AggTypeYearly:
+			start = start.AddDate(1, 0, 0)
+		case AggTypeMonthly:
+			start = start.AddDate(0, 1, 0)
+		case AggTypeWeekly:
+			start = start.AddDate(0, 0, 7)
 		}
-		sort.Slice(res, func(i, j int) bool { return strings.Compare(res[i].AggRange, res[j].AggRange) < 0 })
 	}
-	return res, err
+	return missing
+}
+
+func plotConvertedCashflowStatistics(rail miso.Rail, db *gorm.DB, req ApiPlotStatisticsReq, user common.User) ([]ApiPlotStatisticsRes, error) {
+	start := req.StartTime.ToTime()
+	endRng, err := ParseAggRangeTime(req.AggType, aggRangeOf(req.AggType, req.EndTime.ToTime()))
+	if err != nil {
+		return nil, err
+	}
+	tr := TimeRange{Start: start, End: aggTimeRange(req.AggType, endRng.ToTime()).End}
+	sums, err := calcConvertedCashflowSum(rail, db, tr, req.AggType, req.BaseCurrency, user.UserNo)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]ApiPlotStatisticsRes, 0, len(sums))
+	for rng, v := range sums {
+		// only those aggregation ranges that start within the time range are included
+		rt, err := ParseAggRangeTime(req.AggType, rng)
+		if err != nil {
+			return nil, err
+		}
+		if rt.Before(req.StartTime) {
+			continue
+		}
+		res = append(res, ApiPlotStatisticsRes{AggRange: rng, AggValue: v.String()})
+	}
+	return res, nil
 }
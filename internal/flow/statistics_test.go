@@ -146,3 +146,106 @@ func TestPlotCashflowStatistics(t *testing.T) {
 		t.Logf("ta: %v, plots: %+v", ta, plots)
 	}
 }
+
+func TestUpdateCashflowStatRemoveStale(t *testing.T) {
+	rail := miso.EmptyRail()
+	if err := miso.LoadConfigFromFile("../../conf.yml", rail); err != nil {
+		t.Fatal(err)
+	}
+	miso.SetLogLevel("debug")
+	err := miso.InitMySQLFromProp(rail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userNo := "UE1049787455160320075953"
+	db := miso.GetMySQL()
+	err = updateCashflowStat(rail, db, []CashflowSum{{Currency: "CNY", AmountSum: "1"}, {Currency: "USD", AmountSum: "2"}}, AggTypeMonthly, "199001", userNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = updateCashflowStat(rail, db, []CashflowSum{{Currency: "CNY", AmountSum: "3"}}, AggTypeMonthly, "199001", userNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ccy []string
+	err = db.Raw(`SELECT currency FROM cashflow_statistics WHERE user_no = ? and agg_type = ? and agg_range = ?`,
+		userNo, AggTypeMonthly, "199001").Scan(&ccy).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ccy) != 1 || ccy[0] != "CNY" {
+		t.Fatalf("expected only CNY, actual: %v", ccy)
+	}
+
+	err = updateCashflowStat(rail, db, nil, AggTypeMonthly, "199001", userNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccy = nil
+	err = db.Raw(`SELECT currency FROM cashflow_statistics WHERE user_no = ? and agg_type = ? and agg_range = ?`,
+		userNo, AggTypeMonthly, "199001").Scan(&ccy).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ccy) != 0 {
+		t.Fatalf("expected no statistics, actual: %v", ccy)
+	}
+}
+
+func TestAggTimeRange(t *testing.T) {
+	tab := [][]string{
+		{AggTypeYearly, "2024", "2024-01-01 00:00:00", "2024-12-31 23:59:59"},
+		{AggTypeMonthly, "202402", "2024-02-01 00:00:00", "2024-02-29 23:59:59"},
+		{AggTypeMonthly, "202403", "2024-03-01 00:00:00", "2024-03-31 23:59:59"},
+		{AggTypeWeekly, "20240630", "2024-06-30 00:00:00", "2024-07-06 23:59:59"},
+	}
+	for _, r := range tab {
+		ti, err := ParseAggRangeTime(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := aggTimeRange(r[0], ti.ToTime())
+		if s := tr.Start.Format("2006-01-02 15:04:05"); s != r[2] {
+			t.Fatalf("%v %v, expected start: %v, actual: %v", r[0], r[1], r[2], s)
+		}
+		if e := tr.End.Format("2006-01-02 15:04:05"); e != r[3] {
+			t.Fatalf("%v %v, expected end: %v, actual: %v", r[0], r[1], r[3], e)
+		}
+		if rng := aggRangeOf(r[0], tr.End); rng != r[1] {
+			t.Fatalf("%v, expected range: %v, actual: %v", r[0], r[1], rng)
+		}
+	}
+}
+
+func TestAggRangesBetween(t *testing.T) {
+	start, _ := util.ParseClassicDateTime("2024-01-15 00:00:00", time.Local)
+	end, _ := util.ParseClassicDateTime("2024-03-02 00:00:00", time.Local)
+	tab := map[string]int{AggTypeYearly: 1, AggTypeMonthly: 3, AggTypeWeekly: 7}
+	for typ, n := range tab {
+		rng := aggRangesBetween(typ, start, end)
+		if len(rng) != n {
+			t.Fatalf("%v, expected %d ranges, actual: %v", typ, n, rng)
+		}
+		t.Logf("%v: %v", typ, rng)
+	}
+}
+
+func TestMissingAggRanges(t *testing.T) {
+	start := util.ToETime(time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local))
+	end := util.ToETime(time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local))
+	set := util.NewSet[string]()
+	set.Add("202402")
+
+	missing := missingAggRanges(AggTypeMonthly, start, end, set)
+	exp := []string{"202401", "202403", "202404"}
+	if len(missing) != len(exp) {
+		t.Fatalf("missing: %v", missing)
+	}
+	for i, m := range missing {
+		if m != exp[i] {
+			t.Fatalf("missing: %v, expected: %v", missing, exp)
+		}
+	}
+}
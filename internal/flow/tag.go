@@ -0,0 +1,86 @@
+package flow
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+type ApiTagCashflowReq struct {
+	Category string   `desc:"Category Code" valid:"notEmpty"`
+	TransId  string   `desc:"Transaction ID" valid:"notEmpty"`
+	Tags     []string `desc:"Tags" valid:"notEmpty"`
+}
+
+func TagCashflow(rail miso.Rail, db *gorm.DB, req ApiTagCashflowReq, user common.User) error {
+	var n int
+	err := db.Raw(`SELECT COUNT(*) FROM cashflow WHERE user_no = ? AND category = ? AND trans_id = ? AND deleted = 0`,
+		user.UserNo, req.Category, req.TransId).Scan(&n).Error
+	if err != nil {
+		return fmt.Errorf("failed to query cashflow, %w", err)
+	}
+	if n < 1 {
+		return miso.NewErrf("Cashflow not found")
+	}
+
+	for _, tag := range normalizeTags(req.Tags) {
+		err := db.Exec(`INSERT IGNORE INTO cashflow_tag (user_no, category, trans_id, tag) VALUES (?,?,?,?)`,
+			user.UserNo, req.Category, req.TransId, tag).Error
+		if err != nil {
+			return fmt.Errorf("failed to save cashflow_tag, %w", err)
+		}
+	}
+	return nil
+}
+
+func UntagCashflow(rail miso.Rail, db *gorm.DB, req ApiTagCashflowReq, user common.User) error {
+	err := db.Exec(`DELETE FROM cashflow_tag WHERE user_no = ? AND category = ? AND trans_id = ? AND tag IN ?`,
+		user.UserNo, req.Category, req.TransId, normalizeTags(req.Tags)).Error
+	if err != nil {
+		return fmt.Errorf("failed to delete cashflow_tag, %w", err)
+	}
+	return nil
+}
+
+func ListTags(rail miso.Rail, db *gorm.DB, user common.User) ([]string, error) {
+	var tags []string
+	return tags, db.Raw(`SELECT DISTINCT tag FROM cashflow_tag WHERE user_no = ? ORDER BY tag`, user.UserNo).Scan(&tags).Error
+}
+
+func normalizeTags(tags []string) []string {
+	tags = util.MapTo(tags, func(t string) string { return util.MaxLenStr(strings.TrimSpace(t), 32) })
+	return util.Filter(util.Distinct(tags), func(t string) bool { return t != "" })
+}
+
+type cashflowTag struct {
+	Category string
+	TransId  string
+	Tag      string
+}
+
+func cashflowTagKey(category string, transId string) string {
+	return category + ":" + transId
+}
+
+// Find tags of cashflows, the returned map is keyed by cashflowTagKey(...).
+func findCashflowTags(db *gorm.DB, userNo string, transIds []string) (map[string][]string, error) {
+	tags := map[string][]string{}
+	if len(transIds) < 1 {
+		return tags, nil
+	}
+	var l []cashflowTag
+	err := db.Raw(`SELECT category, trans_id, tag FROM cashflow_tag WHERE user_no = ? AND trans_id IN ? ORDER BY id`,
+		userNo, transIds).Scan(&l).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cashflow_tag, %w", err)
+	}
+	for _, t := range l {
+		k := cashflowTagKey(t.Category, t.TransId)
+		tags[k] = append(tags[k], t.Tag)
+	}
+	return tags, nil
+}
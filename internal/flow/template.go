@@ -0,0 +1,296 @@
+package flow
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+)
+
+const (
+	RecurringCategory = "RECURRING"
+
+	// max number of cashflows materialized for each template in one run
+	maxTemplateCatchUp = 400
+)
+
+type ApiSaveCashflowTemplateReq struct {
+	TemplateNo    string      `desc:"Template No. A new template is created if it's empty"`
+	Name          string      `desc:"Template Name" valid:"notEmpty,maxLen:64"`
+	Direction     string      `desc:"Flow Direction: IN / OUT" valid:"member:IN|OUT"`
+	Amount        string      `desc:"Amount" valid:"notEmpty"`
+	Currency      string      `desc:"Currency" valid:"notEmpty"`
+	Counterparty  string      `desc:"Counterparty of the transaction" valid:"maxLen:255"`
+	PaymentMethod string      `desc:"Payment Method" valid:"maxLen:32"`
+	Category      string      `desc:"Category Code of the cashflows, by default it's RECURRING" valid:"maxLen:32"`
+	Remark        string      `desc:"Remark" valid:"maxLen:255"`
+	Schedule      string      `desc:"Cron expression (minute hour day-of-month month day-of-week), e.g., '0 9 1 * *' for 9am on the first day of each month" valid:"notEmpty"`
+	StartTime     *util.ETime `desc:"Cashflows are only created after the start time, by default it's current time, or the previous due time when the template is updated"`
+	EndTime       *util.ETime `desc:"Cashflows are no longer created after the end time"`
+	Enabled       bool        `desc:"Whether the template is enabled"`
+}
+
+type ApiCashflowTemplateNoReq struct {
+	TemplateNo string `desc:"Template No" valid:"notEmpty"`
+}
+
+type CashflowTemplate struct {
+	TemplateNo    string
+	UserNo        string
+	Name          string
+	Direction     string
+	Amount        string
+	Currency      string
+	Counterparty  string
+	PaymentMethod string
+	Category      string
+	Remark        string
+	Schedule      string
+	EndTime       *util.ETime
+	NextDueTime   *util.ETime
+	CreatedBy     string
+}
+
+func parseTemplateSchedule(schedule string) (cron.Schedule, error) {
+	sched, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return nil, miso.NewErrf("Invalid schedule '%v'", schedule).WithInternalMsg("%v", err)
+	}
+	return sched, nil
+}
+
+func SaveCashflowTemplate(rail miso.Rail, db *gorm.DB, req ApiSaveCashflowTemplateReq, user common.User) (string, error) {
+	if money.NewAmt(req.Amount).Cmp(money.Zero()) <= 0 {
+		return "", miso.NewErrf("Invalid amount '%v'", req.Amount)
+	}
+	sched, err := parseTemplateSchedule(req.Schedule)
+	if err != nil {
+		return "", err
+	}
+	if req.Category == "" {
+		req.Category = RecurringCategory
+	}
+
+	var next util.ETime
+	if req.TemplateNo != "" {
+		// MySQL reports 0 affected rows if nothing is changed, existence is checked beforehand
+		prev, err := findCashflowTemplate(db, req.TemplateNo, user.UserNo)
+		if err != nil {
+			return "", err
+		}
+		next = util.ToETime(templateNextDue(sched, req.StartTime, prev.NextDueTime, time.Now()))
+		t := db.Exec(`UPDATE cashflow_template SET name = ?, direction = ?, amount = ?, currency = ?, counterparty = ?, payment_method = ?,
+			category = ?, remark = ?, schedule = ?, end_time = ?, next_due_time = ?, enabled = ?, updated_by = ?
+			WHERE template_no = ? AND user_no = ? AND deleted = 0`,
+			req.Name, req.Direction, req.Amount, req.Currency, req.Counterparty, req.PaymentMethod, req.Category, req.Remark,
+			req.Schedule, req.EndTime, next, req.Enabled, user.Username, req.TemplateNo, user.UserNo)
+		if t.Error != nil {
+			return "", fmt.Errorf("failed to update cashflow_template, %w", t.Error)
+		}
+	} else {
+		next = util.ToETime(templateNextDue(sched, req.StartTime, nil, time.Now()))
+		req.TemplateNo = util.GenIdP("TPL_")
+		err := db.Exec(`INSERT INTO cashflow_template (template_no, user_no, name, direction, amount, currency, counterparty, payment_method,
+			category, remark, schedule, end_time, next_due_time, enabled, created_by) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+			req.TemplateNo, user.UserNo, req.Name, req.Direction, req.Amount, req.Currency, req.Counterparty, req.PaymentMethod,
+			req.Category, req.Remark, req.Schedule, req.EndTime, next, req.Enabled, user.Username).Error
+		if err != nil {
+			return "", fmt.Errorf("failed to save cashflow_template, %w", err)
+		}
+	}
+	rail.Infof("Cashflow template %v saved by %v, next due time: %v", req.TemplateNo, user.Username, next)
+	return req.TemplateNo, nil
+}
+
+func findCashflowTemplate(db *gorm.DB, templateNo string, userNo string) (CashflowTemplate, error) {
+	var t CashflowTemplate
+	r := db.Raw(`SELECT template_no, user_no, name, direction, amount, currency, counterparty, payment_method, category, remark,
+		schedule, end_time, next_due_time, created_by
+		FROM cashflow_template WHERE template_no = ? AND user_no = ? AND deleted = 0`, templateNo, userNo).
+		Scan(&t)
+	if r.Error != nil {
+		return t, fmt.Errorf("failed to query cashflow_template, %w", r.Error)
+	}
+	if r.RowsAffected < 1 {
+		return t, miso.NewErrf("Template not found")
+	}
+	return t, nil
+}
+
+func DeleteCashflowTemplate(rail miso.Rail, db *gorm.DB, req ApiCashflowTemplateNoReq, user common.User) error {
+	err := db.Exec(`UPDATE cashflow_template SET deleted = 1, updated_by = ? WHERE template_no = ? AND user_no = ?`,
+		user.Username, req.TemplateNo, user.UserNo).Error
+	if err != nil {
+		return fmt.Errorf("failed to delete cashflow_template, %w", err)
+	}
+	return nil
+}
+
+type ApiListCashflowTemplateReq struct {
+	Paging miso.Paging `desc:"Paging"`
+}
+
+type ApiListCashflowTemplateRes struct {
+	TemplateNo    string      `desc:"Template No"`
+	Name          string      `desc:"Template Name"`
+	Direction     string      `desc:"Flow Direction: IN / OUT"`
+	Amount        string      `desc:"Amount"`
+	Currency      string      `desc:"Currency"`
+	Counterparty  string      `desc:"Counterparty of the transaction"`
+	PaymentMethod string      `desc:"Payment Method"`
+	Category      string      `desc:"Category Code"`
+	Remark        string      `desc:"Remark"`
+	Schedule      string      `desc:"Cron expression"`
+	EndTime       *util.ETime `desc:"Cashflows are no longer created after the end time"`
+	NextDueTime   *util.ETime `desc:"Next due time"`
+	Enabled       bool        `desc:"Whether the template is enabled"`
+	CreatedAt     util.ETime  `desc:"Create Time"`
+}
+
+func ListCashflowTemplates(rail miso.Rail, db *gorm.DB, req ApiListCashflowTemplateReq, user common.User) (miso.PageRes[ApiListCashflowTemplateRes], error) {
+	return miso.NewPageQuery[ApiListCashflowTemplateRes]().
+		WithPage(req.Paging).
+		WithBaseQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Table(`cashflow_template`).
+				Where("user_no = ?", user.UserNo).
+				Where("deleted = 0")
+		}).
+		WithSelectQuery(func(tx *gorm.DB) *gorm.DB {
+			return tx.Select("template_no", "name", "direction", "amount", "currency", "counterparty", "payment_method",
+				"category", "remark", "schedule", "end_time", "next_due_time", "enabled", "created_at").
+				Order("id desc")
+		}).
+		ForEach(func(t ApiListCashflowTemplateRes) ApiListCashflowTemplateRes {
+			t.Amount = money.UnitFmt(t.Amount, t.Currency)
+			return t
+		}).
+		Exec(rail, db)
+}
+
+// Next due time of the template.
+//
+// By default it starts from current time, but when an existing template is edited without StartTime, it continues from the
+// previous due time, so that occurrences not yet materialized are not skipped.
+func templateNextDue(sched cron.Schedule, startTime *util.ETime, prevDue *util.ETime, now time.Time) time.Time {
+	start := now
+	if startTime != nil {
+		start = startTime.ToTime()
+	} else if prevDue != nil && prevDue.ToTime().Before(now) {
+		start = prevDue.ToTime()
+	}
+	return sched.Next(start.Add(-time.Second))
+}
+
+// TransId of the cashflow created from template, it's derived from the due time, so that the same
+// occurrence is never saved twice.
+func templateTransId(templateNo string, due time.Time) string {
+	return templateNo + "_" + due.Format("200601021504")
+}
+
+// List due times of the template up to the given time.
+func templateDueTimes(sched cron.Schedule, next time.Time, end *time.Time, now time.Time) []time.Time {
+	due := []time.Time{}
+	for !next.After(now) && len(due) < maxTemplateCatchUp {
+		if end != nil && next.After(*end) {
+			break
+		}
+		due = append(due, next)
+		next = sched.Next(next)
+	}
+	return due
+}
+
+func ScheduleCashflowTemplateJob() error {
+	return miso.ScheduleDistributedTask(miso.Job{
+		Name:                   "CreateCashflowsFromTemplatesJob",
+		Cron:                   "*/10 * * * *",
+		Run:                    func(rail miso.Rail) error { return CreateDueTemplateCashflows(rail, miso.GetMySQL()) },
+		TriggeredOnBoostrapped: true,
+	})
+}
+
+// Create cashflows for all templates that are due, missed occurrences are created as well.
+func CreateDueTemplateCashflows(rail miso.Rail, db *gorm.DB) error {
+	now := time.Now()
+	var templates []CashflowTemplate
+	err := db.Raw(`SELECT template_no, user_no, name, direction, amount, currency, counterparty, payment_method, category, remark,
+		schedule, end_time, next_due_time, created_by
+		FROM cashflow_template WHERE enabled = 1 AND deleted = 0 AND next_due_time <= ?`, now).
+		Scan(&templates).Error
+	if err != nil {
+		return fmt.Errorf("failed to list due cashflow_template, %w", err)
+	}
+
+	for _, t := range templates {
+		if err := createTemplateCashflows(rail, db, t, now); err != nil {
+			rail.Errorf("Failed to create cashflows for template %v, %v", t.TemplateNo, err)
+		}
+	}
+	return nil
+}
+
+func createTemplateCashflows(rail miso.Rail, db *gorm.DB, t CashflowTemplate, now time.Time) error {
+	sched, err := parseTemplateSchedule(t.Schedule)
+	if err != nil {
+		return err
+	}
+	if t.NextDueTime == nil {
+		return nil
+	}
+	var end *time.Time
+	if t.EndTime != nil {
+		et := t.EndTime.ToTime()
+		end = &et
+	}
+
+	due := templateDueTimes(sched, t.NextDueTime.ToTime(), end, now)
+	if len(due) > 0 {
+		records := util.MapTo(due, func(d time.Time) NewCashflow {
+			return NewCashflow{
+				Direction:     t.Direction,
+				TransTime:     util.ToETime(d),
+				TransId:       templateTransId(t.TemplateNo, d),
+				PaymentMethod: t.PaymentMethod,
+				Counterparty:  t.Counterparty,
+				Amount:        t.Amount,
+				Currency:      t.Currency,
+				Extra:         "{}",
+				Remark:        t.Remark,
+			}
+		})
+		saved, err := SaveCashflows(rail, db, SaveCashflowParams{
+			Cashflows: records,
+			Category:  t.Category,
+			User:      common.User{UserNo: t.UserNo, Username: t.CreatedBy},
+		})
+		if err != nil {
+			return err
+		}
+		rail.Infof("Created %d cashflows from template %v", len(saved), t.TemplateNo)
+
+		changes := util.MapTo(saved, func(nc NewCashflow) CashflowChange { return CashflowChange{TransTime: nc.TransTime} })
+		if err := OnCashflowChanged(rail, changes, t.UserNo); err != nil {
+			rail.Errorf("Failed to update cashflow statistics for template %v, userNo: %v, %v", t.TemplateNo, t.UserNo, err)
+		}
+	}
+
+	var next *util.ETime
+	nt := t.NextDueTime.ToTime()
+	if len(due) > 0 {
+		nt = sched.Next(due[len(due)-1])
+	}
+	if end == nil || !nt.After(*end) {
+		v := util.ToETime(nt)
+		next = &v
+	}
+	err = db.Exec(`UPDATE cashflow_template SET next_due_time = ? WHERE template_no = ?`, next, t.TemplateNo).Error
+	if err != nil {
+		return fmt.Errorf("failed to update cashflow_template next_due_time, %w", err)
+	}
+	return nil
+}
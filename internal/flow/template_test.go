@@ -0,0 +1,72 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/util"
+)
+
+func TestTemplateDueTimes(t *testing.T) {
+	sched, err := parseTemplateSchedule("0 9 1 * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := time.Date(2024, 1, 1, 9, 0, 0, 0, time.Local)
+	now := time.Date(2024, 4, 15, 0, 0, 0, 0, time.Local)
+
+	due := templateDueTimes(sched, next, nil, now)
+	if len(due) != 4 {
+		t.Fatalf("due: %v", due)
+	}
+	if due[3].Format("2006-01-02 15:04") != "2024-04-01 09:00" {
+		t.Fatalf("last due: %v", due[3])
+	}
+	if templateTransId("TPL_1", due[3]) != "TPL_1_202404010900" {
+		t.Fatalf("trans id: %v", templateTransId("TPL_1", due[3]))
+	}
+
+	end := time.Date(2024, 2, 15, 0, 0, 0, 0, time.Local)
+	due = templateDueTimes(sched, next, &end, now)
+	if len(due) != 2 {
+		t.Fatalf("due with end time: %v", due)
+	}
+
+	due = templateDueTimes(sched, now.AddDate(0, 0, 1), nil, now)
+	if len(due) != 0 {
+		t.Fatalf("not yet due: %v", due)
+	}
+
+	if _, err := parseTemplateSchedule("every month"); err == nil {
+		t.Fatal("invalid schedule should be rejected")
+	}
+}
+
+func TestTemplateNextDue(t *testing.T) {
+	sched, err := parseTemplateSchedule("0 9 1 * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 4, 15, 0, 0, 0, 0, time.Local)
+	layout := "2006-01-02 15:04"
+
+	// edited without start time, pending occurrences since the previous due time are kept
+	prev := util.ToETime(time.Date(2024, 2, 1, 9, 0, 0, 0, time.Local))
+	if n := templateNextDue(sched, nil, &prev, now); n.Format(layout) != "2024-02-01 09:00" {
+		t.Fatalf("continue from previous due: %v", n)
+	}
+
+	future := util.ToETime(time.Date(2024, 5, 1, 9, 0, 0, 0, time.Local))
+	if n := templateNextDue(sched, nil, &future, now); n.Format(layout) != "2024-05-01 09:00" {
+		t.Fatalf("previous due in future: %v", n)
+	}
+
+	st := util.ToETime(time.Date(2024, 1, 1, 9, 0, 0, 0, time.Local))
+	if n := templateNextDue(sched, &st, &prev, now); n.Format(layout) != "2024-01-01 09:00" {
+		t.Fatalf("explicit start: %v", n)
+	}
+
+	if n := templateNextDue(sched, nil, nil, now); n.Format(layout) != "2024-05-01 09:00" {
+		t.Fatalf("new template: %v", n)
+	}
+}
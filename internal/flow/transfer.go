@@ -0,0 +1,247 @@
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/curtisnewbie/miso/middleware/money"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultTransferMaxHours = 72
+	maxTransferCandidates   = 500
+)
+
+type ApiCashflowRef struct {
+	Category string `desc:"Category Code" valid:"notEmpty"`
+	TransId  string `desc:"Transaction ID" valid:"notEmpty"`
+}
+
+type ApiLinkTransferReq struct {
+	Out ApiCashflowRef `desc:"The OUT cashflow of the transfer"`
+	In  ApiCashflowRef `desc:"The IN cashflow of the transfer"`
+}
+
+type ApiTransferNoReq struct {
+	TransferNo string `desc:"Transfer No" valid:"notEmpty"`
+}
+
+type transferCashflow struct {
+	Direction  string
+	TransTime  util.ETime
+	TransferNo string
+	Amount     string
+	Currency   string
+}
+
+// Link an OUT and an IN cashflow as a transfer pair, transfers are excluded from income/expense statistics.
+func LinkTransfer(rail miso.Rail, db *gorm.DB, req ApiLinkTransferReq, user common.User) (string, error) {
+	findFlow := func(ref ApiCashflowRef, direction string) (transferCashflow, error) {
+		var cf transferCashflow
+		t := db.Raw(`SELECT direction, trans_time, transfer_no, amount, currency FROM cashflow
+			WHERE user_no = ? AND category = ? AND trans_id = ? AND deleted = 0`,
+			user.UserNo, ref.Category, ref.TransId).
+			Scan(&cf)
+		if t.Error != nil {
+			return cf, fmt.Errorf("failed to query cashflow, %w", t.Error)
+		}
+		if t.RowsAffected < 1 {
+			return cf, miso.NewErrf("Cashflow not found")
+		}
+		if cf.Direction != direction {
+			return cf, miso.NewErrf("Cashflow %v is not %v", ref.TransId, direction)
+		}
+		if cf.TransferNo != "" {
+			return cf, miso.NewErrf("Cashflow %v is already linked to transfer %v", ref.TransId, cf.TransferNo)
+		}
+		return cf, nil
+	}
+
+	lock := userCashflowLock(rail, user.UserNo)
+	if err := lock.Lock(); err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+
+	out, err := findFlow(req.Out, DirectionOut)
+	if err != nil {
+		return "", err
+	}
+	in, err := findFlow(req.In, DirectionIn)
+	if err != nil {
+		return "", err
+	}
+	if err := validateTransferPair(out, in); err != nil {
+		return "", err
+	}
+
+	transferNo := util.GenIdP("TRF_")
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, ref := range []ApiCashflowRef{req.Out, req.In} {
+			err := tx.Exec(`UPDATE cashflow SET transfer_no = ?, updated_by = ? WHERE user_no = ? AND category = ? AND trans_id = ? AND deleted = 0`,
+				transferNo, user.Username, user.UserNo, ref.Category, ref.TransId).Error
+			if err != nil {
+				return fmt.Errorf("failed to update cashflow transfer_no, %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	rail.Infof("Linked transfer %v, out: %v, in: %v, by %v", transferNo, req.Out.TransId, req.In.TransId, user.Username)
+
+	changes := []CashflowChange{{TransTime: out.TransTime}, {TransTime: in.TransTime}}
+	if err := OnCashflowChanged(rail, changes, user.UserNo); err != nil {
+		rail.Errorf("Failed to update cashflow statistics for transfer %v, userNo: %v, %v", transferNo, user.UserNo, err)
+	}
+	return transferNo, nil
+}
+
+// Both sides of a transfer must be in opposite directions, and have the same amount and currency.
+func validateTransferPair(out transferCashflow, in transferCashflow) error {
+	if out.Direction != DirectionOut || in.Direction != DirectionIn {
+		return miso.NewErrf("Transfer must consist of an OUT and an IN cashflow")
+	}
+	if out.Currency != in.Currency {
+		return miso.NewErrf("Currency of the transfer doesn't match, out: %v, in: %v", out.Currency, in.Currency)
+	}
+	if money.NewAmt(out.Amount).Cmp(money.NewAmt(in.Amount)) != 0 {
+		return miso.NewErrf("Amount of the transfer doesn't match, out: %v, in: %v",
+			money.UnitFmt(out.Amount, out.Currency), money.UnitFmt(in.Amount, in.Currency))
+	}
+	return nil
+}
+
+func UnlinkTransfer(rail miso.Rail, db *gorm.DB, req ApiTransferNoReq, user common.User) error {
+	var flows []transferCashflow
+	err := db.Raw(`SELECT direction, trans_time, transfer_no FROM cashflow WHERE user_no = ? AND transfer_no = ? AND deleted = 0`,
+		user.UserNo, req.TransferNo).
+		Scan(&flows).Error
+	if err != nil {
+		return fmt.Errorf("failed to query cashflow, %w", err)
+	}
+	if len(flows) < 1 {
+		return miso.NewErrf("Transfer not found")
+	}
+
+	err = db.Exec(`UPDATE cashflow SET transfer_no = '', updated_by = ? WHERE user_no = ? AND transfer_no = ?`,
+		user.Username, user.UserNo, req.TransferNo).Error
+	if err != nil {
+		return fmt.Errorf("failed to update cashflow transfer_no, %w", err)
+	}
+
+	changes := util.MapTo(flows, func(f transferCashflow) CashflowChange { return CashflowChange{TransTime: f.TransTime} })
+	if err := OnCashflowChanged(rail, changes, user.UserNo); err != nil {
+		rail.Errorf("Failed to update cashflow statistics for transfer %v, userNo: %v, %v", req.TransferNo, user.UserNo, err)
+	}
+	return nil
+}
+
+type ApiSuggestTransfersReq struct {
+	Since    *util.ETime `desc:"Only cashflows after the time are matched, by default it's three months ago"`
+	MaxHours int         `desc:"Max hours between the OUT and IN cashflow, by default it's 72"`
+}
+
+type ApiTransferSuggestion struct {
+	Out          ApiCashflowRef `desc:"The OUT cashflow of the transfer"`
+	OutTransTime util.ETime     `desc:"Transaction Time of the OUT cashflow"`
+	OutAccountNo string         `desc:"Account No of the OUT cashflow"`
+	In           ApiCashflowRef `desc:"The IN cashflow of the transfer"`
+	InTransTime  util.ETime     `desc:"Transaction Time of the IN cashflow"`
+	InAccountNo  string         `desc:"Account No of the IN cashflow"`
+	Amount       string         `desc:"Amount"`
+	Currency     string         `desc:"Currency"`
+}
+
+type transferCandidate struct {
+	OutCategory  string
+	OutTransId   string
+	OutTransTime util.ETime
+	OutAccountNo string
+	InCategory   string
+	InTransId    string
+	InTransTime  util.ETime
+	InAccountNo  string
+	Amount       string
+	Currency     string
+}
+
+// Suggest transfer pairs: cashflows with the same amount, close time, opposite direction and different accounts.
+//
+// A cashflow not linked to any account can be matched with one that is linked, but at least one of them must be linked
+// so that the accounts are known to be different.
+func SuggestTransfers(rail miso.Rail, db *gorm.DB, req ApiSuggestTransfersReq, user common.User) ([]ApiTransferSuggestion, error) {
+	since := time.Now().AddDate(0, -3, 0)
+	if req.Since != nil {
+		since = req.Since.ToTime()
+	}
+	maxHours := req.MaxHours
+	if maxHours < 1 {
+		maxHours = defaultTransferMaxHours
+	}
+
+	var candidates []transferCandidate
+	err := db.Raw(`
+	SELECT o.category out_category, o.trans_id out_trans_id, o.trans_time out_trans_time, o.account_no out_account_no,
+	i.category in_category, i.trans_id in_trans_id, i.trans_time in_trans_time, i.account_no in_account_no, o.amount, o.currency
+	FROM cashflow o
+	JOIN cashflow i ON i.user_no = o.user_no AND i.direction = ? AND i.currency = o.currency AND i.amount = o.amount
+		AND (i.account_no != '' OR o.account_no != '') AND i.account_no != o.account_no AND i.transfer_no = '' AND i.deleted = 0
+		AND i.trans_time BETWEEN DATE_SUB(o.trans_time, INTERVAL ? HOUR) AND DATE_ADD(o.trans_time, INTERVAL ? HOUR)
+	WHERE o.user_no = ? AND o.direction = ? AND o.transfer_no = '' AND o.deleted = 0 AND o.trans_time >= ?
+	ORDER BY o.trans_time DESC LIMIT ?
+	`,
+		DirectionIn, maxHours, maxHours, user.UserNo, DirectionOut, since, maxTransferCandidates).
+		Scan(&candidates).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query transfer candidates, %w", err)
+	}
+
+	return util.MapTo(pickTransferPairs(candidates), func(c transferCandidate) ApiTransferSuggestion {
+		return ApiTransferSuggestion{
+			Out:          ApiCashflowRef{Category: c.OutCategory, TransId: c.OutTransId},
+			OutTransTime: c.OutTransTime,
+			OutAccountNo: c.OutAccountNo,
+			In:           ApiCashflowRef{Category: c.InCategory, TransId: c.InTransId},
+			InTransTime:  c.InTransTime,
+			InAccountNo:  c.InAccountNo,
+			Amount:       money.UnitFmt(c.Amount, c.Currency),
+			Currency:     c.Currency,
+		}
+	}), nil
+}
+
+// Pick transfer pairs with the closest time first, each cashflow is only paired once.
+func pickTransferPairs(candidates []transferCandidate) []transferCandidate {
+	timeDiff := func(c transferCandidate) time.Duration {
+		d := c.InTransTime.Sub(c.OutTransTime)
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+	sorted := make([]transferCandidate, len(candidates))
+	copy(sorted, candidates)
+	sort.SliceStable(sorted, func(i, j int) bool { return timeDiff(sorted[i]) < timeDiff(sorted[j]) })
+
+	used := util.NewSet[string]()
+	picked := []transferCandidate{}
+	for _, c := range sorted {
+		ok := c.OutCategory + ":" + c.OutTransId
+		ik := c.InCategory + ":" + c.InTransId
+		if used.Has(ok) || used.Has(ik) {
+			continue
+		}
+		used.Add(ok)
+		used.Add(ik)
+		picked = append(picked, c)
+	}
+	sort.SliceStable(picked, func(i, j int) bool { return picked[i].OutTransTime.After(picked[j].OutTransTime) })
+	return picked
+}
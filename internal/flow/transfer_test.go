@@ -0,0 +1,50 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/curtisnewbie/miso/util"
+)
+
+func TestPickTransferPairs(t *testing.T) {
+	base := time.Date(2024, 3, 1, 10, 0, 0, 0, time.Local)
+	at := func(h int) util.ETime { return util.ToETime(base.Add(time.Duration(h) * time.Hour)) }
+
+	candidates := []transferCandidate{
+		{OutCategory: "WECHAT", OutTransId: "o1", OutTransTime: at(0), InCategory: "BANK", InTransId: "i1", InTransTime: at(5)},
+		{OutCategory: "WECHAT", OutTransId: "o1", OutTransTime: at(0), InCategory: "BANK", InTransId: "i2", InTransTime: at(1)},
+		{OutCategory: "WECHAT", OutTransId: "o2", OutTransTime: at(2), InCategory: "BANK", InTransId: "i2", InTransTime: at(1)},
+		{OutCategory: "WECHAT", OutTransId: "o2", OutTransTime: at(2), InCategory: "BANK", InTransId: "i1", InTransTime: at(5)},
+	}
+	picked := pickTransferPairs(candidates)
+	if len(picked) != 2 {
+		t.Fatalf("picked: %+v", picked)
+	}
+	if picked[0].OutTransId != "o2" || picked[0].InTransId != "i1" {
+		t.Fatalf("first pair: %+v", picked[0])
+	}
+	if picked[1].OutTransId != "o1" || picked[1].InTransId != "i2" {
+		t.Fatalf("second pair: %+v", picked[1])
+	}
+}
+
+func TestValidateTransferPair(t *testing.T) {
+	out := transferCashflow{Direction: DirectionOut, Amount: "100", Currency: "CNY"}
+	in := transferCashflow{Direction: DirectionIn, Amount: "100.00", Currency: "CNY"}
+	if err := validateTransferPair(out, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateTransferPair(in, out); err == nil {
+		t.Fatal("directions are swapped")
+	}
+	if err := validateTransferPair(out, transferCashflow{Direction: DirectionOut, Amount: "100", Currency: "CNY"}); err == nil {
+		t.Fatal("both are OUT")
+	}
+	if err := validateTransferPair(out, transferCashflow{Direction: DirectionIn, Amount: "99.99", Currency: "CNY"}); err == nil {
+		t.Fatal("amount doesn't match")
+	}
+	if err := validateTransferPair(out, transferCashflow{Direction: DirectionIn, Amount: "100", Currency: "USD"}); err == nil {
+		t.Fatal("currency doesn't match")
+	}
+}
@@ -0,0 +1,218 @@
+package flow
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/curtisnewbie/miso/encoding"
+	"github.com/curtisnewbie/miso/middleware/user-vault/common"
+	"github.com/curtisnewbie/miso/miso"
+	"gorm.io/gorm"
+)
+
+const (
+	UserArchiveVersion = 1
+
+	userArchiveManifest   = "manifest.json"
+	userArchiveCategories = "categories.jsonl"
+	userArchiveTimeFormat = "2006-01-02 15:04:05"
+)
+
+// Table that holds user data, rows are found either by user_no or through the parent table.
+type userDataTable struct {
+	Table     string
+	ParentTab string // parent table with user_no, e.g., envelope for envelope_category
+	ParentKey string // key shared with the parent table
+}
+
+func (t userDataTable) where() string {
+	if t.ParentTab != "" {
+		return fmt.Sprintf("%v IN (SELECT %v FROM %v WHERE user_no = ?)", t.ParentKey, t.ParentKey, t.ParentTab)
+	}
+	return "user_no = ?"
+}
+
+// All tables that hold user data, child tables go before their parents.
+var userDataTables = []userDataTable{
+	{Table: "cashflow"},
+	{Table: "cashflow_tag"},
+	{Table: "cashflow_statistics"},
+	{Table: "cashflow_currency"},
+	{Table: "budget"},
+	{Table: "budget_spending"},
+	{Table: "budget_alert"},
+	{Table: "envelope_category", ParentTab: "envelope", ParentKey: "envelope_no"},
+	{Table: "envelope"},
+	{Table: "saving_goal"},
+	{Table: "cashflow_template"},
+	{Table: "bill_reminder"},
+	{Table: "account_payment_method"},
+	{Table: "account"},
+	{Table: "account_statement"},
+	{Table: "cashflow_reconciliation"},
+	{Table: "net_worth_statistics"},
+	{Table: "installment_plan"},
+	{Table: "loan_repayment"},
+	{Table: "loan"},
+	{Table: "ledger_account_mapping"},
+}
+
+type UserArchiveManifest struct {
+	Version    int
+	UserNo     string
+	Username   string
+	ExportedAt string
+	Tables     map[string]int // number of rows in each table
+}
+
+// Export all data of the user as a zip archive, each table is written as JSON lines, e.g., cashflow.jsonl.
+func ExportUserData(rail miso.Rail, db *gorm.DB, user common.User, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	manifest := UserArchiveManifest{
+		Version:    UserArchiveVersion,
+		UserNo:     user.UserNo,
+		Username:   user.Username,
+		ExportedAt: time.Now().Format(userArchiveTimeFormat),
+		Tables:     map[string]int{},
+	}
+	for _, t := range userDataTables {
+		f, err := zw.Create(t.Table + ".jsonl")
+		if err != nil {
+			return err
+		}
+		n, err := writeUserTable(db, t, user.UserNo, f)
+		if err != nil {
+			return err
+		}
+		manifest.Tables[t.Table] = n
+	}
+
+	// categories are configured, they are included for reference
+	f, err := zw.Create(userArchiveCategories)
+	if err != nil {
+		return err
+	}
+	for _, c := range categoryConfs {
+		if err := encoding.EncodeJson(f, c); err != nil {
+			return err
+		}
+	}
+
+	f, err = zw.Create(userArchiveManifest)
+	if err != nil {
+		return err
+	}
+	if err := encoding.EncodeJson(f, manifest); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	rail.Infof("Exported user data for %v, %+v", user.Username, manifest.Tables)
+	return nil
+}
+
+// Export all data of the current user as a zip archive in the response.
+func ExportUserDataArchive(inb *miso.Inbound, db *gorm.DB) error {
+	rail := inb.Rail()
+	user := common.GetUser(rail)
+	w, _ := inb.Unwrap()
+	name := fmt.Sprintf("acct_%v_%v.zip", user.Username, time.Now().Format("20060102150405"))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, name))
+	w.Header().Set("Content-Type", "application/zip")
+	w.WriteHeader(http.StatusOK)
+
+	// the response is already committed, errors are only logged
+	if err := ExportUserData(rail, db, user, w); err != nil {
+		rail.Errorf("Failed to export user data for %v, %v", user.Username, err)
+	}
+	return nil
+}
+
+func writeUserTable(db *gorm.DB, t userDataTable, userNo string, w io.Writer) (int, error) {
+	rows, err := db.Raw(fmt.Sprintf("SELECT * FROM %v WHERE %v ORDER BY id", t.Table, t.where()), userNo).Rows()
+	if err != nil {
+		return 0, fmt.Errorf("failed to query %v, %w", t.Table, err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	values := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, fmt.Errorf("failed to scan %v, %w", t.Table, err)
+		}
+		row := make(map[string]any, len(cols))
+		for i, c := range cols {
+			row[c] = archiveValue(values[i])
+		}
+		if err := encoding.EncodeJson(w, row); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("failed to iterate %v, %w", t.Table, err)
+	}
+	return n, nil
+}
+
+// Convert column value to json friendly value, datetime is formatted in local time.
+func archiveValue(v any) any {
+	switch t := v.(type) {
+	case []byte:
+		return string(t)
+	case time.Time:
+		return t.In(time.Local).Format(userArchiveTimeFormat)
+	default:
+		return v
+	}
+}
+
+type ApiPurgeUserDataReq struct {
+	Confirm string `desc:"Username of the current user, to confirm that all data is deleted permanently" valid:"notEmpty"`
+}
+
+type ApiPurgeUserDataRes struct {
+	Deleted map[string]int64 `desc:"Number of rows deleted in each table"`
+}
+
+// Hard delete all data of the user, the data can't be recovered unless it's exported beforehand.
+func PurgeUserData(rail miso.Rail, db *gorm.DB, req ApiPurgeUserDataReq, user common.User) (ApiPurgeUserDataRes, error) {
+	if req.Confirm != user.Username {
+		return ApiPurgeUserDataRes{}, miso.NewErrf("Confirmation doesn't match the username")
+	}
+	lock := userCashflowLock(rail, user.UserNo)
+	if err := lock.Lock(); err != nil {
+		return ApiPurgeUserDataRes{}, err
+	}
+	defer lock.Unlock()
+
+	res := ApiPurgeUserDataRes{Deleted: map[string]int64{}}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, t := range userDataTables {
+			r := tx.Exec(fmt.Sprintf("DELETE FROM %v WHERE %v", t.Table, t.where()), user.UserNo)
+			if r.Error != nil {
+				return fmt.Errorf("failed to purge %v, %w", t.Table, r.Error)
+			}
+			res.Deleted[t.Table] = r.RowsAffected
+		}
+		return nil
+	})
+	if err != nil {
+		return ApiPurgeUserDataRes{}, err
+	}
+	rail.Infof("Purged user data for %v, %+v", user.Username, res.Deleted)
+	return res, nil
+}
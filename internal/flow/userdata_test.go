@@ -0,0 +1,38 @@
+package flow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestArchiveValue(t *testing.T) {
+	if v := archiveValue([]byte("12.50")); v != "12.50" {
+		t.Fatalf("bytes: %v", v)
+	}
+	tm := time.Date(2024, 6, 1, 12, 30, 0, 0, time.Local)
+	if v := archiveValue(tm); v != "2024-06-01 12:30:00" {
+		t.Fatalf("time: %v", v)
+	}
+	if v := archiveValue(int64(1)); v != int64(1) {
+		t.Fatalf("int: %v", v)
+	}
+	if v := archiveValue(nil); v != nil {
+		t.Fatalf("nil: %v", v)
+	}
+}
+
+func TestUserDataTablesOrder(t *testing.T) {
+	idx := map[string]int{}
+	for i, t := range userDataTables {
+		idx[t.Table] = i
+	}
+	for _, tb := range userDataTables {
+		if tb.ParentTab == "" {
+			continue
+		}
+		p, ok := idx[tb.ParentTab]
+		if !ok || p < idx[tb.Table] {
+			t.Fatalf("%v should go before its parent %v", tb.Table, tb.ParentTab)
+		}
+	}
+}
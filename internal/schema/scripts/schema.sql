@@ -17,6 +17,11 @@ CREATE TABLE `cashflow` (
   `category` varchar(32) NOT NULL DEFAULT '' COMMENT 'category',
   `remark` varchar(255) NOT NULL DEFAULT '' COMMENT 'remark',
   `payment_method` varchar(32) NOT NULL DEFAULT '' COMMENT 'payment method',
+  `account_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'account no',
+  `transfer_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'transfer no, cashflows of the same transfer share the same transfer no',
+  `installment_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'installment plan no of the purchase or the installment',
+  `stat_excluded` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'excluded from statistics',
+  `extra_values` text GENERATED ALWAYS AS (CAST(JSON_EXTRACT(`extra`, '$.*') AS CHAR)) STORED COMMENT 'values of extra info, for full-text search',
   `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
   `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
   `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
@@ -25,7 +30,11 @@ CREATE TABLE `cashflow` (
   PRIMARY KEY (`id`),
   KEY `user_cate_trans_time_idx` (`user_no`,`category`,`deleted`,`trans_time`),
   KEY `user_trans_time_idx` (`user_no`,`deleted`,`trans_time`),
-  KEY `user_cate_trans_id_idx` (`user_no`,`category`,`trans_id`,`deleted`)
+  KEY `user_cate_trans_id_idx` (`user_no`,`category`,`trans_id`,`deleted`),
+  KEY `user_account_trans_time_idx` (`user_no`,`account_no`,`deleted`,`trans_time`),
+  KEY `user_transfer_no_idx` (`user_no`,`transfer_no`),
+  KEY `user_installment_no_idx` (`user_no`,`installment_no`),
+  FULLTEXT KEY `keyword_ft_idx` (`counterparty`,`remark`,`payment_method`,`extra_values`) WITH PARSER ngram
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Cashflow';
 
 CREATE TABLE `cashflow_statistics` (
@@ -41,7 +50,8 @@ CREATE TABLE `cashflow_statistics` (
   `updated_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'updated by',
   `deleted` tinyint(1) NOT NULL DEFAULT 0 COMMENT 'record deleted',
   PRIMARY KEY (`id`),
-  KEY `user_agg_type_currency_range_idx` (`user_no`, `agg_type`, `currency`, `agg_range`)
+  KEY `user_agg_type_currency_range_idx` (`user_no`, `agg_type`, `currency`, `agg_range`),
+  UNIQUE KEY `user_agg_type_range_currency_uk` (`user_no`, `agg_type`, `agg_range`, `currency`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Cashflow Statistics';
 
 CREATE TABLE `cashflow_currency` (
@@ -55,3 +65,320 @@ CREATE TABLE `cashflow_currency` (
   PRIMARY KEY (`id`),
   UNIQUE KEY `user_currency_uk` (`user_no`,`currency`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='User Cashflow Currency';
+
+CREATE TABLE `fx_rate` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `base_currency` varchar(6) NOT NULL DEFAULT '' COMMENT 'base currency',
+  `quote_currency` varchar(6) NOT NULL DEFAULT '' COMMENT 'quote currency',
+  `rate_date` date NOT NULL COMMENT 'date of the exchange rate',
+  `rate` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'exchange rate, 1 base currency = rate * quote currency',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
+  `updated_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'updated by',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `base_quote_date_uk` (`base_currency`,`quote_currency`,`rate_date`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Daily Exchange Rate';
+
+CREATE TABLE `budget` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `budget_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'budget no',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `name` varchar(64) NOT NULL DEFAULT '' COMMENT 'budget name',
+  `category` varchar(32) NOT NULL DEFAULT '' COMMENT 'category, empty for all categories',
+  `currency` varchar(6) NOT NULL DEFAULT '' COMMENT 'currency',
+  `period_type` varchar(10) NOT NULL DEFAULT '' COMMENT 'budget period type: MONTHLY, YEARLY, WEEKLY',
+  `amount` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'spending limit of each period',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
+  `updated_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'updated by',
+  `deleted` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'record deleted',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `budget_no_uk` (`budget_no`),
+  KEY `user_period_type_idx` (`user_no`,`period_type`,`deleted`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Budget';
+
+CREATE TABLE `budget_spending` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `budget_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'budget no',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `agg_range` varchar(10) NOT NULL DEFAULT '' COMMENT 'aggregation range of the budget period',
+  `spent` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'amount spent in the period',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
+  `updated_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'updated by',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `budget_range_uk` (`budget_no`,`agg_range`),
+  KEY `user_no_idx` (`user_no`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Budget Spending of Each Period';
+
+CREATE TABLE `budget_alert` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `budget_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'budget no',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `agg_range` varchar(10) NOT NULL DEFAULT '' COMMENT 'aggregation range of the budget period',
+  `threshold` int NOT NULL DEFAULT 0 COMMENT 'percentage of budget used that triggered the alert',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `budget_range_threshold_uk` (`budget_no`,`agg_range`,`threshold`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Budget Threshold Alert';
+
+CREATE TABLE `envelope` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `envelope_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'envelope no',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `name` varchar(64) NOT NULL DEFAULT '' COMMENT 'envelope name',
+  `currency` varchar(6) NOT NULL DEFAULT '' COMMENT 'currency',
+  `period_type` varchar(10) NOT NULL DEFAULT '' COMMENT 'envelope period type: MONTHLY, YEARLY, WEEKLY',
+  `allocation` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'amount allocated for each period',
+  `rollover` varchar(10) NOT NULL DEFAULT '' COMMENT 'rollover rule: ALL, SURPLUS, DEFICIT, NONE',
+  `start_range` varchar(10) NOT NULL DEFAULT '' COMMENT 'aggregation range of the first period',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
+  `updated_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'updated by',
+  `deleted` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'record deleted',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `envelope_no_uk` (`envelope_no`),
+  KEY `user_no_idx` (`user_no`,`deleted`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Envelope Budget';
+
+CREATE TABLE `envelope_category` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `envelope_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'envelope no',
+  `category` varchar(32) NOT NULL DEFAULT '' COMMENT 'category',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `envelope_category_uk` (`envelope_no`,`category`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Categories Linked to Envelope';
+
+CREATE TABLE `cashflow_tag` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `category` varchar(32) NOT NULL DEFAULT '' COMMENT 'category of the cashflow',
+  `trans_id` varchar(64) NOT NULL DEFAULT '' COMMENT 'transaction id of the cashflow',
+  `tag` varchar(32) NOT NULL DEFAULT '' COMMENT 'tag',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_cate_trans_id_tag_uk` (`user_no`,`category`,`trans_id`,`tag`),
+  KEY `user_tag_idx` (`user_no`,`tag`),
+  KEY `user_trans_id_idx` (`user_no`,`trans_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Cashflow Tag';
+
+CREATE TABLE `saving_goal` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `goal_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'goal no',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `name` varchar(64) NOT NULL DEFAULT '' COMMENT 'goal name',
+  `target_amount` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'target amount',
+  `currency` varchar(6) NOT NULL DEFAULT '' COMMENT 'currency',
+  `deadline` datetime DEFAULT NULL COMMENT 'deadline',
+  `match_type` varchar(10) NOT NULL DEFAULT '' COMMENT 'how cashflows are matched: TAG, CATEGORY',
+  `match_value` varchar(32) NOT NULL DEFAULT '' COMMENT 'tag or category of the cashflows',
+  `direction` varchar(6) NOT NULL DEFAULT '' COMMENT 'direction of cashflows that contribute to the goal: IN / OUT',
+  `start_time` datetime DEFAULT NULL COMMENT 'only cashflows after start time are included',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
+  `updated_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'updated by',
+  `deleted` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'record deleted',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `goal_no_uk` (`goal_no`),
+  KEY `user_no_idx` (`user_no`,`deleted`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Saving Goal';
+
+CREATE TABLE `cashflow_template` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `template_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'template no',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `name` varchar(64) NOT NULL DEFAULT '' COMMENT 'template name',
+  `direction` varchar(6) NOT NULL DEFAULT '' COMMENT 'flow direction: IN / OUT',
+  `amount` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'amount',
+  `currency` varchar(6) NOT NULL DEFAULT '' COMMENT 'currency',
+  `counterparty` varchar(255) NOT NULL DEFAULT '' COMMENT 'counterparty',
+  `payment_method` varchar(32) NOT NULL DEFAULT '' COMMENT 'payment method',
+  `category` varchar(32) NOT NULL DEFAULT '' COMMENT 'category of the created cashflows',
+  `remark` varchar(255) NOT NULL DEFAULT '' COMMENT 'remark',
+  `schedule` varchar(64) NOT NULL DEFAULT '' COMMENT 'cron expression',
+  `end_time` datetime DEFAULT NULL COMMENT 'cashflows are no longer created after end time',
+  `next_due_time` datetime DEFAULT NULL COMMENT 'next due time',
+  `enabled` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'template enabled',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
+  `updated_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'updated by',
+  `deleted` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'record deleted',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `template_no_uk` (`template_no`),
+  KEY `user_no_idx` (`user_no`,`deleted`),
+  KEY `next_due_time_idx` (`enabled`,`deleted`,`next_due_time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Cashflow Template';
+
+CREATE TABLE `bill_reminder` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `bill_key` varchar(64) NOT NULL DEFAULT '' COMMENT 'template no or key of the detected subscription',
+  `due_date` varchar(10) NOT NULL DEFAULT '' COMMENT 'due date of the bill',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_bill_due_date_uk` (`user_no`,`bill_key`,`due_date`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Bill Reminder';
+
+CREATE TABLE `account` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `account_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'account no',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `name` varchar(64) NOT NULL DEFAULT '' COMMENT 'account name',
+  `account_type` varchar(20) NOT NULL DEFAULT '' COMMENT 'account type: CASH, DEBIT_CARD, CREDIT_CARD, E_WALLET, INVESTMENT, OTHER',
+  `currency` varchar(6) NOT NULL DEFAULT '' COMMENT 'currency',
+  `opening_balance` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'opening balance',
+  `opening_time` datetime DEFAULT NULL COMMENT 'time of the opening balance',
+  `cycle_close_day` int NOT NULL DEFAULT 0 COMMENT 'day of month the billing cycle closes, only for credit card',
+  `payment_due_day` int NOT NULL DEFAULT 0 COMMENT 'day of month the payment is due, only for credit card',
+  `min_payment_pct` decimal(5,2) NOT NULL DEFAULT '0.00' COMMENT 'minimum payment in percentage of statement total, only for credit card',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
+  `updated_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'updated by',
+  `deleted` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'record deleted',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `account_no_uk` (`account_no`),
+  KEY `user_no_idx` (`user_no`,`deleted`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Account';
+
+CREATE TABLE `account_payment_method` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `payment_method` varchar(32) NOT NULL DEFAULT '' COMMENT 'payment method',
+  `account_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'account no',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_payment_method_uk` (`user_no`,`payment_method`),
+  KEY `account_no_idx` (`account_no`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Payment Method to Account Mapping';
+
+CREATE TABLE `account_statement` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `statement_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'statement no',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `account_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'account no',
+  `statement_date` datetime NOT NULL COMMENT 'closing date of the statement',
+  `closing_balance` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'closing balance on the statement',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
+  `updated_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'updated by',
+  `deleted` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'record deleted',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `statement_no_uk` (`statement_no`),
+  KEY `user_account_date_idx` (`user_no`,`account_no`,`deleted`,`statement_date`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Account Statement';
+
+CREATE TABLE `cashflow_reconciliation` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `category` varchar(32) NOT NULL DEFAULT '' COMMENT 'category of the cashflow',
+  `trans_id` varchar(64) NOT NULL DEFAULT '' COMMENT 'transaction id of the cashflow',
+  `statement_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'statement no',
+  `direction` varchar(6) NOT NULL DEFAULT '' COMMENT 'flow direction when it is reconciled',
+  `trans_time` datetime DEFAULT NULL COMMENT 'transaction time when it is reconciled',
+  `amount` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'amount when it is reconciled',
+  `currency` varchar(6) NOT NULL DEFAULT '' COMMENT 'currency when it is reconciled',
+  `account_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'account no when it is reconciled',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_cate_trans_id_uk` (`user_no`,`category`,`trans_id`),
+  KEY `statement_no_idx` (`statement_no`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Reconciled Cashflow Snapshot';
+
+CREATE TABLE `net_worth_statistics` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `agg_range` varchar(10) NOT NULL DEFAULT '' COMMENT 'aggregation range, month value',
+  `base_currency` varchar(6) NOT NULL DEFAULT '' COMMENT 'base currency',
+  `assets` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'total balance of asset accounts',
+  `liabilities` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'total amount owed on liability accounts',
+  `net_worth` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'assets - liabilities',
+  `stale` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'snapshot is stale and should be recalculated',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_range_currency_uk` (`user_no`,`agg_range`,`base_currency`),
+  KEY `stale_idx` (`stale`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Monthly Net Worth Snapshot';
+
+CREATE TABLE `installment_plan` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `plan_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'installment plan no',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `category` varchar(32) NOT NULL DEFAULT '' COMMENT 'category of the purchase',
+  `trans_id` varchar(64) NOT NULL DEFAULT '' COMMENT 'transaction id of the purchase',
+  `periods` int NOT NULL DEFAULT 0 COMMENT 'number of installment periods',
+  `principal` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'amount of the purchase',
+  `fee` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'total fee or interest',
+  `currency` varchar(6) NOT NULL DEFAULT '' COMMENT 'currency',
+  `first_due_time` datetime DEFAULT NULL COMMENT 'due time of the first installment',
+  `amortised` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'purchase is amortised over the plan in statistics',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
+  `updated_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'updated by',
+  `deleted` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'record deleted',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `plan_no_uk` (`plan_no`),
+  KEY `user_no_idx` (`user_no`,`deleted`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Installment Plan';
+
+CREATE TABLE `loan` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `loan_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'loan no',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `name` varchar(64) NOT NULL DEFAULT '' COMMENT 'loan name',
+  `counterparty` varchar(255) NOT NULL DEFAULT '' COMMENT 'lender',
+  `account_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'account no of the repayments',
+  `principal` decimal(22,8) NOT NULL DEFAULT '0.00000000' COMMENT 'principal',
+  `annual_rate` decimal(10,6) NOT NULL DEFAULT '0.000000' COMMENT 'annual interest rate in percentage',
+  `term_months` int NOT NULL DEFAULT 0 COMMENT 'term in months',
+  `repayment_method` varchar(32) NOT NULL DEFAULT '' COMMENT 'repayment method: EQUAL_INSTALLMENT, EQUAL_PRINCIPAL',
+  `currency` varchar(6) NOT NULL DEFAULT '' COMMENT 'currency',
+  `first_due_time` datetime DEFAULT NULL COMMENT 'due time of the first repayment',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
+  `updated_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'updated by',
+  `deleted` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'record deleted',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `loan_no_uk` (`loan_no`),
+  KEY `user_no_idx` (`user_no`,`deleted`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Loan';
+
+CREATE TABLE `loan_repayment` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `loan_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'loan no',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `period` int NOT NULL DEFAULT 0 COMMENT 'period, starting from 1',
+  `category` varchar(32) NOT NULL DEFAULT '' COMMENT 'category of the repayment cashflow',
+  `trans_id` varchar(64) NOT NULL DEFAULT '' COMMENT 'transaction id of the repayment cashflow',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `loan_period_uk` (`loan_no`,`period`),
+  UNIQUE KEY `user_cashflow_uk` (`user_no`,`category`,`trans_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Loan Repayment';
+
+CREATE TABLE `ledger_account_mapping` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT COMMENT 'primary key',
+  `user_no` varchar(32) NOT NULL DEFAULT '' COMMENT 'user no',
+  `mapping_type` varchar(16) NOT NULL DEFAULT '' COMMENT 'mapping type: EXPENSE, INCOME, ASSET',
+  `source` varchar(255) NOT NULL DEFAULT '' COMMENT 'category code or payment method',
+  `ledger_account` varchar(255) NOT NULL DEFAULT '' COMMENT 'ledger account',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'created at',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'created by',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'updated at',
+  `updated_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'updated by',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_mapping_uk` (`user_no`,`mapping_type`,`source`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='Ledger Account Mapping';
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/curtisnewbie/acct/internal/flow"
+	"github.com/curtisnewbie/miso/miso"
+)
+
+const (
+	CmdImportFxRates = "import-fx-rates"
+)
+
+// Check whether the args are for one of the CLI commands instead of bootstrapping the server.
+func IsCliCommand(args []string) bool {
+	return len(args) > 1 && args[1] == CmdImportFxRates
+}
+
+// Run CLI command, args are in the same KEY=VALUE syntax used by the server, e.g.,
+//
+//	acct import-fx-rates configFile=conf.yml format=ECB file=eurofxref-hist.xml
+func RunCliCommand(args []string) {
+	rail := miso.EmptyRail()
+	if err := runCliCommand(rail, args); err != nil {
+		rail.Errorf("Command failed, %v", err)
+		os.Exit(1)
+	}
+}
+
+func runCliCommand(rail miso.Rail, args []string) error {
+	miso.DefaultReadConfig(args, rail)
+	if err := miso.ConfigureLogging(rail); err != nil {
+		return err
+	}
+
+	switch args[1] {
+	case CmdImportFxRates:
+		format := miso.ExtractArgValue(args, func(key string) bool { return key == "format" })
+		file := miso.ExtractArgValue(args, func(key string) bool { return key == "file" })
+		if file == "" {
+			return fmt.Errorf("missing file, usage: %v file=/path/to/file format=ECB|CSV", CmdImportFxRates)
+		}
+		if format == "" {
+			format = flow.FxRateFormatEcb
+		}
+		if err := miso.InitMySQLFromProp(rail); err != nil {
+			return err
+		}
+		n, err := flow.ImportFxRateFile(rail, miso.GetMySQL(), format, file)
+		if err != nil {
+			return err
+		}
+		rail.Infof("Imported %d exchange rates from %v", n, file)
+	}
+	return nil
+}
@@ -28,6 +28,15 @@ func PreServerBootstrap(rail miso.Rail) error {
 	// declare http endpoints, jobs/tasks, and other components here
 	web.RegisterEndpoints(rail)
 	flow.LoadCategoryConfs(rail)
+	if err := flow.ScheduleCashflowTemplateJob(); err != nil {
+		return err
+	}
+	if err := flow.ScheduleBillReminderJob(); err != nil {
+		return err
+	}
+	if err := flow.ScheduleNetWorthJob(); err != nil {
+		return err
+	}
 
 	return nil
 }
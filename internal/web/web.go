@@ -9,6 +9,7 @@ import (
 
 const (
 	CodeManageCashflows = "acct:ManageCashflows"
+	CodeManageFxRates   = "acct:ManageFxRates"
 )
 
 func RegisterEndpoints(rail miso.Rail) {
@@ -16,14 +17,78 @@ func RegisterEndpoints(rail miso.Rail) {
 	auth.ExposeResourceInfo([]auth.Resource{{
 		Code: CodeManageCashflows,
 		Name: "Manage Personal Cashflows",
+	}, {
+		Code: CodeManageFxRates,
+		Name: "Manage Exchange Rates",
 	}})
 
 	miso.GroupRoute("/open/api/v1",
 		miso.IPost("/cashflow/list", ApiListCashFlows).Resource(CodeManageCashflows),
 		miso.Post("/cashflow/import/wechat", ApiImportWechatCashflows).Resource(CodeManageCashflows),
+		miso.RawPost("/cashflow/export", ApiExportCashflows).Resource(CodeManageCashflows),
+		miso.RawPost("/cashflow/export/ledger", ApiExportLedger).Resource(CodeManageCashflows),
+		miso.RawGet("/user-data/export", ApiExportUserData).Resource(CodeManageCashflows),
+		miso.IPost("/user-data/purge", ApiPurgeUserData).Resource(CodeManageCashflows),
+		miso.Post("/user-data/restore", ApiRestoreUserData).Resource(CodeManageCashflows),
+		miso.Post("/cashflow/import/ledger", ApiImportJournal).Resource(CodeManageCashflows),
+		miso.Get("/ledger-mapping/list", ApiListLedgerMappings).Resource(CodeManageCashflows),
+		miso.IPost("/ledger-mapping/save", ApiSaveLedgerMapping).Resource(CodeManageCashflows),
+		miso.IPost("/ledger-mapping/delete", ApiDeleteLedgerMapping).Resource(CodeManageCashflows),
 		miso.Get("/cashflow/list-currency", ApiListCurrency).Resource(CodeManageCashflows),
 		miso.IPost("/cashflow/list-statistics", ApiListCashflowStatistics).Resource(CodeManageCashflows),
 		miso.IPost("/cashflow/plot-statistics", ApiPlotCashflowStatistics).Resource(CodeManageCashflows),
+		miso.IPost("/cashflow/compare-statistics", ApiCompareCashflowStatistics).Resource(CodeManageCashflows),
+		miso.IPost("/cashflow/detect-recurring", ApiDetectRecurringCashflows).Resource(CodeManageCashflows),
+		miso.IPost("/cashflow/tag/add", ApiTagCashflow).Resource(CodeManageCashflows),
+		miso.IPost("/cashflow/tag/remove", ApiUntagCashflow).Resource(CodeManageCashflows),
+		miso.Get("/cashflow/list-tags", ApiListTags).Resource(CodeManageCashflows),
+		miso.IPost("/budget/list", ApiListBudgets).Resource(CodeManageCashflows),
+		miso.IPost("/budget/save", ApiSaveBudget).Resource(CodeManageCashflows),
+		miso.IPost("/budget/delete", ApiDeleteBudget).Resource(CodeManageCashflows),
+		miso.IPost("/budget/progress", ApiBudgetProgress).Resource(CodeManageCashflows),
+		miso.IPost("/envelope/list", ApiListEnvelopes).Resource(CodeManageCashflows),
+		miso.IPost("/envelope/save", ApiSaveEnvelope).Resource(CodeManageCashflows),
+		miso.IPost("/envelope/delete", ApiDeleteEnvelope).Resource(CodeManageCashflows),
+		miso.IPost("/envelope/balances", ApiEnvelopeBalances).Resource(CodeManageCashflows),
+		miso.IPost("/goal/save", ApiSaveGoal).Resource(CodeManageCashflows),
+		miso.IPost("/goal/delete", ApiDeleteGoal).Resource(CodeManageCashflows),
+		miso.Get("/goal/progress", ApiGoalProgress).Resource(CodeManageCashflows),
+		miso.IPost("/cashflow-template/list", ApiListCashflowTemplates).Resource(CodeManageCashflows),
+		miso.IPost("/cashflow-template/save", ApiSaveCashflowTemplate).Resource(CodeManageCashflows),
+		miso.IPost("/cashflow-template/delete", ApiDeleteCashflowTemplate).Resource(CodeManageCashflows),
+		miso.IPost("/cashflow/link-account", ApiLinkCashflowAccount).Resource(CodeManageCashflows),
+		miso.IPost("/transfer/link", ApiLinkTransfer).Resource(CodeManageCashflows),
+		miso.IPost("/transfer/unlink", ApiUnlinkTransfer).Resource(CodeManageCashflows),
+		miso.IPost("/transfer/suggest", ApiSuggestTransfers).Resource(CodeManageCashflows),
+		miso.Get("/account/list", ApiListAccounts).Resource(CodeManageCashflows),
+		miso.IPost("/account/save", ApiSaveAccount).Resource(CodeManageCashflows),
+		miso.IPost("/account/delete", ApiDeleteAccount).Resource(CodeManageCashflows),
+		miso.IPost("/account/balance-history", ApiAccountBalanceHistory).Resource(CodeManageCashflows),
+		miso.IPost("/account/credit-cycles", ApiCreditCycles).Resource(CodeManageCashflows),
+		miso.IPost("/installment/list", ApiListInstallmentPlans).Resource(CodeManageCashflows),
+		miso.IPost("/installment/create", ApiCreateInstallmentPlan).Resource(CodeManageCashflows),
+		miso.IPost("/installment/amortise", ApiAmortiseInstallmentPlan).Resource(CodeManageCashflows),
+		miso.IPost("/installment/cancel", ApiCancelInstallmentPlan).Resource(CodeManageCashflows),
+		miso.IPost("/loan/list", ApiListLoans).Resource(CodeManageCashflows),
+		miso.IPost("/loan/save", ApiSaveLoan).Resource(CodeManageCashflows),
+		miso.IPost("/loan/delete", ApiDeleteLoan).Resource(CodeManageCashflows),
+		miso.IPost("/loan/schedule", ApiLoanSchedule).Resource(CodeManageCashflows),
+		miso.IPost("/loan/match-repayments", ApiMatchLoanRepayments).Resource(CodeManageCashflows),
+		miso.IPost("/loan/link-repayment", ApiLinkLoanRepayment).Resource(CodeManageCashflows),
+		miso.IPost("/loan/unlink-repayment", ApiUnlinkLoanRepayment).Resource(CodeManageCashflows),
+		miso.IPost("/statement/list", ApiListStatements).Resource(CodeManageCashflows),
+		miso.IPost("/statement/save", ApiSaveStatement).Resource(CodeManageCashflows),
+		miso.IPost("/statement/delete", ApiDeleteStatement).Resource(CodeManageCashflows),
+		miso.IPost("/statement/reconcile", ApiReconcileStatement).Resource(CodeManageCashflows),
+		miso.IPost("/statement/mark-reconciled", ApiMarkReconciled).Resource(CodeManageCashflows),
+		miso.IPost("/statement/unmark-reconciled", ApiUnmarkReconciled).Resource(CodeManageCashflows),
+		miso.Get("/statement/list-flagged", ApiListFlaggedReconciliations).Resource(CodeManageCashflows),
+		miso.IPost("/net-worth/plot", ApiPlotNetWorth).Resource(CodeManageCashflows),
+		miso.IPost("/net-worth/recalc", ApiRecalcNetWorth).Resource(CodeManageCashflows),
+		miso.IPost("/bill/upcoming", ApiUpcomingBills).Resource(CodeManageCashflows),
+		miso.IPost("/fx-rate/list", ApiListFxRates).Resource(CodeManageCashflows),
+		miso.IPost("/fx-rate/save", ApiSaveFxRates).Resource(CodeManageFxRates),
+		miso.Post("/fx-rate/import", ApiImportFxRates).Resource(CodeManageFxRates),
 	)
 }
 
@@ -35,6 +100,48 @@ func ApiImportWechatCashflows(inb *miso.Inbound) (any, error) {
 	return nil, flow.ImportWechatCashflows(inb, miso.GetMySQL())
 }
 
+func ApiExportCashflows(inb *miso.Inbound) {
+	if err := flow.ExportCashflows(inb, miso.GetMySQL()); err != nil {
+		inb.HandleResult(nil, err)
+	}
+}
+
+func ApiExportLedger(inb *miso.Inbound) {
+	if err := flow.ExportLedger(inb, miso.GetMySQL()); err != nil {
+		inb.HandleResult(nil, err)
+	}
+}
+
+func ApiImportJournal(inb *miso.Inbound) (flow.ApiImportJournalRes, error) {
+	return flow.ImportUploadedJournal(inb, miso.GetMySQL())
+}
+
+func ApiExportUserData(inb *miso.Inbound) {
+	if err := flow.ExportUserDataArchive(inb, miso.GetMySQL()); err != nil {
+		inb.HandleResult(nil, err)
+	}
+}
+
+func ApiPurgeUserData(inb *miso.Inbound, req flow.ApiPurgeUserDataReq) (flow.ApiPurgeUserDataRes, error) {
+	return flow.PurgeUserData(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiRestoreUserData(inb *miso.Inbound) (flow.ApiRestoreUserDataRes, error) {
+	return flow.RestoreUploadedUserData(inb, miso.GetMySQL())
+}
+
+func ApiListLedgerMappings(inb *miso.Inbound) ([]flow.ApiLedgerMapping, error) {
+	return flow.ListLedgerMappings(inb.Rail(), miso.GetMySQL(), common.GetUser(inb.Rail()))
+}
+
+func ApiSaveLedgerMapping(inb *miso.Inbound, req flow.ApiSaveLedgerMappingReq) (any, error) {
+	return nil, flow.SaveLedgerMapping(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiDeleteLedgerMapping(inb *miso.Inbound, req flow.ApiDeleteLedgerMappingReq) (any, error) {
+	return nil, flow.DeleteLedgerMapping(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
 func ApiListCashflowStatistics(inb *miso.Inbound, req flow.ApiListStatisticsReq) (miso.PageRes[flow.ApiListStatisticsRes], error) {
 	return flow.ListCashflowStatistics(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
 }
@@ -46,3 +153,211 @@ func ApiListCurrency(inb *miso.Inbound) ([]string, error) {
 func ApiPlotCashflowStatistics(inb *miso.Inbound, req flow.ApiPlotStatisticsReq) ([]flow.ApiPlotStatisticsRes, error) {
 	return flow.PlotCashflowStatistics(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
 }
+
+func ApiCompareCashflowStatistics(inb *miso.Inbound, req flow.ApiCompareStatisticsReq) ([]flow.ApiCompareStatisticsRes, error) {
+	return flow.CompareCashflowStatistics(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiDetectRecurringCashflows(inb *miso.Inbound, req flow.ApiDetectRecurringReq) ([]flow.ApiRecurringCashflow, error) {
+	return flow.DetectRecurringCashflows(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiTagCashflow(inb *miso.Inbound, req flow.ApiTagCashflowReq) (any, error) {
+	return nil, flow.TagCashflow(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiUntagCashflow(inb *miso.Inbound, req flow.ApiTagCashflowReq) (any, error) {
+	return nil, flow.UntagCashflow(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiListTags(inb *miso.Inbound) ([]string, error) {
+	return flow.ListTags(inb.Rail(), miso.GetMySQL(), common.GetUser(inb.Rail()))
+}
+
+func ApiListBudgets(inb *miso.Inbound, req flow.ApiListBudgetReq) (miso.PageRes[flow.ApiListBudgetRes], error) {
+	return flow.ListBudgets(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiSaveBudget(inb *miso.Inbound, req flow.ApiSaveBudgetReq) (string, error) {
+	return flow.SaveBudget(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiDeleteBudget(inb *miso.Inbound, req flow.ApiBudgetNoReq) (any, error) {
+	return nil, flow.DeleteBudget(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiBudgetProgress(inb *miso.Inbound, req flow.ApiBudgetProgressReq) ([]flow.ApiBudgetProgressRes, error) {
+	return flow.BudgetProgress(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiListEnvelopes(inb *miso.Inbound, req flow.ApiListEnvelopeReq) (miso.PageRes[flow.ApiListEnvelopeRes], error) {
+	return flow.ListEnvelopes(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiSaveEnvelope(inb *miso.Inbound, req flow.ApiSaveEnvelopeReq) (string, error) {
+	return flow.SaveEnvelope(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiDeleteEnvelope(inb *miso.Inbound, req flow.ApiEnvelopeNoReq) (any, error) {
+	return nil, flow.DeleteEnvelope(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiEnvelopeBalances(inb *miso.Inbound, req flow.ApiEnvelopeBalancesReq) ([]flow.ApiEnvelopeBalance, error) {
+	return flow.EnvelopeBalances(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiSaveGoal(inb *miso.Inbound, req flow.ApiSaveGoalReq) (string, error) {
+	return flow.SaveGoal(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiDeleteGoal(inb *miso.Inbound, req flow.ApiGoalNoReq) (any, error) {
+	return nil, flow.DeleteGoal(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiGoalProgress(inb *miso.Inbound) ([]flow.ApiGoalProgressRes, error) {
+	return flow.GoalProgress(inb.Rail(), miso.GetMySQL(), common.GetUser(inb.Rail()))
+}
+
+func ApiListCashflowTemplates(inb *miso.Inbound, req flow.ApiListCashflowTemplateReq) (miso.PageRes[flow.ApiListCashflowTemplateRes], error) {
+	return flow.ListCashflowTemplates(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiSaveCashflowTemplate(inb *miso.Inbound, req flow.ApiSaveCashflowTemplateReq) (string, error) {
+	return flow.SaveCashflowTemplate(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiDeleteCashflowTemplate(inb *miso.Inbound, req flow.ApiCashflowTemplateNoReq) (any, error) {
+	return nil, flow.DeleteCashflowTemplate(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiListInstallmentPlans(inb *miso.Inbound, req flow.ApiListInstallmentPlanReq) (miso.PageRes[flow.ApiListInstallmentPlanRes], error) {
+	return flow.ListInstallmentPlans(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiCreateInstallmentPlan(inb *miso.Inbound, req flow.ApiCreateInstallmentReq) (string, error) {
+	return flow.CreateInstallmentPlan(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiAmortiseInstallmentPlan(inb *miso.Inbound, req flow.ApiAmortiseInstallmentReq) (any, error) {
+	return nil, flow.AmortiseInstallmentPlan(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiCancelInstallmentPlan(inb *miso.Inbound, req flow.ApiInstallmentPlanNoReq) (any, error) {
+	return nil, flow.CancelInstallmentPlan(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiListLoans(inb *miso.Inbound, req flow.ApiListLoanReq) (miso.PageRes[flow.ApiListLoanRes], error) {
+	return flow.ListLoans(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiSaveLoan(inb *miso.Inbound, req flow.ApiSaveLoanReq) (string, error) {
+	return flow.SaveLoan(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiDeleteLoan(inb *miso.Inbound, req flow.ApiLoanNoReq) (any, error) {
+	return nil, flow.DeleteLoan(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiLoanSchedule(inb *miso.Inbound, req flow.ApiLoanNoReq) (flow.ApiLoanScheduleRes, error) {
+	return flow.LoanSchedule(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiMatchLoanRepayments(inb *miso.Inbound, req flow.ApiLoanNoReq) (int, error) {
+	return flow.MatchLoanRepayments(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiLinkLoanRepayment(inb *miso.Inbound, req flow.ApiLinkLoanRepaymentReq) (any, error) {
+	return nil, flow.LinkLoanRepayment(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiUnlinkLoanRepayment(inb *miso.Inbound, req flow.ApiUnlinkLoanRepaymentReq) (any, error) {
+	return nil, flow.UnlinkLoanRepayment(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiListStatements(inb *miso.Inbound, req flow.ApiListStatementReq) (miso.PageRes[flow.ApiListStatementRes], error) {
+	return flow.ListStatements(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiSaveStatement(inb *miso.Inbound, req flow.ApiSaveStatementReq) (string, error) {
+	return flow.SaveStatement(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiDeleteStatement(inb *miso.Inbound, req flow.ApiStatementNoReq) (any, error) {
+	return nil, flow.DeleteStatement(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiReconcileStatement(inb *miso.Inbound, req flow.ApiStatementNoReq) (flow.ApiReconcileStatementRes, error) {
+	return flow.ReconcileStatement(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiMarkReconciled(inb *miso.Inbound, req flow.ApiMarkReconciledReq) (any, error) {
+	return nil, flow.MarkReconciled(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiUnmarkReconciled(inb *miso.Inbound, req flow.ApiUnmarkReconciledReq) (any, error) {
+	return nil, flow.UnmarkReconciled(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiListFlaggedReconciliations(inb *miso.Inbound) ([]flow.ApiFlaggedReconciliation, error) {
+	return flow.ListFlaggedReconciliations(inb.Rail(), miso.GetMySQL(), common.GetUser(inb.Rail()))
+}
+
+func ApiPlotNetWorth(inb *miso.Inbound, req flow.ApiPlotNetWorthReq) ([]flow.ApiPlotNetWorthRes, error) {
+	return flow.PlotNetWorth(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiRecalcNetWorth(inb *miso.Inbound, req flow.ApiRecalcNetWorthReq) (any, error) {
+	return nil, flow.RecalcNetWorth(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiUpcomingBills(inb *miso.Inbound, req flow.ApiUpcomingBillsReq) ([]flow.ApiUpcomingBill, error) {
+	return flow.UpcomingBills(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiLinkCashflowAccount(inb *miso.Inbound, req flow.ApiLinkCashflowAccountReq) (any, error) {
+	return nil, flow.LinkCashflowAccount(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiLinkTransfer(inb *miso.Inbound, req flow.ApiLinkTransferReq) (string, error) {
+	return flow.LinkTransfer(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiUnlinkTransfer(inb *miso.Inbound, req flow.ApiTransferNoReq) (any, error) {
+	return nil, flow.UnlinkTransfer(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiSuggestTransfers(inb *miso.Inbound, req flow.ApiSuggestTransfersReq) ([]flow.ApiTransferSuggestion, error) {
+	return flow.SuggestTransfers(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiListAccounts(inb *miso.Inbound) ([]flow.ApiListAccountRes, error) {
+	return flow.ListAccounts(inb.Rail(), miso.GetMySQL(), common.GetUser(inb.Rail()))
+}
+
+func ApiSaveAccount(inb *miso.Inbound, req flow.ApiSaveAccountReq) (string, error) {
+	return flow.SaveAccount(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiDeleteAccount(inb *miso.Inbound, req flow.ApiAccountNoReq) (any, error) {
+	return nil, flow.DeleteAccount(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiAccountBalanceHistory(inb *miso.Inbound, req flow.ApiAccountBalanceHistoryReq) ([]flow.ApiAccountBalance, error) {
+	return flow.AccountBalanceHistory(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiCreditCycles(inb *miso.Inbound, req flow.ApiCreditCyclesReq) ([]flow.ApiCreditCycle, error) {
+	return flow.CreditCycles(inb.Rail(), miso.GetMySQL(), req, common.GetUser(inb.Rail()))
+}
+
+func ApiListFxRates(inb *miso.Inbound, req flow.ApiListFxRatesReq) (miso.PageRes[flow.ApiFxRate], error) {
+	return flow.ListFxRates(inb.Rail(), miso.GetMySQL(), req)
+}
+
+func ApiSaveFxRates(inb *miso.Inbound, req flow.ApiSaveFxRatesReq) (any, error) {
+	return nil, flow.SaveFxRates(inb.Rail(), miso.GetMySQL(), req)
+}
+
+func ApiImportFxRates(inb *miso.Inbound) (flow.ApiImportFxRatesRes, error) {
+	return flow.ImportUploadedFxRates(inb, miso.GetMySQL())
+}
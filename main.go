@@ -1,9 +1,15 @@
 package main
 
 import (
+	"os"
+
 	"github.com/curtisnewbie/acct/internal/server"
 )
 
 func main() {
+	if server.IsCliCommand(os.Args) {
+		server.RunCliCommand(os.Args)
+		return
+	}
 	server.BootstrapServer()
 }